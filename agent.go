@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/DemmyDemon/hardnote/storage"
+)
+
+// agentSocketEnv is where the agent tells the commands run after it which socket it listens on.
+const agentSocketEnv = "HARDNOTE_AGENT_SOCK"
+
+// agentTimeout is how long the agent keeps the key without anyone using it, unless told otherwise.
+const agentTimeout = 15 * time.Minute
+
+// agentDial is how long a command waits for the agent to answer before doing without it.
+const agentDial = 2 * time.Second
+
+// agentRequest is a line sent to the agent.
+type agentRequest struct {
+	Op    string `json:"op"`              // "key", "status" or "lock"
+	Vault string `json:"vault,omitempty"` // Absolute filename of the vault the key is wanted for
+}
+
+// agentResponse is the line the agent answers with.
+type agentResponse struct {
+	Error   string    `json:"error,omitempty"`
+	Key     []byte    `json:"key,omitempty"`
+	Vault   string    `json:"vault,omitempty"`
+	Pid     int       `json:"pid,omitempty"`
+	Timeout string    `json:"timeout,omitempty"`
+	LocksAt time.Time `json:"locks_at,omitzero"`
+}
+
+// agentStatus is what the status command tells about the agent.
+type agentStatus struct {
+	Socket  string    `json:"socket"`
+	Vault   string    `json:"vault"`
+	Pid     int       `json:"pid"`
+	Timeout string    `json:"timeout"`
+	LocksAt time.Time `json:"locks_at,omitzero"`
+}
+
+// agentSocket is where the agent listens, unless it was told otherwise.
+// The directory it is in is only for the user, as the socket hands out the key to anyone who can connect to it.
+func agentSocket() string {
+	if socket := os.Getenv(agentSocketEnv); socket != "" {
+		return socket
+	}
+	if runtime := os.Getenv("XDG_RUNTIME_DIR"); runtime != "" {
+		return filepath.Join(runtime, "hardnote", "agent.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("hardnote-%d", os.Getuid()), "agent.sock")
+}
+
+// askAgent sends the request to the agent listening on the socket, and returns its answer.
+func askAgent(socket string, request agentRequest) (agentResponse, error) {
+	response := agentResponse{}
+	conn, err := net.DialTimeout("unix", socket, agentDial)
+	if err != nil {
+		return response, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(agentDial))
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return response, err
+	}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return response, err
+	}
+	if response.Error != "" {
+		return response, errors.New(response.Error)
+	}
+	return response, nil
+}
+
+// agentUnlock opens the vault with the key the agent holds for it, or returns false to have the passphrase asked for.
+func agentUnlock(filename string) (storage.Storage, bool) {
+	vault, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, false
+	}
+	response, err := askAgent(agentSocket(), agentRequest{Op: "key", Vault: vault})
+	if err != nil {
+		return nil, false
+	}
+	defer clear(response.Key)
+	store, err := storage.Open(filename, nil, storage.WithDerivedKey(response.Key))
+	if errors.Is(err, storage.ErrInvalidKey) || errors.Is(err, storage.ErrNeedPassphrase) {
+		return nil, false // Rekeyed since the agent got the key, most likely
+	}
+	must(exitOpen, "Could not open storage", err)
+	return store, true
+}
+
+// agentForget locks the agent if it holds the key for the vault, as after a rekey the key is no use to anyone.
+func agentForget(filename string) {
+	vault, err := filepath.Abs(filename)
+	if err != nil {
+		return
+	}
+	socket := agentSocket()
+	response, err := askAgent(socket, agentRequest{Op: "status"})
+	if err == nil && response.Vault == vault {
+		askAgent(socket, agentRequest{Op: "lock"})
+	}
+}
+
+// agent unlocks the vault and keeps its key in memory, handing it to the commands run after it.
+// Unless told to stay in the foreground, it goes to the background once the vault is unlocked,
+// and prints shell commands pointing the other commands at it, just like ssh-agent.
+func agent(args []string) {
+	flags := flag.NewFlagSet("agent", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", agentTimeout, "lock after going unused this long, or never if 0")
+	socket := flags.String("socket", agentSocket(), "unix socket to listen on")
+	foreground := flags.Bool("foreground", false, "stay in the foreground instead of going to the background")
+	keyFd := flags.Int("key-fd", -1, "read the derived key from this file descriptor, used when going to the background")
+	var source passphraseSource
+	source.register(flags)
+	parseFlags(flags, args, 1, "Specify the vault to hold the key for!")
+	if *timeout < 0 {
+		must(exitUsage, "Could not start agent", errors.New("the timeout can't be negative"))
+	}
+
+	vault, err := filepath.Abs(flags.Arg(0))
+	must(exitNoFile, "Could not get information about the specified file", err)
+	_, err = os.Stat(vault)
+	must(exitNoFile, "Could not get information about the specified file", err)
+
+	var key []byte
+	if *keyFd >= 0 {
+		file := os.NewFile(uintptr(*keyFd), "key")
+		if file == nil {
+			must(exitPassphrase, "Reading key failed", fmt.Errorf("file descriptor %d is not open", *keyFd))
+		}
+		key, err = io.ReadAll(io.LimitReader(file, maxPassphrase))
+		file.Close()
+		must(exitPassphrase, "Reading key failed", err)
+	} else {
+		key = agentDeriveKey(vault, source)
+	}
+	defer clear(key)
+
+	if !*foreground && *keyFd < 0 {
+		agentDetach(vault, key, *socket, *timeout)
+		return
+	}
+
+	listener := agentListen(*socket)
+	if *keyFd >= 0 {
+		// Tell the process that started this one that all is well, and let go of its terminal.
+		fmt.Println(*socket)
+		os.Stdout.Close()
+		os.Stderr.Close()
+		signal.Ignore(syscall.SIGHUP, syscall.SIGINT)
+	} else {
+		agentEnvironment(*socket, os.Getpid())
+		fmt.Fprintf(os.Stderr, "Holding the key for %s. Interrupt or run hardnote lock to forget it.\n", vault)
+	}
+	serveAgent(listener, *socket, vault, key, *timeout)
+}
+
+// agentDeriveKey asks for the passphrase until it turns out to be right, and returns the key derived from it.
+func agentDeriveKey(vault string, source passphraseSource) []byte {
+	for attempt := 1; ; attempt++ {
+		passphrase, err := source.read("Enter passphrase", vault)
+		must(exitPassphrase, "Reading passphrase failed", err)
+		keyfile, err := source.options()
+		must(exitKeyfile, "Could not derive key", err)
+		key, err := storage.DeriveKey(vault, passphrase, keyfile...)
+		clear(passphrase)
+		mustKeyfile("Could not derive key", err)
+		must(exitOpen, "Could not derive key", err)
+		store, err := storage.Open(vault, nil, storage.WithDerivedKey(key))
+		if err == nil {
+			must(exitClose, "Error while closing storage", store.Close())
+			return key
+		}
+		clear(key)
+		if !errors.Is(err, storage.ErrInvalidKey) {
+			must(exitOpen, "Could not open storage", err)
+		}
+		if !source.prompting() || attempt >= unlockAttempts {
+			must(exitWrongKey, "Could not open storage", err)
+		}
+		delay := time.Duration(attempt*attempt) * time.Second
+		fmt.Fprintf(os.Stderr, "Wrong passphrase. Try again in %s.\n", delay)
+		time.Sleep(delay)
+	}
+}
+
+// agentDetach starts the agent again in the background, hands it the key, and waits for it to listen.
+func agentDetach(vault string, key []byte, socket string, timeout time.Duration) {
+	executable, err := os.Executable()
+	must(exitFailed, "Could not start agent", err)
+	keyReader, keyWriter, err := os.Pipe()
+	must(exitFailed, "Could not start agent", err)
+
+	cmd := exec.Command(executable, "agent", "-key-fd", "3", "-socket", socket, "-timeout", timeout.String(), vault)
+	cmd.ExtraFiles = []*os.File{keyReader}
+	cmd.Stderr = os.Stderr
+	ready, err := cmd.StdoutPipe()
+	must(exitFailed, "Could not start agent", err)
+	must(exitFailed, "Could not start agent", cmd.Start())
+	keyReader.Close()
+	_, err = keyWriter.Write(key)
+	keyWriter.Close()
+	must(exitFailed, "Could not start agent", err)
+
+	line, _ := bufio.NewReader(ready).ReadString('\n')
+	if line == "" {
+		// It said why on stderr already, so only its exit code is left to pass on.
+		if err := cmd.Wait(); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+				os.Exit(exitErr.ExitCode())
+			}
+			must(exitFailed, "Could not start agent", err)
+		}
+		must(exitFailed, "Could not start agent", errors.New("it stopped without saying why"))
+	}
+	agentEnvironment(socket, cmd.Process.Pid)
+	cmd.Process.Release()
+}
+
+// agentEnvironment prints the shell commands pointing the other commands at the agent.
+func agentEnvironment(socket string, pid int) {
+	quoted := "'" + strings.ReplaceAll(socket, "'", `'\''`) + "'"
+	fmt.Printf("%s=%s; export %s;\n", agentSocketEnv, quoted, agentSocketEnv)
+	fmt.Printf("echo Agent pid %d;\n", pid)
+}
+
+// agentListen makes the socket, refusing to take over from an agent already listening on it.
+// The directory has to be a real one, belonging to the user and closed to everyone else,
+// or anyone who got to make it first, like in a shared temporary directory, could take the key.
+func agentListen(socket string) net.Listener {
+	dir := filepath.Dir(socket)
+	must(exitFailed, "Could not start agent", os.MkdirAll(dir, 0700))
+	info, err := os.Lstat(dir)
+	must(exitFailed, "Could not start agent", err)
+	if !info.IsDir() || info.Mode().Perm()&0077 != 0 || !agentDirOwned(info) {
+		must(exitFailed, "Could not start agent", fmt.Errorf("%s must be a directory of yours that only you can use", dir))
+	}
+	if _, err := askAgent(socket, agentRequest{Op: "status"}); err == nil {
+		must(exitRefused, "Could not start agent", fmt.Errorf("an agent is already listening on %s", socket))
+	}
+	os.Remove(socket) // Left behind by an agent that didn't get to clean up after itself
+	listener, err := net.Listen("unix", socket)
+	must(exitFailed, "Could not start agent", err)
+	if err := os.Chmod(socket, 0600); err != nil {
+		listener.Close()
+		must(exitFailed, "Could not start agent", err)
+	}
+	return listener
+}
+
+// serveAgent answers requests until the agent is locked, goes unused for the timeout, or is told to stop.
+func serveAgent(listener net.Listener, socket string, vault string, key []byte, timeout time.Duration) {
+	var lock sync.Mutex
+	var timer *time.Timer
+	locksAt := time.Time{}
+	stop := sync.OnceFunc(func() { listener.Close() })
+	touch := func() {
+		if timeout > 0 {
+			timer.Reset(timeout)
+			locksAt = time.Now().Add(timeout)
+		}
+	}
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, stop)
+		locksAt = time.Now().Add(timeout)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		stop()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			break
+		}
+		go func() {
+			defer conn.Close()
+			if err := agentPeerAllowed(conn); err != nil {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(agentDial))
+			request := agentRequest{}
+			if err := json.NewDecoder(io.LimitReader(conn, maxPassphrase)).Decode(&request); err != nil {
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			response := agentResponse{Vault: vault, Pid: os.Getpid(), Timeout: timeout.String(), LocksAt: locksAt}
+			switch request.Op {
+			case "key":
+				if request.Vault != vault {
+					response = agentResponse{Error: fmt.Sprintf("the agent holds the key for %s, not %s", vault, request.Vault)}
+					break
+				}
+				touch()
+				response.Key, response.LocksAt = key, locksAt
+			case "status":
+			case "lock":
+				defer stop()
+			default:
+				response = agentResponse{Error: fmt.Sprintf("unknown request %q", request.Op)}
+			}
+			json.NewEncoder(conn).Encode(response)
+		}()
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	clear(key)
+	os.Remove(socket)
+}
+
+// agentStatusOf asks the agent how it is doing, exiting if there is none.
+func agentStatusOf(socket string) agentStatus {
+	response, err := askAgent(socket, agentRequest{Op: "status"})
+	must(exitNoAgent, "No agent", err)
+	return agentStatus{
+		Socket:  socket,
+		Vault:   response.Vault,
+		Pid:     response.Pid,
+		Timeout: response.Timeout,
+		LocksAt: response.LocksAt,
+	}
+}
+
+// cliStatus tells if there is an agent, and what it holds the key for.
+func cliStatus(args []string) {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "write JSON instead of plain text")
+	parseFlags(flags, args, 0, "")
+	output(*asJSON, agentStatusOf(agentSocket()), func(status agentStatus) string {
+		locks := "when locked"
+		if !status.LocksAt.IsZero() {
+			locks = status.LocksAt.Format(time.DateTime)
+		}
+		return fmt.Sprintf("Agent %d on %s\nHolding the key for %s until %s\n", status.Pid, status.Socket, status.Vault, locks)
+	})
+}
+
+// cliLock makes the agent forget the key and stop.
+func cliLock(args []string) {
+	flags := flag.NewFlagSet("lock", flag.ContinueOnError)
+	parseFlags(flags, args, 0, "")
+	socket := agentSocket()
+	status := agentStatusOf(socket)
+	_, err := askAgent(socket, agentRequest{Op: "lock"})
+	must(exitNoAgent, "Could not lock agent", err)
+	fmt.Printf("Forgot the key for %s.\n", status.Vault)
+}
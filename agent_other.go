@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// agentDirOwned can't tell who owns the directory here, so the permissions on it are all there is to go by.
+// Where this matters most, in a shared temporary directory, other platforms give every user a directory of their own.
+func agentDirOwned(info os.FileInfo) bool {
+	return true
+}
+
+// agentPeerAllowed has no way of asking who is connecting here, so the permissions of the socket are all that keep others out.
+func agentPeerAllowed(conn net.Conn) error {
+	return nil
+}
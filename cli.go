@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DemmyDemon/hardnote/storage"
+	"github.com/google/uuid"
+)
+
+// maxInput is the most text a subcommand takes in one go, same as the interface reads from a file.
+const maxInput = 3 * 1024 * 1024 // 3MiB
+
+var errAmbiguous = errors.New("more than one note has that name or path, use the id instead")
+
+// scriptFlags are the flags every scripting subcommand takes, on top of its own.
+type scriptFlags struct {
+	*flag.FlagSet
+	json       bool
+	passphrase passphraseSource
+}
+
+func newScriptFlags(name string) *scriptFlags {
+	flags := &scriptFlags{FlagSet: flag.NewFlagSet(name, flag.ContinueOnError)}
+	flags.BoolVar(&flags.json, "json", false, "write the output as JSON instead of plain text")
+	flags.passphrase.register(flags.FlagSet)
+	return flags
+}
+
+// parseFlags is flag parsing that exits with exitUsage, rather than the 2 the flag package would use.
+func parseFlags(flags *flag.FlagSet, args []string, positional int, what string) {
+	err := flags.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(int(exitUsage))
+	}
+	if flags.NArg() < positional {
+		fmt.Fprintln(os.Stderr, what)
+		flags.Usage()
+		os.Exit(int(exitUsage))
+	}
+}
+
+// openExisting opens a vault that has to exist already, for a subcommand that works on it.
+func openExisting(filename string, source passphraseSource) storage.Storage {
+	_, err := os.Stat(filename)
+	must(exitNoFile, "Could not get information about the specified file", err)
+	if source.prompting() {
+		if store, ok := agentUnlock(filename); ok {
+			return store
+		}
+	}
+	key, err := source.read("Enter passphrase", filename)
+	must(exitPassphrase, "Reading passphrase failed", err)
+	return unlock(filename, source, key)
+}
+
+// mustChange exits with the code that fits what went wrong changing or looking something up in the vault.
+func mustChange(what string, err error) {
+	switch {
+	case errors.Is(err, storage.ErrNoSuchEntry):
+		must(exitNotFound, what, err)
+	case errors.Is(err, storage.ErrNoSuchSlot):
+		must(exitNotFound, what, err)
+	case errors.Is(err, errAmbiguous):
+		must(exitAmbiguous, what, err)
+	case errors.Is(err, storage.ErrLastSlot), errors.Is(err, storage.ErrEmptyPassphrase):
+		must(exitRefused, what, err)
+	}
+	must(exitFailed, what, err)
+}
+
+// notePath is where a note or folder is, as folder names from the top level down, separated by slashes.
+func notePath(idx storage.Index, meta storage.EntryMeta) string {
+	names := []string{}
+	for _, folder := range idx.Path(meta.Parent) {
+		names = append(names, folder.Name)
+	}
+	return strings.Join(append(names, meta.Name), "/")
+}
+
+// resolve finds a note or folder by id, by its path, or by its name alone if nothing else has that name.
+// A path always wins over a name, so a note at the top level can be found by name even if a folder has one like it.
+// Two notes can share a path as well as a name, and then neither is picked.
+func resolve(idx storage.Index, ref string) (storage.EntryMeta, error) {
+	if id, err := uuid.Parse(ref); err == nil {
+		for _, meta := range idx {
+			if meta.Id == id {
+				return meta, nil
+			}
+		}
+	}
+	path := strings.TrimSuffix(ref, "/")
+	found := []storage.EntryMeta{}
+	for _, meta := range idx {
+		if notePath(idx, meta) == path {
+			found = append(found, meta)
+		}
+	}
+	if len(found) == 0 {
+		for _, meta := range idx {
+			if meta.Name == path {
+				found = append(found, meta)
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return storage.EntryMeta{}, fmt.Errorf("%q: %w", ref, storage.ErrNoSuchEntry)
+	case 1:
+		return found[0], nil
+	}
+	return storage.EntryMeta{}, fmt.Errorf("%q: %w", ref, errAmbiguous)
+}
+
+// resolveFolder finds the folder for the -folder flag, where nothing means the top level.
+func resolveFolder(idx storage.Index, ref string) uuid.UUID {
+	if ref == "" || ref == "/" {
+		return uuid.Nil
+	}
+	meta, err := resolve(idx, ref)
+	mustChange("Could not find folder", err)
+	if !meta.Folder {
+		mustChange("Could not use folder", fmt.Errorf("%q: %w", ref, storage.ErrNotAFolder))
+	}
+	return meta.Id
+}
+
+// readInput reads the text for a note from stdin.
+func readInput() string {
+	data, err := io.ReadAll(io.LimitReader(os.Stdin, maxInput+1))
+	must(exitIO, "Reading input failed", err)
+	if len(data) > maxInput {
+		must(exitIO, "Reading input failed", fmt.Errorf("more than %d bytes", maxInput))
+	}
+	return string(data)
+}
+
+// noteJSON is how a note or folder is written as JSON.
+type noteJSON struct {
+	Id       uuid.UUID  `json:"id"`
+	Name     string     `json:"name"`
+	Path     string     `json:"path"`
+	Folder   bool       `json:"folder"`
+	Tags     []string   `json:"tags"`
+	Pinned   bool       `json:"pinned"`
+	Created  time.Time  `json:"created"`
+	Modified time.Time  `json:"modified"`
+	Opened   *time.Time `json:"opened,omitempty"`
+	Size     int        `json:"size"`
+	Text     *string    `json:"text,omitempty"`
+}
+
+func newNoteJSON(idx storage.Index, meta storage.EntryMeta) noteJSON {
+	note := noteJSON{
+		Id:       meta.Id,
+		Name:     meta.Name,
+		Path:     notePath(idx, meta),
+		Folder:   meta.Folder,
+		Tags:     meta.Tags,
+		Pinned:   meta.Pinned,
+		Created:  meta.Created,
+		Modified: meta.Modified,
+		Size:     meta.Size,
+	}
+	if note.Tags == nil {
+		note.Tags = []string{}
+	}
+	if !meta.Opened.IsZero() {
+		note.Opened = &meta.Opened
+	}
+	return note
+}
+
+// output writes the value as JSON, or what plain makes of it if JSON wasn't asked for.
+func output[T any](asJSON bool, value T, plain func(value T) string) {
+	var err error
+	if asJSON {
+		err = json.NewEncoder(os.Stdout).Encode(value)
+	} else {
+		_, err = io.WriteString(os.Stdout, plain(value))
+	}
+	must(exitIO, "Writing output failed", err)
+}
+
+// plainIds is the plain output of the subcommands that change notes, the id of each on a line of its own.
+func plainIds(notes []noteJSON) string {
+	var sb strings.Builder
+	for _, note := range notes {
+		sb.WriteString(note.Id.String() + "\n")
+	}
+	return sb.String()
+}
+
+func plainId(note noteJSON) string {
+	return plainIds([]noteJSON{note})
+}
+
+// walk lists what is in the folder, and in the folders in it, each folder followed by what is in it.
+func walk(idx storage.Index, folder uuid.UUID) storage.Index {
+	found := storage.Index{}
+	for _, meta := range idx.Children(folder) {
+		found = append(found, meta)
+		if meta.Folder {
+			found = append(found, walk(idx, meta.Id)...)
+		}
+	}
+	return found
+}
+
+func closeStore(store storage.Storage) {
+	must(exitClose, "Error while closing storage", store.Close())
+}
+
+func cliList(args []string) {
+	flags := newScriptFlags("list")
+	folder := flags.String("folder", "", "only list what is in this folder")
+	parseFlags(flags.FlagSet, args, 1, "Specify the vault to list!")
+	store := openExisting(flags.Arg(0), flags.passphrase)
+	defer closeStore(store)
+
+	idx, err := store.Index()
+	mustChange("Could not read index", err)
+	notes := []noteJSON{}
+	for _, meta := range walk(idx, resolveFolder(idx, *folder)) {
+		notes = append(notes, newNoteJSON(idx, meta))
+	}
+	output(flags.json, notes, func(notes []noteJSON) string {
+		var sb strings.Builder
+		for _, note := range notes {
+			sb.WriteString(note.Id.String() + "\t" + note.Path)
+			if note.Folder {
+				sb.WriteRune('/')
+			}
+			sb.WriteRune('\n')
+		}
+		return sb.String()
+	})
+}
+
+func cliCat(args []string) {
+	flags := newScriptFlags("cat")
+	parseFlags(flags.FlagSet, args, 2, "Specify the vault, and the note to show!")
+	store := openExisting(flags.Arg(0), flags.passphrase)
+	defer closeStore(store)
+
+	idx, err := store.Index()
+	mustChange("Could not read index", err)
+	meta, err := resolve(idx, flags.Arg(1))
+	mustChange("Could not find note", err)
+	entry, err := store.Read(meta.Id)
+	mustChange("Could not read note", err)
+	note := newNoteJSON(idx, meta)
+	note.Text = &entry.Text
+	output(flags.json, note, func(note noteJSON) string {
+		return *note.Text
+	})
+}
+
+func cliAdd(args []string) {
+	flags := newScriptFlags("add")
+	folder := flags.String("folder", "", "put the note in this folder")
+	tags := flags.String("tags", "", "tag the note with these, separated by commas")
+	parseFlags(flags.FlagSet, args, 2, "Specify the vault, and the name of the new note!")
+	store := openExisting(flags.Arg(0), flags.passphrase) // First, as the passphrase may come before the text on stdin
+	defer closeStore(store)
+	text := readInput()
+
+	idx, err := store.Index()
+	mustChange("Could not read index", err)
+	created, idx, err := store.Batch(storage.CreateOp{
+		Name:   flags.Arg(1),
+		Text:   text,
+		Tags:   strings.Split(*tags, ","),
+		Parent: resolveFolder(idx, *folder),
+	})
+	mustChange("Could not add note", err)
+	meta, _ := resolve(idx, created[0].Id.String())
+	output(flags.json, newNoteJSON(idx, meta), plainId)
+}
+
+func cliAppend(args []string) {
+	flags := newScriptFlags("append")
+	parseFlags(flags.FlagSet, args, 2, "Specify the vault, and the note to append to!")
+	store := openExisting(flags.Arg(0), flags.passphrase) // First, as the passphrase may come before the text on stdin
+	defer closeStore(store)
+	text := readInput()
+
+	idx, err := store.Index()
+	mustChange("Could not read index", err)
+	meta, err := resolve(idx, flags.Arg(1))
+	mustChange("Could not find note", err)
+	entry, err := store.Read(meta.Id)
+	mustChange("Could not read note", err)
+	if entry.Text != "" && !strings.HasSuffix(entry.Text, "\n") {
+		entry.Text += "\n" // What is appended starts on a line of its own
+	}
+	entry.Text += text
+	idx, err = store.Update(entry)
+	mustChange("Could not append to note", err)
+	meta, _ = resolve(idx, meta.Id.String())
+	output(flags.json, newNoteJSON(idx, meta), plainId)
+}
+
+func cliRename(args []string) {
+	flags := newScriptFlags("rename")
+	parseFlags(flags.FlagSet, args, 3, "Specify the vault, the note to rename and its new name!")
+	store := openExisting(flags.Arg(0), flags.passphrase)
+	defer closeStore(store)
+
+	idx, err := store.Index()
+	mustChange("Could not read index", err)
+	meta, err := resolve(idx, flags.Arg(1))
+	mustChange("Could not find note", err)
+	idx, err = store.Rename(meta.Id, flags.Arg(2))
+	mustChange("Could not rename note", err)
+	meta, _ = resolve(idx, meta.Id.String())
+	output(flags.json, newNoteJSON(idx, meta), plainId)
+}
+
+func cliRemove(args []string) {
+	flags := newScriptFlags("rm")
+	purge := flags.Bool("purge", false, "delete for ever, rather than putting it in the trash")
+	parseFlags(flags.FlagSet, args, 2, "Specify the vault, and the note to remove!")
+	store := openExisting(flags.Arg(0), flags.passphrase)
+	defer closeStore(store)
+
+	idx, err := store.Index()
+	mustChange("Could not read index", err)
+	meta, err := resolve(idx, flags.Arg(1))
+	mustChange("Could not find note", err)
+	note := newNoteJSON(idx, meta)
+	if *purge {
+		_, err = store.Delete(meta.Id)
+	} else {
+		_, err = store.Trash(meta.Id)
+	}
+	mustChange("Could not remove note", err)
+	output(flags.json, note, plainId)
+}
+
+// exportJSON is what export writes, when asked for JSON.
+type exportJSON struct {
+	Directory string `json:"directory"`
+	Notes     int    `json:"notes"`
+}
+
+func cliExport(args []string) {
+	flags := newScriptFlags("export")
+	folder := flags.String("folder", "", "only export what is in this folder")
+	parseFlags(flags.FlagSet, args, 2, "Specify the vault, and a directory that doesn't exist yet to export to!")
+	store := openExisting(flags.Arg(0), flags.passphrase)
+	defer closeStore(store)
+
+	idx, err := store.Index()
+	mustChange("Could not read index", err)
+	count, err := storage.WriteFolder(store, idx, resolveFolder(idx, *folder), flags.Arg(1))
+	must(exitIO, "Could not export", err)
+	output(flags.json, exportJSON{Directory: flags.Arg(1), Notes: count}, func(exported exportJSON) string {
+		return fmt.Sprintf("%d\n", exported.Notes)
+	})
+}
+
+func cliImport(args []string) {
+	flags := newScriptFlags("import")
+	folder := flags.String("folder", "", "put the notes in this folder")
+	parseFlags(flags.FlagSet, args, 2, "Specify the vault, and the file or directory to import!")
+
+	filenames := []string{flags.Arg(1)}
+	stat, err := os.Stat(flags.Arg(1))
+	must(exitIO, "Could not import", err)
+	if stat.IsDir() {
+		files, err := os.ReadDir(flags.Arg(1))
+		must(exitIO, "Could not import", err)
+		filenames = []string{}
+		for _, file := range files {
+			if file.Type().IsRegular() {
+				filenames = append(filenames, filepath.Join(flags.Arg(1), file.Name()))
+			}
+		}
+	}
+	texts := make([]string, len(filenames))
+	for i, filename := range filenames {
+		stat, err := os.Stat(filename)
+		must(exitIO, "Could not import", err)
+		if stat.Size() > maxInput {
+			must(exitIO, "Could not import", fmt.Errorf("%s is more than %d bytes", filename, maxInput))
+		}
+		data, err := os.ReadFile(filename)
+		must(exitIO, "Could not import", err)
+		texts[i] = string(data)
+	}
+
+	store := openExisting(flags.Arg(0), flags.passphrase)
+	defer closeStore(store)
+	idx, err := store.Index()
+	mustChange("Could not read index", err)
+	parent := resolveFolder(idx, *folder)
+	ops := make([]storage.Op, len(filenames))
+	for i, filename := range filenames {
+		ops[i] = storage.CreateOp{Name: filepath.Base(filename), Text: texts[i], Parent: parent}
+	}
+	created, idx, err := store.Batch(ops...)
+	mustChange("Could not import", err)
+	notes := []noteJSON{}
+	for _, entry := range created {
+		meta, _ := resolve(idx, entry.Id.String())
+		notes = append(notes, newNoteJSON(idx, meta))
+	}
+	output(flags.json, notes, plainIds)
+}
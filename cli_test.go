@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DemmyDemon/hardnote/storage"
+	"github.com/DemmyDemon/hardnote/test"
+	"github.com/google/uuid"
+)
+
+func TestResolve(t *testing.T) {
+	folder := storage.EntryMeta{Name: "Folder", Id: uuid.New(), Folder: true}
+	idx := storage.Index{
+		folder,
+		{Name: "Twin", Id: uuid.New(), Parent: folder.Id},
+		{Name: "Twin", Id: uuid.New(), Parent: folder.Id},
+		{Name: "Single", Id: uuid.New(), Parent: folder.Id},
+		{Name: "Single", Id: uuid.New()},
+	}
+
+	for _, found := range []struct {
+		ref      string
+		expected storage.EntryMeta
+	}{
+		{idx[1].Id.String(), idx[1]},
+		{"Folder/", folder},
+		{"Folder/Single", idx[3]},
+		{"Single", idx[4]},
+	} {
+		meta, err := resolve(idx, found.ref)
+		test.Result(t, err, "resolve", found.ref)
+		test.Compare(t, "resolved "+found.ref, found.expected, meta)
+	}
+
+	for _, refused := range []struct {
+		ref      string
+		expected error
+	}{
+		{"Folder/Twin", errAmbiguous},
+		{"Twin", errAmbiguous},
+		{"Folder/Nothing", storage.ErrNoSuchEntry},
+	} {
+		if _, err := resolve(idx, refused.ref); !errors.Is(err, refused.expected) {
+			t.Errorf("expected %v resolving %q, got %v", refused.expected, refused.ref, err)
+		}
+	}
+}
@@ -2,22 +2,53 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/DemmyDemon/hardnote/storage"
 	"github.com/DemmyDemon/hardnote/ui"
 	tea "github.com/charmbracelet/bubbletea"
-	"github.com/charmbracelet/x/term"
 )
 
-func must(code int, what string, err error) {
+// kdfTarget is how long deriving the key should take on the machine that creates the vault.
+const kdfTarget = 750 * time.Millisecond
+
+// unlockAttempts is how many passphrases are tried before giving up, waiting longer after each wrong one.
+const unlockAttempts = 3
+
+// exitCode is what hardnote exits with. Scripts rely on these, so never renumber them, only add new ones.
+type exitCode int
+
+const (
+	exitUsage         exitCode = 1  // The command line makes no sense
+	exitPassphrase    exitCode = 2  // The passphrase could not be read
+	exitNoFile        exitCode = 3  // The vault file is missing or can't be looked at
+	exitNewPassphrase exitCode = 4  // The new passphrase could not be read
+	exitRefused       exitCode = 5  // Refused to go ahead, like when the passphrases don't match
+	exitOpen          exitCode = 6  // The vault could not be opened
+	exitClose         exitCode = 7  // The vault could not be closed cleanly
+	exitUI            exitCode = 8  // The interactive interface failed
+	exitCheck         exitCode = 9  // The check itself failed
+	exitProblems      exitCode = 10 // The check found problems, and they were not repaired
+	exitConvert       exitCode = 11 // Converting the vault failed
+	exitWrongKey      exitCode = 12 // The passphrase, or the keyfile given with it, was wrong
+	exitNotFound      exitCode = 13 // There is no note or folder by that name or id
+	exitAmbiguous     exitCode = 14 // More than one note has that name or path
+	exitFailed        exitCode = 15 // Anything else failed, like the vault refusing the change
+	exitIO            exitCode = 16 // Reading the input or writing the output failed
+	exitNoAgent       exitCode = 17 // There is no agent to ask
+	exitKeyfile       exitCode = 18 // The keyfile is missing, unreadable or not wanted
+)
+
+func must(code exitCode, what string, err error) {
 	if err == nil {
 		return
 	}
 	fmt.Fprintf(os.Stderr, "%s: %v\n", what, err)
-	os.Exit(code)
+	os.Exit(int(code))
 }
 func same[T comparable](slice1, slice2 []T) bool {
 	if len(slice1) != len(slice2) {
@@ -31,41 +62,333 @@ func same[T comparable](slice1, slice2 []T) bool {
 	return true
 }
 
+// unlock opens the storage, asking for the passphrase again if it was wrong and typed in at the prompt.
+func unlock(filename string, source passphraseSource, key []byte, opts ...storage.Option) storage.Storage {
+	keyfile, err := source.options()
+	must(exitKeyfile, "Could not open storage", err)
+	opts = append(opts, keyfile...)
+	for attempt := 1; ; attempt++ {
+		store, err := storage.Open(filename, key, opts...)
+		if err == nil {
+			return store
+		}
+		mustKeyfile("Could not open storage", err)
+		if !errors.Is(err, storage.ErrInvalidKey) {
+			must(exitOpen, "Could not open storage", err)
+		}
+		if !source.prompting() || attempt >= unlockAttempts {
+			must(exitWrongKey, "Could not open storage", err)
+		}
+		delay := time.Duration(attempt*attempt) * time.Second
+		fmt.Fprintf(os.Stderr, "Wrong passphrase. Try again in %s.\n", delay)
+		time.Sleep(delay)
+		key, err = source.read("Enter passprase", filename)
+		must(exitPassphrase, "Reading password failed", err)
+	}
+}
+
+func usage() {
+	fmt.Println("Usage:")
+	fmt.Println("  hardnote [-backend bolt|sealed] <filename>")
+	fmt.Println("                               opens the vault, creating it with the given backend if needed")
+	fmt.Println("  hardnote rekey <filename>    changes the passphrase of the vault, the new one typed in twice, or taken from")
+	fmt.Println("                               -new-passphrase-fd, -new-passphrase-file, -new-passphrase-env or -new-passphrase-command")
+	fmt.Println("  hardnote check [-repair] <filename>")
+	fmt.Println("                               looks for problems in the vault, and optionally fixes them")
+	fmt.Println("  hardnote convert [-backend bolt|sealed] <filename> <new filename>")
+	fmt.Println("                               copies the vault to a new file with the other backend")
+	fmt.Println("  hardnote keyfile <new file>  makes a random keyfile, for creating a vault that needs it")
+	fmt.Println("")
+	fmt.Println("A vault can be unlocked in more than one way, each a key slot. A new vault has a passphrase slot,")
+	fmt.Println("and a recovery code that is shown once, to type in instead of the passphrase if it is forgotten.")
+	fmt.Println("  hardnote slots <filename>    lists the key slots")
+	fmt.Println("  hardnote add-slot [-kind passphrase|keyfile|recovery] [-label <label>] [-new-keyfile <file>] <filename>")
+	fmt.Println("                               adds a key slot, a keyfile slot opening with the keyfile and an empty passphrase")
+	fmt.Println("  hardnote revoke-slot <filename> <slot>")
+	fmt.Println("                               removes the key slot with that id or label")
+	fmt.Println("Rekeying changes the passphrase that was used to open the vault, or adds one if it was opened another way.")
+	fmt.Println("A new recovery code is only ever written to a terminal, unless -show-recovery-code is given, when creating")
+	fmt.Println("or converting a vault or adding a recovery slot.")
+	fmt.Println("")
+	fmt.Println("For scripts, where a note is given by id, by path like Folder/Name, or by name alone:")
+	fmt.Println("  hardnote list [-folder <folder>] <filename>")
+	fmt.Println("  hardnote cat <filename> <note>")
+	fmt.Println("  hardnote add [-folder <folder>] [-tags a,b] <filename> <name>    reads the text from stdin")
+	fmt.Println("  hardnote append <filename> <note>                                reads the text from stdin")
+	fmt.Println("  hardnote rename <filename> <note> <new name>")
+	fmt.Println("  hardnote rm [-purge] <filename> <note>")
+	fmt.Println("  hardnote export [-folder <folder>] <filename> <new directory>")
+	fmt.Println("  hardnote import [-folder <folder>] <filename> <file or directory>")
+	fmt.Println("These all take -json for JSON output. See exitCode in main.go for what the exit codes mean.")
+	fmt.Println("")
+	fmt.Println("Every command that needs the passphrase takes one of these to get it without a prompt:")
+	fmt.Println("  -passphrase-fd <n>           the first line read from the file descriptor")
+	fmt.Println("  -passphrase-file <file>      the first line of the file")
+	fmt.Println("  -passphrase-command <cmd>    the first line written by the shell command, like a password manager")
+	fmt.Println("  -passphrase-env <variable>   the environment variable, which is NOT safe, as every program started")
+	fmt.Println("                               from the same shell gets it too")
+	fmt.Println("They also take -keyfile <file> for a vault created with a keyfile, which is then needed to open it.")
+	fmt.Println("")
+	fmt.Println("To type the passphrase only once, like ssh-agent:")
+	fmt.Println("  eval $(hardnote agent [-timeout 15m] [-socket <path>] [-foreground] <filename>)")
+	fmt.Println("                               holds the key for the vault, until it goes unused for the timeout")
+	fmt.Println("  hardnote status [-json]      tells what the agent holds the key for")
+	fmt.Println("  hardnote lock                makes the agent forget the key")
+	fmt.Println("Everything that would prompt for the passphrase of that vault asks the agent first.")
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Println("Specify a filename!")
-		os.Exit(1)
+		usage()
+		os.Exit(int(exitUsage))
+	}
+
+	switch os.Args[1] {
+	case "list":
+		cliList(os.Args[2:])
+	case "cat":
+		cliCat(os.Args[2:])
+	case "add":
+		cliAdd(os.Args[2:])
+	case "append":
+		cliAppend(os.Args[2:])
+	case "rename":
+		cliRename(os.Args[2:])
+	case "rm":
+		cliRemove(os.Args[2:])
+	case "export":
+		cliExport(os.Args[2:])
+	case "import":
+		cliImport(os.Args[2:])
+	case "agent":
+		agent(os.Args[2:])
+	case "status":
+		cliStatus(os.Args[2:])
+	case "lock":
+		cliLock(os.Args[2:])
+	case "slots":
+		cliSlots(os.Args[2:])
+	case "add-slot":
+		cliAddSlot(os.Args[2:])
+	case "revoke-slot":
+		cliRevokeSlot(os.Args[2:])
+	case "keyfile":
+		flags := flag.NewFlagSet("keyfile", flag.ContinueOnError)
+		parseFlags(flags, os.Args[2:], 1, "Specify the keyfile to create!")
+		newKeyfile(flags.Arg(0))
+	case "rekey":
+		flags := flag.NewFlagSet("rekey", flag.ContinueOnError)
+		var source, newSource passphraseSource
+		source.register(flags)
+		newSource.registerNew(flags)
+		parseFlags(flags, os.Args[2:], 1, "Specify a filename to rekey!")
+		rekey(flags.Arg(0), source, newSource)
+	case "check":
+		flags := flag.NewFlagSet("check", flag.ContinueOnError)
+		repair := flags.Bool("repair", false, "fix the problems found")
+		var source passphraseSource
+		source.register(flags)
+		parseFlags(flags, os.Args[2:], 1, "Specify a filename to check!")
+		check(flags.Arg(0), source, *repair)
+	case "convert":
+		flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+		backend := flags.String("backend", "", "backend of the new vault, the one the vault doesn't use if not given")
+		showRecovery := flags.Bool(showRecoveryFlag, false, "write the recovery code of the new vault even when the output is not a terminal")
+		var source passphraseSource
+		source.register(flags)
+		parseFlags(flags, os.Args[2:], 2, "Specify the vault to convert, and the file to convert it to!")
+		convert(flags.Arg(0), flags.Arg(1), source, *backend, *showRecovery)
+	default:
+		flags := flag.NewFlagSet("hardnote", flag.ContinueOnError)
+		backend := flags.String("backend", string(storage.BackendBolt), "backend of the vault, if it is created")
+		showRecovery := flags.Bool(showRecoveryFlag, false, "write the recovery code of a new vault even when the output is not a terminal")
+		var source passphraseSource
+		source.register(flags)
+		flags.Usage = usage
+		parseFlags(flags, os.Args[1:], 1, "Specify a filename!")
+		chosen, err := storage.ParseBackend(*backend)
+		must(exitUsage, "Could not create vault", err)
+		interactive(flags.Arg(0), source, chosen, *showRecovery)
+	}
+}
+
+func rekey(filename string, source passphraseSource, newSource passphraseSource) {
+	_, err := os.Stat(filename)
+	must(exitNoFile, "Could not get information about the specified file", err)
+
+	key, err := source.read("Enter current passphrase", filename)
+	must(exitPassphrase, "Reading password failed", err)
+
+	store := unlock(filename, source, key)
+	defer func() {
+		err := store.Close()
+		must(exitClose, "Error while closing storage", err)
+	}()
+
+	newKey, err := newSource.read("Enter new passphrase", filename)
+	must(exitNewPassphrase, "Reading password failed", err)
+	if newSource.prompting() {
+		newKeyAgain, err := readPassphrase("Repeat new passphrase", filename)
+		must(exitNewPassphrase, "Reading password failed", err)
+		if !same(newKey, newKeyAgain) {
+			must(exitRefused, "Could not change passphrase", errors.New("passwords did not match"))
+		}
+	}
+	if len(newKey) == 0 {
+		must(exitRefused, "Could not change passphrase", errors.New("refusing to use an empty passphrase"))
+	}
+
+	err = store.Rekey(newKey)
+	must(exitFailed, "Could not change passphrase", err)
+	agentForget(filename)
+	fmt.Println("Passphrase changed.")
+}
+
+func newKeyfile(filename string) {
+	keyfile, err := storage.NewKeyfile()
+	must(exitFailed, "Could not make keyfile", err)
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		must(exitRefused, "Could not create keyfile", err)
+	}
+	must(exitIO, "Could not create keyfile", err)
+	_, err = file.Write(keyfile)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+		must(exitIO, "Could not write keyfile", err)
+	}
+	fmt.Printf("Wrote a new keyfile to %s.\n", filename)
+	fmt.Println("Keep a copy of it somewhere safe. Without it, a vault created with it can not be opened.")
+}
+
+func check(filename string, source passphraseSource, repair bool) {
+	_, err := os.Stat(filename)
+	must(exitNoFile, "Could not get information about the specified file", err)
+
+	store, ok := agentUnlock(filename)
+	if !ok {
+		key, err := source.read("Enter passprase", filename)
+		must(exitPassphrase, "Reading password failed", err)
+		store = unlock(filename, source, key)
+	}
+	defer func() {
+		err := store.Close()
+		must(exitClose, "Error while closing storage", err)
+	}()
+
+	report, err := store.Check(repair)
+	must(exitCheck, "Could not check storage", err)
+	fmt.Println(report)
+	if !report.Clean() && !report.Repaired {
+		store.Close()
+		os.Exit(int(exitProblems))
+	}
+}
+
+func convert(filename string, newFilename string, source passphraseSource, backend string, showRecovery bool) {
+	from, found, err := storage.DetectBackend(filename)
+	must(exitNoFile, "Could not get information about the specified file", err)
+	if !found {
+		must(exitNoFile, "Could not convert", fmt.Errorf("%s: %w", filename, os.ErrNotExist))
+	}
+	if _, err := os.Stat(newFilename); err == nil {
+		must(exitConvert, "Could not convert", fmt.Errorf("%s: %w", newFilename, os.ErrExist))
 	}
+	mustShowRecoveryCode("Could not convert", showRecovery)
+	to := storage.BackendSealed
+	if from == storage.BackendSealed {
+		to = storage.BackendBolt
+	}
+	if backend != "" {
+		to, err = storage.ParseBackend(backend)
+		must(exitUsage, "Could not convert", err)
+	}
+
+	key, err := source.read("Enter passprase", filename)
+	must(exitPassphrase, "Reading password failed", err)
+
+	store := unlock(filename, source, key)
+	defer func() {
+		err := store.Close()
+		must(exitClose, "Error while closing storage", err)
+	}()
+
+	fmt.Println("Calibrating key derivation for this machine...")
+	kdf, err := storage.CalibrateKDF(kdfTarget)
+	must(exitFailed, "Could not calibrate key derivation", err)
+
+	keyfile, err := source.options()
+	must(exitKeyfile, "Could not convert", err)
+	err = storage.Convert(store, newFilename, key, append(keyfile, storage.WithKDF(kdf), storage.WithBackend(to))...)
+	must(exitConvert, "Could not convert", err)
+	fmt.Printf("Converted %s (%s) to %s (%s), with the same passphrase and keyfile.\n", filename, from, newFilename, to)
+	fmt.Println("None of the other key slots came along, so it gets a recovery code of its own.")
+
+	converted := unlock(newFilename, source, key)
+	defer func() {
+		err := converted.Close()
+		must(exitClose, "Error while closing storage", err)
+	}()
+	_, code := addRecoveryCode(converted, "")
+	fmt.Print(recoveryMessage(code))
+}
 
-	filename := os.Args[1]
+func interactive(filename string, source passphraseSource, backend storage.Backend, showRecovery bool) {
 	fmt.Println("SECURITY NOTE: KEY AND CURRENT NOTE ARE UNENCRYPTED IN MEMORY!")
 	fmt.Println("DO NOT ENTER YOUR PASSPHEASE IN AN UNTRUSTED ENVIRONMENT!")
-	fmt.Printf("Enter passprase for %s> ", filepath.Base(filename))
 
-	key, err := term.ReadPassword(os.Stdin.Fd())
-	fmt.Println("")
-	must(2, "Reading password failed", err)
+	_, err := os.Stat(filename)
+	if err == nil && source.prompting() {
+		if store, ok := agentUnlock(filename); ok {
+			runUI(filename, store)
+			return
+		}
+	}
 
+	key, err := source.read("Enter passprase", filename)
+	must(exitPassphrase, "Reading password failed", err)
+
+	var opts []storage.Option
 	_, err = os.Stat(filename)
-	if err != nil {
+	created := err != nil
+	if created {
 		if !errors.Is(err, os.ErrNotExist) {
-			must(3, "Could not get information about the specified file", err)
+			must(exitNoFile, "Could not get information about the specified file", err)
 		}
-		fmt.Println("This is a new file. Please repeat the passphrase.")
-		fmt.Printf("Enter passprase for %s> ", filepath.Base(filename))
-		keyAgain, err := term.ReadPassword(os.Stdin.Fd())
-		fmt.Println("")
-		must(4, "Reading password failed", err)
-		if !same(key, keyAgain) {
-			must(5, "Could not create file", errors.New("passwords did not match"))
+		mustShowRecoveryCode("Could not create file", showRecovery)
+		if len(key) == 0 {
+			must(exitRefused, "Could not create file", errors.New("refusing to use an empty passphrase"))
 		}
+		if source.prompting() {
+			fmt.Println("This is a new file. Please repeat the passphrase.")
+			keyAgain, err := readPassphrase("Enter passprase", filename)
+			must(exitNewPassphrase, "Reading password failed", err)
+			if !same(key, keyAgain) {
+				must(exitRefused, "Could not create file", errors.New("passwords did not match"))
+			}
+		}
+		fmt.Println("Calibrating key derivation for this machine...")
+		kdf, err := storage.CalibrateKDF(kdfTarget)
+		must(exitFailed, "Could not calibrate key derivation", err)
+		opts = append(opts, storage.WithKDF(kdf), storage.WithBackend(backend))
+	}
+
+	store := unlock(filename, source, key, opts...)
+	if created {
+		showRecoveryCode(store)
 	}
+	runUI(filename, store)
+}
 
-	store, err := storage.NewBoltStorage(filename, key)
-	must(6, "Could not open storage", err)
+// runUI runs the interactive interface on the vault until the user quits, and closes it.
+func runUI(filename string, store storage.Storage) {
 	defer func() {
 		err := store.Close()
-		must(7, "Error while closing storage", err)
+		must(exitClose, "Error while closing storage", err)
 		fmt.Println("\033c")
 		fmt.Println("OKAY BYE!")
 	}()
@@ -73,6 +396,6 @@ func main() {
 	p := tea.NewProgram(ui.New(filepath.Base(filename), store))
 	if _, err := p.Run(); err != nil {
 		fmt.Fprintf(os.Stderr, "OH NO, I TOTALLY %v\n", err)
-		os.Exit(8)
+		os.Exit(int(exitUI))
 	}
 }
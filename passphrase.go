@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/DemmyDemon/hardnote/storage"
+	"github.com/charmbracelet/x/term"
+)
+
+// maxPassphrase is more than anyone would type, and keeps a wrong file descriptor from being read for ever.
+const maxPassphrase = 64 * 1024
+
+// maxKeyfile is as large a keyfile as is read, as any file will do, but a huge one is more likely a mistake.
+const maxKeyfile = 16 * 1024 * 1024
+
+// standardFiles are stdin, stdout and stderr, by their file descriptors. They are never closed after reading
+// the passphrase from one of them, and never opened anew either, as closing that would close them as well.
+var standardFiles = []*os.File{os.Stdin, os.Stdout, os.Stderr}
+
+// passphraseSource is where a command gets the passphrase from, when it isn't typed in at the prompt,
+// and the keyfile that goes with it, if the vault has one.
+type passphraseSource struct {
+	fd      int    // File descriptor to read the first line of, or -1
+	file    string // File to read the first line of, or ""
+	env     string // Environment variable to take it from, or ""
+	command string // Shell command to take the first line of the output of, or ""
+	keyfile string // Keyfile to mix in with the passphrase, or ""
+	prefix  string // Put in front of the flag names, like "new-" for the new passphrase when rekeying
+}
+
+// register adds the flags choosing the passphrase source to the flag set.
+func (ps *passphraseSource) register(flags *flag.FlagSet) {
+	ps.registerSources(flags, "", "the passphrase")
+	flags.StringVar(&ps.keyfile, "keyfile", "", "keyfile of the vault, or for the vault to need if it is created")
+}
+
+// registerNew adds the flags choosing where the new passphrase comes from, named like those of register with "new-" in front.
+func (ps *passphraseSource) registerNew(flags *flag.FlagSet) {
+	ps.registerSources(flags, "new-", "the new passphrase")
+}
+
+func (ps *passphraseSource) registerSources(flags *flag.FlagSet, prefix string, what string) {
+	ps.prefix = prefix
+	flags.IntVar(&ps.fd, prefix+"passphrase-fd", -1, "read "+what+" from the first line of this file descriptor")
+	flags.StringVar(&ps.file, prefix+"passphrase-file", "", "read "+what+" from the first line of this file")
+	flags.StringVar(&ps.env, prefix+"passphrase-env", "", "take "+what+" from this environment variable, which is NOT safe")
+	flags.StringVar(&ps.command, prefix+"passphrase-command", "", "take "+what+" from the first line this shell command writes, like from a password manager")
+}
+
+// options are the storage options for the keyfile, if one was given.
+func (ps passphraseSource) options() ([]storage.Option, error) {
+	if ps.keyfile == "" {
+		return nil, nil
+	}
+	keyfile, err := readKeyfile(ps.keyfile)
+	if err != nil {
+		return nil, err
+	}
+	return []storage.Option{storage.WithKeyfile(keyfile)}, nil
+}
+
+// readKeyfile reads the whole of the keyfile, refusing one that is empty or too large to be meant as one.
+func readKeyfile(filename string) ([]byte, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading keyfile: %w", err)
+	}
+	defer file.Close()
+	keyfile, err := io.ReadAll(io.LimitReader(file, maxKeyfile+1))
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("reading keyfile: %w", err)
+	case len(keyfile) == 0:
+		return nil, fmt.Errorf("keyfile %s is empty", filename)
+	case len(keyfile) > maxKeyfile:
+		return nil, fmt.Errorf("keyfile %s is larger than %d bytes", filename, maxKeyfile)
+	}
+	return keyfile, nil
+}
+
+// mustKeyfile exits with exitKeyfile if the error is about the keyfile, so it isn't mistaken for a wrong passphrase.
+func mustKeyfile(what string, err error) {
+	if errors.Is(err, storage.ErrKeyfileNeeded) || errors.Is(err, storage.ErrNoKeyfile) {
+		must(exitKeyfile, what, err)
+	}
+}
+
+// prompting is true if the passphrase is typed in, so it can be asked for again if it was wrong.
+func (ps passphraseSource) prompting() bool {
+	return ps.fd < 0 && ps.file == "" && ps.env == "" && ps.command == ""
+}
+
+func (ps passphraseSource) read(prompt string, filename string) ([]byte, error) {
+	given := 0
+	for _, set := range []bool{ps.fd >= 0, ps.file != "", ps.env != "", ps.command != ""} {
+		if set {
+			given++
+		}
+	}
+	if given > 1 {
+		p := "-" + ps.prefix
+		return nil, fmt.Errorf("give only one of %[1]spassphrase-fd, %[1]spassphrase-file, %[1]spassphrase-env and %[1]spassphrase-command", p)
+	}
+
+	switch {
+	case ps.fd >= 0 && ps.fd < len(standardFiles):
+		return firstLine(standardFiles[ps.fd]) // Left open, as stdin may well have a note coming after the passphrase
+	case ps.fd >= 0:
+		file := os.NewFile(uintptr(ps.fd), fmt.Sprintf("file descriptor %d", ps.fd))
+		if file == nil {
+			return nil, fmt.Errorf("file descriptor %d is not open", ps.fd)
+		}
+		defer file.Close()
+		return firstLine(file)
+	case ps.file != "":
+		file, err := os.Open(ps.file)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if info, err := file.Stat(); err == nil && info.Mode().Perm()&0077 != 0 {
+			fmt.Fprintf(os.Stderr, "WARNING: %s can be read by others, and holds your passphrase!\n", ps.file)
+		}
+		return firstLine(file)
+	case ps.env != "":
+		value, ok := os.LookupEnv(ps.env)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", ps.env)
+		}
+		fmt.Fprintln(os.Stderr, "WARNING: TAKING THE PASSPHRASE FROM THE ENVIRONMENT IS NOT SAFE!")
+		fmt.Fprintf(os.Stderr, "WARNING: %s is passed on to every program started from here, and may end up in logs and crash reports.\n", ps.env)
+		return []byte(value), nil
+	case ps.command != "":
+		cmd := exec.Command("sh", "-c", ps.command)
+		cmd.Stderr = os.Stderr // So it can ask for whatever it needs to hand over the passphrase
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		line, readErr := firstLine(out)
+		io.Copy(io.Discard, out)
+		if err := cmd.Wait(); err != nil {
+			return nil, fmt.Errorf("passphrase command failed: %w", err)
+		}
+		return line, readErr
+	}
+	return readPassphrase(prompt, filename)
+}
+
+// firstLine reads the first line of what the reader holds, which is the passphrase.
+// It reads a byte at a time, so nothing past the line is taken from the reader. Whatever comes after it,
+// like the text of a note following the passphrase on stdin, is left for the next read, and a writer
+// that keeps the other end open doesn't hold things up.
+func firstLine(reader io.Reader) ([]byte, error) {
+	line := []byte{}
+	b := make([]byte, 1)
+	for {
+		n, err := reader.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			if len(line) == maxPassphrase {
+				return nil, fmt.Errorf("the first line is longer than %d bytes, which is too long for a passphrase", maxPassphrase)
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+// openTerminal is stdin if it is a terminal, or else the terminal itself, for when stdin is a pipe with a note coming through it.
+// The returned func closes the terminal once done with it, if it had to be opened.
+func openTerminal() (*os.File, func(), error) {
+	if term.IsTerminal(os.Stdin.Fd()) {
+		return os.Stdin, func() {}, nil
+	}
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return nil, nil, err
+	}
+	return tty, func() { tty.Close() }, nil
+}
+
+// readPassphrase asks for the passphrase on the terminal, even when stdin is a pipe with a note coming through it.
+func readPassphrase(prompt string, filename string) ([]byte, error) {
+	input, done, err := openTerminal()
+	if err != nil {
+		return nil, fmt.Errorf("no terminal to ask for the passphrase on: %w", err)
+	}
+	defer done()
+	fmt.Fprintf(os.Stderr, "%s for %s> ", prompt, filepath.Base(filename))
+	key, err := term.ReadPassword(input.Fd())
+	fmt.Fprintln(os.Stderr, "")
+	return key, err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/DemmyDemon/hardnote/test"
+)
+
+func TestFirstLine(t *testing.T) {
+	for _, input := range []struct {
+		text     string
+		expected string
+	}{
+		{"secret\n", "secret"},
+		{"secret\r\nsomething else\n", "secret"},
+		{"no newline", "no newline"},
+		{"", ""},
+	} {
+		line, err := firstLine(strings.NewReader(input.text))
+		test.Result(t, err, "read first line", input.text)
+		test.Compare(t, "first line of "+input.text, input.expected, string(line))
+	}
+
+	reader, writer := io.Pipe()
+	go writer.Write([]byte("secret\nand the pipe stays open"))
+	line, err := firstLine(reader)
+	test.Result(t, err, "read first line from an open pipe")
+	test.Compare(t, "first line from an open pipe", "secret", string(line))
+
+	if _, err := firstLine(strings.NewReader(strings.Repeat("x", maxPassphrase+1))); err == nil {
+		t.Error("expected a first line longer than a passphrase can be to be refused")
+	}
+}
+
+func TestPassphraseBeforeNote(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	test.Result(t, err, "make pipe")
+	defer reader.Close()
+	_, err = writer.WriteString("pass\nbody")
+	test.Result(t, err, "write passphrase and note")
+	test.Result(t, writer.Close(), "close the writing end")
+
+	stdin := standardFiles[0]
+	standardFiles[0] = reader // Stands in for stdin, as -passphrase-fd 0 reads it
+	defer func() {
+		standardFiles[0] = stdin
+	}()
+	passphrase, err := passphraseSource{fd: 0}.read("Enter passphrase", "hardnote.test")
+	test.Result(t, err, "read passphrase from fd 0")
+	test.Compare(t, "passphrase is the first line", "pass", string(passphrase))
+
+	body, err := io.ReadAll(reader)
+	test.Result(t, err, "read the rest, still open")
+	test.Compare(t, "note is what follows the passphrase", "body", string(body))
+}
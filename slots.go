@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/DemmyDemon/hardnote/storage"
+	"github.com/charmbracelet/x/term"
+	"github.com/google/uuid"
+)
+
+// slotJSON is how a key slot is written as JSON.
+type slotJSON struct {
+	Id           uuid.UUID        `json:"id"`
+	Kind         storage.SlotKind `json:"kind"`
+	Label        string           `json:"label"`
+	Created      time.Time        `json:"created"`
+	Keyfile      bool             `json:"keyfile"`                 // A passphrase slot that needs its keyfile as well
+	RecoveryCode string           `json:"recovery_code,omitempty"` // Only ever there right after the slot was added
+}
+
+func newSlotJSON(slot storage.KeySlot) slotJSON {
+	return slotJSON{
+		Id:      slot.Id,
+		Kind:    slot.Kind,
+		Label:   slot.Label,
+		Created: slot.Created,
+		Keyfile: slot.Kind == storage.SlotPassphrase && slot.KDF.Keyfile,
+	}
+}
+
+// plainSlot is the plain output of a key slot, tab separated like the listing of notes.
+func plainSlot(slot slotJSON) string {
+	kind := string(slot.Kind)
+	if slot.Keyfile {
+		kind += "+keyfile"
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%s\n", slot.Id, kind, slot.Created.Local().Format(time.DateOnly), slot.Label)
+}
+
+// resolveSlot finds a key slot by its id, or by its label if no other slot has the same.
+func resolveSlot(slots []storage.KeySlot, ref string) (storage.KeySlot, error) {
+	if id, err := uuid.Parse(ref); err == nil {
+		for _, slot := range slots {
+			if slot.Id == id {
+				return slot, nil
+			}
+		}
+	}
+	found := []storage.KeySlot{}
+	for _, slot := range slots {
+		if slot.Label == ref {
+			found = append(found, slot)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return storage.KeySlot{}, fmt.Errorf("%q: %w", ref, storage.ErrNoSuchSlot)
+	case 1:
+		return found[0], nil
+	}
+	return storage.KeySlot{}, fmt.Errorf("%q: %w", ref, errAmbiguous)
+}
+
+// addRecoveryCode adds a recovery slot to the vault, and returns the code that opens it.
+func addRecoveryCode(store storage.Storage, label string) (storage.KeySlot, string) {
+	code, err := storage.NewRecoveryCode()
+	must(exitFailed, "Could not make recovery code", err)
+	slot, err := store.AddSlot(storage.SlotRecovery, label, []byte(code), nil)
+	mustChange("Could not add recovery code", err)
+	return slot, code
+}
+
+// recoveryMessage is how the recovery code is shown, the only time it ever is.
+func recoveryMessage(code string) string {
+	var sb strings.Builder
+	sb.WriteString("RECOVERY CODE, SHOWN THIS ONCE AND NEVER AGAIN:\n\n")
+	sb.WriteString("    " + code + "\n\n")
+	sb.WriteString("Write it down and keep it somewhere safe, away from the vault.\n")
+	sb.WriteString("Typed in instead of the passphrase, it opens the vault. Case and dashes don't matter.\n")
+	return sb.String()
+}
+
+// showRecoveryFlag is the flag for showing a new recovery code when the output is not a terminal.
+const showRecoveryFlag = "show-recovery-code"
+
+// mustShowRecoveryCode exits before anything is changed if a recovery code would be written anywhere but a terminal,
+// like a file or a pipe, where it is easily kept by mistake, unless that was asked for with showRecoveryFlag.
+func mustShowRecoveryCode(what string, asked bool) {
+	if !asked && !term.IsTerminal(os.Stdout.Fd()) {
+		must(exitRefused, what, fmt.Errorf("the output is not a terminal, give -%s to write the recovery code to it anyway", showRecoveryFlag))
+	}
+}
+
+// showRecoveryCode gives a new vault a recovery code, and waits for it to be written down before going on.
+// Like the passphrase, the wait is on the terminal, even when stdin is a pipe.
+func showRecoveryCode(store storage.Storage) {
+	_, code := addRecoveryCode(store, "")
+	fmt.Print(recoveryMessage(code))
+	input, done, err := openTerminal()
+	if err != nil {
+		return // Nobody at a terminal to wait for
+	}
+	defer done()
+	fmt.Print("Press Enter once it is written down.")
+	bufio.NewReader(input).ReadString('\n')
+}
+
+func cliSlots(args []string) {
+	flags := newScriptFlags("slots")
+	parseFlags(flags.FlagSet, args, 1, "Specify the vault to list the key slots of!")
+	store := openExisting(flags.Arg(0), flags.passphrase)
+	defer closeStore(store)
+
+	slots, err := store.Slots()
+	mustChange("Could not list key slots", err)
+	listed := []slotJSON{}
+	for _, slot := range slots {
+		listed = append(listed, newSlotJSON(slot))
+	}
+	output(flags.json, listed, func(listed []slotJSON) string {
+		var sb strings.Builder
+		for _, slot := range listed {
+			sb.WriteString(plainSlot(slot))
+		}
+		return sb.String()
+	})
+}
+
+func cliAddSlot(args []string) {
+	flags := newScriptFlags("add-slot")
+	kindName := flags.String("kind", string(storage.SlotPassphrase), fmt.Sprintf("kind of key slot, one of %v", storage.SlotKinds))
+	label := flags.String("label", "", "what to call the key slot, the kind if not given")
+	newKeyfile := flags.String("new-keyfile", "", "keyfile of a keyfile slot, or to mix in with the passphrase of a passphrase slot")
+	showRecovery := flags.Bool(showRecoveryFlag, false, "write the recovery code of a recovery slot even when the output is not a terminal")
+	parseFlags(flags.FlagSet, args, 1, "Specify the vault to add a key slot to!")
+	kind, err := storage.ParseSlotKind(*kindName)
+	must(exitUsage, "Could not add key slot", err)
+
+	var keyfile []byte
+	if *newKeyfile != "" {
+		keyfile, err = readKeyfile(*newKeyfile)
+		must(exitKeyfile, "Could not add key slot", err)
+	}
+	switch {
+	case kind == storage.SlotKeyfile && keyfile == nil:
+		must(exitUsage, "Could not add key slot", errors.New("a keyfile slot needs -new-keyfile"))
+	case kind == storage.SlotRecovery && keyfile != nil:
+		must(exitUsage, "Could not add key slot", errors.New("a recovery code is all it takes, so -new-keyfile makes no sense"))
+	case kind == storage.SlotRecovery:
+		mustShowRecoveryCode("Could not add key slot", *showRecovery)
+	}
+
+	store := openExisting(flags.Arg(0), flags.passphrase)
+	defer closeStore(store)
+
+	var added slotJSON
+	switch kind {
+	case storage.SlotRecovery:
+		slot, code := addRecoveryCode(store, *label)
+		added = newSlotJSON(slot)
+		added.RecoveryCode = code
+	case storage.SlotPassphrase:
+		newKey, err := readPassphrase("Enter passphrase for the new slot", flags.Arg(0))
+		must(exitNewPassphrase, "Reading passphrase failed", err)
+		newKeyAgain, err := readPassphrase("Repeat passphrase for the new slot", flags.Arg(0))
+		must(exitNewPassphrase, "Reading passphrase failed", err)
+		if !same(newKey, newKeyAgain) {
+			must(exitRefused, "Could not add key slot", errors.New("passphrases did not match"))
+		}
+		slot, err := store.AddSlot(kind, *label, newKey, keyfile)
+		mustChange("Could not add key slot", err)
+		added = newSlotJSON(slot)
+	default:
+		slot, err := store.AddSlot(kind, *label, nil, keyfile)
+		mustChange("Could not add key slot", err)
+		added = newSlotJSON(slot)
+	}
+	output(flags.json, added, func(slot slotJSON) string {
+		if slot.RecoveryCode != "" {
+			return plainSlot(slot) + "\n" + recoveryMessage(slot.RecoveryCode)
+		}
+		return plainSlot(slot)
+	})
+}
+
+func cliRevokeSlot(args []string) {
+	flags := newScriptFlags("revoke-slot")
+	parseFlags(flags.FlagSet, args, 2, "Specify the vault, and the id or label of the key slot to revoke!")
+	store := openExisting(flags.Arg(0), flags.passphrase)
+	defer closeStore(store)
+
+	slots, err := store.Slots()
+	mustChange("Could not list key slots", err)
+	slot, err := resolveSlot(slots, flags.Arg(1))
+	mustChange("Could not find key slot", err)
+	mustChange("Could not revoke key slot", store.RevokeSlot(slot.Id))
+	output(flags.json, newSlotJSON(slot), plainSlot)
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Op is one step of a Batch. All the steps of a batch succeed together, or none of them happen at all.
+type Op interface {
+	apply(idx Index, target batchTarget) (Index, *Entry, error)
+}
+
+// batchTarget is what a storage backend provides for ops to work on, inside whatever makes the batch atomic.
+type batchTarget interface {
+	getEntry(id uuid.UUID) (Entry, error)
+	putEntry(entry Entry) error
+	deleteEntry(id uuid.UUID) error       // Also forgets the revisions of the entry
+	keepRevision(revision Revision) error // Also forgets revisions that are past the retention settings
+	trashEntry(meta EntryMeta, deleted time.Time) error
+	restoreEntry(id uuid.UUID) (EntryMeta, error)
+	purgeEntry(id uuid.UUID) error // Also forgets the revisions of the entry
+}
+
+// CreateOp makes a new entry at the end of the index. The created entry is part of the batch result.
+type CreateOp struct {
+	Name   string
+	Text   string
+	Tags   []string
+	Parent uuid.UUID // The folder to put it in, or uuid.Nil for the top level
+}
+
+// RenameOp changes the name of an entry.
+type RenameOp struct {
+	Id   uuid.UUID
+	Name string
+}
+
+// MoveUpOp moves an entry one step towards the top of its folder.
+type MoveUpOp struct {
+	Id uuid.UUID
+}
+
+// MoveDownOp moves an entry one step towards the bottom of its folder.
+type MoveDownOp struct {
+	Id uuid.UUID
+}
+
+// PinOp pins or unpins an entry.
+type PinOp struct {
+	Id     uuid.UUID
+	Pinned bool
+}
+
+// UpdateOp replaces the text of an existing entry, and marks it as modified.
+// If the text changed, the previous text is kept as a revision.
+type UpdateOp struct {
+	Entry Entry
+}
+
+// DeleteOp removes an entry from the index, and the entry itself, without passing through the trash.
+// Folders can only be deleted when they are empty.
+type DeleteOp struct {
+	Id uuid.UUID
+}
+
+// applyOps runs the ops in order against the index, returning the entries created along the way.
+func applyOps(idx Index, target batchTarget, ops []Op) ([]Entry, Index, error) {
+	created := []Entry{}
+	for _, op := range ops {
+		var entry *Entry
+		var err error
+		idx, entry, err = op.apply(idx, target)
+		if err != nil {
+			return nil, nil, err
+		}
+		if entry != nil {
+			created = append(created, *entry)
+		}
+	}
+	return created, idx, nil
+}
+
+func (idx Index) position(id uuid.UUID) int {
+	for i, meta := range idx {
+		if meta.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (op CreateOp) apply(idx Index, target batchTarget) (Index, *Entry, error) {
+	if err := idx.checkParent(op.Parent); err != nil {
+		return idx, nil, err
+	}
+	id, err := uuid.NewV7()
+	if err != nil {
+		return idx, nil, err
+	}
+	entry := Entry{
+		Id:   id,
+		Text: op.Text,
+	}
+	if err := target.putEntry(entry); err != nil {
+		return idx, nil, err
+	}
+	now := timestamp()
+	idx = append(idx, EntryMeta{
+		Name:     op.Name,
+		Id:       entry.Id,
+		Created:  now,
+		Modified: now,
+		Tags:     NormalizeTags(op.Tags),
+		Parent:   op.Parent,
+		Size:     len(op.Text),
+	})
+	return idx, &entry, nil
+}
+
+func (op RenameOp) apply(idx Index, target batchTarget) (Index, *Entry, error) {
+	i := idx.position(op.Id)
+	if i < 0 {
+		return idx, nil, ErrNoSuchEntry
+	}
+	idx[i].Name = op.Name
+	return idx, nil, nil
+}
+
+func (op MoveUpOp) apply(idx Index, target batchTarget) (Index, *Entry, error) {
+	i := idx.position(op.Id)
+	if i < 0 {
+		return idx, nil, ErrNoSuchEntry
+	}
+	if j := idx.sibling(i, -1); j >= 0 { // Already being at the top is not an error
+		idx[j], idx[i] = idx[i], idx[j]
+	}
+	return idx, nil, nil
+}
+
+func (op MoveDownOp) apply(idx Index, target batchTarget) (Index, *Entry, error) {
+	i := idx.position(op.Id)
+	if i < 0 {
+		return idx, nil, ErrNoSuchEntry
+	}
+	if j := idx.sibling(i, 1); j >= 0 { // Already being at the bottom is not an error
+		idx[j], idx[i] = idx[i], idx[j]
+	}
+	return idx, nil, nil
+}
+
+func (op PinOp) apply(idx Index, target batchTarget) (Index, *Entry, error) {
+	i := idx.position(op.Id)
+	if i < 0 {
+		return idx, nil, ErrNoSuchEntry
+	}
+	idx[i].Pinned = op.Pinned
+	return idx, nil, nil
+}
+
+func (op UpdateOp) apply(idx Index, target batchTarget) (Index, *Entry, error) {
+	i := idx.position(op.Entry.Id)
+	if i < 0 || idx[i].Folder {
+		return idx, nil, ErrNoSuchEntry
+	}
+	previous, err := target.getEntry(op.Entry.Id)
+	if err != nil && !errors.Is(err, ErrNoSuchEntry) {
+		return idx, nil, err
+	}
+	if err == nil && previous.Text != op.Entry.Text {
+		id, err := uuid.NewV7()
+		if err != nil {
+			return idx, nil, err
+		}
+		err = target.keepRevision(Revision{
+			Id:      id,
+			EntryId: previous.Id,
+			Saved:   idx[i].Modified,
+			Text:    previous.Text,
+		})
+		if err != nil {
+			return idx, nil, err
+		}
+	}
+	idx[i].Modified = timestamp()
+	idx[i].Size = len(op.Entry.Text)
+	return idx, nil, target.putEntry(op.Entry)
+}
+
+func (op DeleteOp) apply(idx Index, target batchTarget) (Index, *Entry, error) {
+	i := idx.position(op.Id)
+	if i < 0 {
+		return idx, nil, ErrNoSuchEntry
+	}
+	folder := idx[i].Folder
+	if folder && idx.hasChildren(op.Id) {
+		return idx, nil, ErrFolderNotEmpty
+	}
+	idx = append(idx[:i], idx[i+1:]...)
+	if folder {
+		return idx, nil, nil
+	}
+	return idx, nil, target.deleteEntry(op.Id)
+}
@@ -1,241 +1,1404 @@
 package storage
 
 import (
+	"bytes"
+	"cmp"
 	"crypto/cipher"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	bolt "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
 )
 
 type BoltStorage struct {
-	bolt   *bolt.DB
-	cipher cipher.AEAD
+	bolt     *bolt.DB
+	cipher   cipher.AEAD
+	lock     sync.RWMutex
+	index    Index               // Decrypted copy of the stored index, kept in step with every write
+	orders   map[uuid.UUID]int64 // Sort key of each entry in the index
+	settings Settings
+	search   *searchIndex // Words of every entry, decrypted after unlocking and never written anywhere
+	keys     keyring
+	opened   map[uuid.UUID]bool // Entries opened since the last change, whose opened time is only in the index until the next one
 }
 
 var (
-	indexKey  = []byte("index")
-	bucketKey = []byte("hardnote")
+	indexKey        = []byte("index")
+	bucketKey       = []byte("hardnote")
+	metaBucketKey   = []byte("meta")
+	revisionsKey    = []byte("revisions")
+	settingsKey     = []byte("settings")
+	trashKey        = []byte("trash")
+	headerBucketKey = []byte("header")
+	kdfKey          = []byte("kdf")
+	slotsKey        = []byte("slots")
+	formatKey       = []byte("format")
+	keyCheckKey     = []byte("keycheck")
+	quarantineKey   = []byte("quarantine")
 )
 
-func NewBoltStorage(filename string, keyText []byte) (Storage, error) {
-
-	gcm, err := NewGCM(keyText)
+func NewBoltStorage(filename string, keyText []byte, opts ...Option) (Storage, error) {
+	options := collectOptions(opts)
 
+	db, err := openBolt(filename, nil)
 	if err != nil {
-		return BoltStorage{}, err
+		return nil, err
+	}
+
+	store := &BoltStorage{
+		bolt:   db,
+		opened: map[uuid.UUID]bool{},
 	}
 
-	db, err := bolt.Open(filename, 0600, nil)
+	err = db.Update(func(tx *bolt.Tx) error {
+		vault, err := openVault(tx, keyText, options)
+		if err != nil {
+			return err
+		}
+		store.cipher = vault.cipher
+		store.keys = options.newKeyring(vault.keys)
+		bb, err := newBoltBatch(tx, store.cipher, DefaultSettings())
+		if err != nil {
+			return err
+		}
+		store.settings, err = bb.loadSettings()
+		if err != nil {
+			return err
+		}
+		bb.settings = store.settings
+		if err := bb.purgeExpiredTrash(timestamp()); err != nil {
+			return err
+		}
+		store.index, store.orders, err = bb.loadIndex()
+		if err != nil {
+			return err
+		}
+		store.search = bb.loadSearch(store.index)
+		return nil
+	})
 	if err != nil {
-		return BoltStorage{}, err
+		db.Close()
+		return nil, err
 	}
 
-	store := BoltStorage{
-		bolt:   db,
-		cipher: gcm,
+	return store, nil
+}
+
+// openBolt opens the bolt file, waiting a little for any other process to let go of it, but not for ever.
+func openBolt(filename string, boltOptions *bolt.Options) (*bolt.DB, error) {
+	if boltOptions == nil {
+		boltOptions = &bolt.Options{}
 	}
+	boltOptions.Timeout = vaultLockTimeout
+	db, err := bolt.Open(filename, 0600, boltOptions)
+	if errors.Is(err, berrors.ErrTimeout) {
+		return nil, ErrVaultInUse
+	}
+	return db, err
+}
 
-	_, err = store.Index()
+func readHeader(tx *bolt.Tx) (Header, bool, error) {
+	header := Header{}
+	bucket := tx.Bucket(headerBucketKey)
+	if bucket == nil {
+		return header, false, nil
+	}
+	rawKDF, rawSlots := bucket.Get(kdfKey), bucket.Get(slotsKey)
+	if rawKDF != nil {
+		if err := Decode(rawKDF, &header.KDF); err != nil {
+			return header, true, err
+		}
+	}
+	if rawSlots != nil {
+		if err := Decode(rawSlots, &header.Slots); err != nil {
+			return header, true, err
+		}
+	}
+	return header, rawKDF != nil || rawSlots != nil, nil
+}
+
+// readBoltHeader reads the unencrypted header of a bolt vault without opening it for writing.
+// A vault from before the header existed has to be opened with the passphrase once, to be upgraded.
+func readBoltHeader(filename string) (Header, error) {
+	db, err := openBolt(filename, &bolt.Options{ReadOnly: true})
 	if err != nil {
-		return BoltStorage{}, err
+		return Header{}, err
 	}
+	defer db.Close()
+	header := Header{}
+	err = db.View(func(tx *bolt.Tx) error {
+		var found bool
+		var err error
+		header, found, err = readHeader(tx)
+		if err == nil && !found {
+			return ErrNeedPassphrase
+		}
+		return err
+	})
+	return header, err
+}
 
-	return store, nil
+func readFormat(tx *bolt.Tx) (Format, bool, error) {
+	format := Format{}
+	bucket := tx.Bucket(headerBucketKey)
+	if bucket == nil {
+		return format, false, nil
+	}
+	raw := bucket.Get(formatKey)
+	if raw == nil {
+		return format, false, nil
+	}
+	return format, true, Decode(raw, &format)
 }
 
-func (b BoltStorage) Close() error {
-	return b.bolt.Close()
+func writeFormat(tx *bolt.Tx, format Format) error {
+	bucket, err := tx.CreateBucketIfNotExists(headerBucketKey)
+	if err != nil {
+		return err
+	}
+	data, err := Encode(format)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(formatKey, data)
+}
+
+// keyCheckText is sealed in the key check record. Being able to open it at all is what proves the key.
+const keyCheckText = "hardnote"
+
+func writeKeyCheck(tx *bolt.Tx, gcm cipher.AEAD) error {
+	bucket, err := tx.CreateBucketIfNotExists(headerBucketKey)
+	if err != nil {
+		return err
+	}
+	data, err := Harden(gcm, keyCheckText, AssociatedData(RecordKeyCheck, keyCheckKey))
+	if err != nil {
+		return err
+	}
+	return bucket.Put(keyCheckKey, data)
 }
 
-func (b BoltStorage) bucket(tx *bolt.Tx) (*bolt.Bucket, error) {
-	bucket := tx.Bucket(bucketKey)
+// verifyKeyCheck reports ErrInvalidKey if the cipher can't open the key check record.
+// A vault from before key checks existed is reported as not verified, without an error.
+func verifyKeyCheck(tx *bolt.Tx, gcm cipher.AEAD) (bool, error) {
+	bucket := tx.Bucket(headerBucketKey)
 	if bucket == nil {
-		return tx.CreateBucket(bucketKey)
+		return false, nil
 	}
-	return bucket, nil
+	raw := bucket.Get(keyCheckKey)
+	if raw == nil {
+		return false, nil
+	}
+	text := ""
+	err := Soften(gcm, raw, &text, AssociatedData(RecordKeyCheck, keyCheckKey))
+	if errors.Is(err, ErrIntegrity) {
+		return false, ErrInvalidKey
+	}
+	if err != nil {
+		return false, err
+	}
+	if text != keyCheckText {
+		return false, fmt.Errorf("%w: unexpected key check %q", ErrInvalidStorage, text)
+	}
+	return true, nil
 }
 
-func (b BoltStorage) Index() (Index, error) {
-	idx := Index{}
-	err := b.bolt.Update(func(tx *bolt.Tx) error {
-		bucket, err := b.bucket(tx)
+func writeHeader(tx *bolt.Tx, header Header) error {
+	bucket, err := tx.CreateBucketIfNotExists(headerBucketKey)
+	if err != nil {
+		return err
+	}
+	if header.KDF.Algorithm == "" {
+		if err := bucket.Delete(kdfKey); err != nil {
+			return err
+		}
+	} else {
+		data, err := Encode(header.KDF)
 		if err != nil {
 			return err
 		}
-		value := bucket.Get(indexKey)
-		if value == nil {
-			data, err := Harden(b.cipher, idx)
-			if err != nil {
-				return err
-			}
-			return bucket.Put(indexKey, data)
+		if err := bucket.Put(kdfKey, data); err != nil {
+			return err
 		}
-		return Soften(b.cipher, value, &idx)
-	})
-	return idx, err
+	}
+	if len(header.Slots) == 0 {
+		return bucket.Delete(slotsKey)
+	}
+	data, err := Encode(header.Slots)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(slotsKey, data)
+}
+
+// adFunc gives the associated data for a value stored under a given key.
+type adFunc func(key []byte) []byte
+
+// noAD is for values sealed before associated data was used.
+func noAD(key []byte) []byte {
+	return nil
+}
+
+// boltAD binds values in the main bucket to their key, and what kind of record that key holds.
+func boltAD(key []byte) []byte {
+	if string(key) == string(indexKey) {
+		return AssociatedData(RecordIndex, key)
+	}
+	return AssociatedData(RecordEntry, key)
+}
+
+// metaAD binds values in the meta bucket to the entry they describe.
+func metaAD(key []byte) []byte {
+	return AssociatedData(RecordMeta, key)
+}
+
+// revisionAD binds values in the revisions bucket to the entry and revision they are.
+func revisionAD(key []byte) []byte {
+	return AssociatedData(RecordRevision, key)
 }
-func (b BoltStorage) updateIndex(idx Index) error {
-	return b.bolt.Update(func(tx *bolt.Tx) error {
-		bucket, err := b.bucket(tx)
+
+// settingsAD binds values in the settings bucket to what setting they are.
+func settingsAD(key []byte) []byte {
+	return AssociatedData(RecordSettings, key)
+}
+
+// trashAD binds values in the trash bucket to the entry they were.
+func trashAD(key []byte) []byte {
+	return AssociatedData(RecordTrash, key)
+}
+
+// sealedBuckets lists every bucket holding sealed values, along with how the values are bound to their keys.
+var sealedBuckets = []struct {
+	key []byte
+	ad  adFunc
+}{
+	{bucketKey, boltAD},
+	{metaBucketKey, metaAD},
+	{revisionsKey, revisionAD},
+	{settingsKey, settingsAD},
+	{trashKey, trashAD},
+}
+
+// resealVault encrypts every sealed value of the vault anew with another cipher, key check included.
+func resealVault(tx *bolt.Tx, from cipher.AEAD, to cipher.AEAD) error {
+	for _, sealed := range sealedBuckets {
+		bucket := tx.Bucket(sealed.key)
+		if bucket == nil {
+			continue
+		}
+		if err := reseal(bucket, from, sealed.ad, to, sealed.ad); err != nil {
+			return err
+		}
+	}
+	return writeKeyCheck(tx, to)
+}
+
+// reseal decrypts every value in the bucket with one cipher and encrypts it again with another.
+func reseal(bucket *bolt.Bucket, from cipher.AEAD, fromAD adFunc, to cipher.AEAD, toAD adFunc) error {
+	resealed := map[string][]byte{}
+	err := bucket.ForEach(func(k, v []byte) error {
+		data, err := unseal(from, v, fromAD(k))
 		if err != nil {
 			return err
 		}
-		data, err := Harden(b.cipher, idx)
+		data, err = seal(to, data, toAD(k))
 		if err != nil {
 			return err
 		}
-		return bucket.Put(indexKey, data)
+		resealed[string(k)] = data
+		return nil
 	})
-}
-func (b BoltStorage) Rename(id uuid.UUID, newName string) (Index, error) {
-	idx, err := b.Index()
 	if err != nil {
-		return idx, err
+		return err
 	}
-	for i, meta := range idx {
-		if meta.Id == id {
-			idx[i].Name = newName
-			return idx, b.updateIndex(idx)
+	for k, v := range resealed {
+		if err := bucket.Put([]byte(k), v); err != nil {
+			return err
 		}
 	}
-	return idx, ErrNoSuchEntry
+	return nil
+}
+
+// Rekey changes the passphrase of the slot the vault was opened with, as described for keyring.rekey.
+// The master key is replaced as well, so everything is encrypted anew, all in one transaction.
+func (b *BoltStorage) Rekey(keyText []byte) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var slot KeySlot
+	err := b.updateSlots(func(slots []KeySlot) ([]KeySlot, []byte, error) {
+		var master []byte
+		var err error
+		slots, slot, master, err = b.keys.rekey(slots, keyText)
+		return slots, master, err
+	}, func() {
+		b.keys.opened = slot.Id
+	})
+	return err
+}
+
+// Slots lists the ways the vault can be unlocked.
+func (b *BoltStorage) Slots() ([]KeySlot, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	var slots []KeySlot
+	err := b.bolt.View(func(tx *bolt.Tx) error {
+		header, _, err := readHeader(tx)
+		slots = header.Slots
+		return err
+	})
+	return slots, err
+}
+
+// AddSlot adds another way of unlocking the vault. The secret is the passphrase or the recovery code,
+// and the keyfile is the one to mix in with the passphrase, or the one to unlock a keyfile slot with.
+func (b *BoltStorage) AddSlot(kind SlotKind, label string, secret []byte, keyfile []byte) (KeySlot, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var slot KeySlot
+	err := b.updateSlots(func(slots []KeySlot) ([]KeySlot, []byte, error) {
+		var err error
+		slots, slot, err = b.keys.add(slots, kind, label, secret, keyfile)
+		return slots, nil, err
+	}, nil)
+	return slot, err
+}
+
+// RevokeSlot takes away a way of unlocking the vault, refusing to take away the last one.
+// Like Rekey, it replaces the master key and encrypts everything anew.
+func (b *BoltStorage) RevokeSlot(id uuid.UUID) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.updateSlots(func(slots []KeySlot) ([]KeySlot, []byte, error) {
+		return b.keys.revoke(slots, id)
+	}, func() {
+		if id == b.keys.opened {
+			b.keys.opened = uuid.Nil
+		}
+	})
 }
 
-func (b BoltStorage) MoveUp(id uuid.UUID) (Index, error) {
-	idx, err := b.Index()
+// updateSlots changes the key slots in the header, all in one transaction. If the change comes with a new master key,
+// everything is encrypted anew with it. Once that is committed, the keyring is brought up to date by applied, if given.
+func (b *BoltStorage) updateSlots(change func(slots []KeySlot) ([]KeySlot, []byte, error), applied func()) error {
+	var master []byte
+	var gcm cipher.AEAD
+	err := b.update(func(tx *bolt.Tx) error {
+		header, _, err := readHeader(tx)
+		if err != nil {
+			return err
+		}
+		if len(header.Slots) == 0 {
+			return fmt.Errorf("%w: no key slots", ErrInvalidStorage)
+		}
+		header.Slots, master, err = change(header.Slots)
+		if err != nil {
+			return err
+		}
+		if master != nil {
+			gcm, err = NewCipher(master)
+			if err != nil {
+				return err
+			}
+			if err := resealVault(tx, b.cipher, gcm); err != nil {
+				return err
+			}
+		}
+		return writeHeader(tx, header)
+	})
 	if err != nil {
-		return idx, err
+		return err
+	}
+	if master != nil {
+		b.cipher, b.keys.master = gcm, master
+	}
+	if applied != nil {
+		applied()
+	}
+	return nil
+}
+
+// Close saves the opened times kept since the last change, and closes the file.
+func (b *BoltStorage) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var err error
+	if len(b.opened) > 0 {
+		err = b.update(func(tx *bolt.Tx) error {
+			return nil // Nothing but the opened times
+		})
+	}
+	if closeErr := b.bolt.Close(); err == nil {
+		err = closeErr
 	}
-	for i, entry := range idx {
-		if entry.Id == id {
-			if i == 0 {
-				return idx, nil // Already being at the top is not an error
+	return err
+}
+
+// update runs a write transaction, first saving the opened times kept since the last one in it.
+func (b *BoltStorage) update(change func(tx *bolt.Tx) error) error {
+	err := b.bolt.Update(func(tx *bolt.Tx) error {
+		if len(b.opened) > 0 {
+			bb, err := newBoltBatch(tx, b.cipher, b.settings)
+			if err != nil {
+				return err
+			}
+			for id := range b.opened {
+				i := b.index.position(id)
+				if i < 0 {
+					continue
+				}
+				if err := bb.putMeta(b.index[i], b.orders[id]); err != nil {
+					return err
+				}
 			}
-			idx[i-1], idx[i] = idx[i], idx[i-1]
-			err = b.updateIndex(idx)
-			return idx, err
 		}
+		return change(tx)
+	})
+	if err == nil {
+		clear(b.opened)
 	}
-	return idx, ErrNoSuchEntry
+	return err
 }
-func (b BoltStorage) MoveDown(id uuid.UUID) (Index, error) {
-	idx, err := b.Index()
+
+// metaRecord is how an EntryMeta is stored, each in its own record, along with the key that puts it in order.
+type metaRecord struct {
+	Meta  EntryMeta
+	Order int64
+}
+
+// boltBatch is a write transaction that ops can be applied in.
+type boltBatch struct {
+	cipher    cipher.AEAD
+	settings  Settings
+	entries   *bolt.Bucket
+	metas     *bolt.Bucket
+	revisions *bolt.Bucket
+	trash     *bolt.Bucket
+	written   map[uuid.UUID]*Entry // Entries put or deleted (nil) in the batch, for keeping the search index in step
+}
+
+func newBoltBatch(tx *bolt.Tx, gcm cipher.AEAD, settings Settings) (boltBatch, error) {
+	bb := boltBatch{
+		cipher:   gcm,
+		settings: settings,
+		written:  map[uuid.UUID]*Entry{},
+	}
+	for _, bucket := range []struct {
+		key    []byte
+		target **bolt.Bucket
+	}{
+		{bucketKey, &bb.entries},
+		{metaBucketKey, &bb.metas},
+		{revisionsKey, &bb.revisions},
+		{trashKey, &bb.trash},
+	} {
+		var err error
+		*bucket.target, err = tx.CreateBucketIfNotExists(bucket.key)
+		if err != nil {
+			return bb, err
+		}
+	}
+	return bb, nil
+}
+
+// loadSettings reads the settings of the vault, or the defaults if they were never changed.
+func (bb boltBatch) loadSettings() (Settings, error) {
+	bucket := bb.entries.Tx().Bucket(settingsKey)
+	if bucket == nil {
+		return DefaultSettings(), nil
+	}
+	raw := bucket.Get(settingsKey)
+	if raw == nil {
+		return DefaultSettings(), nil
+	}
+	settings := Settings{}
+	return settings, Soften(bb.cipher, raw, &settings, settingsAD(settingsKey))
+}
+
+func (bb boltBatch) saveSettings(settings Settings) error {
+	bucket, err := bb.entries.Tx().CreateBucketIfNotExists(settingsKey)
+	if err != nil {
+		return err
+	}
+	data, err := Harden(bb.cipher, settings, settingsAD(settingsKey))
+	if err != nil {
+		return err
+	}
+	return bucket.Put(settingsKey, data)
+}
+
+// loadIndex decrypts every meta record and puts them in order.
+func (bb boltBatch) loadIndex() (Index, map[uuid.UUID]int64, error) {
+	records := []metaRecord{}
+	err := bb.metas.ForEach(func(k, v []byte) error {
+		record := metaRecord{}
+		if err := Soften(bb.cipher, v, &record, metaAD(k)); err != nil {
+			return err
+		}
+		records = append(records, record)
+		return nil
+	})
 	if err != nil {
-		return idx, err
+		return nil, nil, err
+	}
+	slices.SortFunc(records, func(a, b metaRecord) int {
+		return cmp.Compare(a.Order, b.Order)
+	})
+	idx := make(Index, len(records))
+	orders := make(map[uuid.UUID]int64, len(records))
+	for i, record := range records {
+		idx[i] = record.Meta
+		orders[record.Meta.Id] = record.Order
 	}
-	for i, entry := range idx {
-		if entry.Id == id {
-			if i == len(idx)-1 {
-				return idx, nil // Already being at the bottom is not an error
+	return idx, orders, nil
+}
+
+// loadSearch decrypts every entry in the index, to build the search index from.
+// Entries that can't be read are left out, so a damaged vault can still be opened and checked.
+func (bb boltBatch) loadSearch(idx Index) *searchIndex {
+	search := newSearchIndex()
+	for _, meta := range idx {
+		if meta.Folder {
+			continue
+		}
+		entry, err := bb.getEntry(meta.Id)
+		if err != nil {
+			continue
+		}
+		search.put(entry.Id, entry.Text)
+	}
+	return search
+}
+
+// saveIndex writes the meta records that differ between the old index and the new one, and nothing else.
+func (bb boltBatch) saveIndex(old Index, oldOrders map[uuid.UUID]int64, idx Index) (map[uuid.UUID]int64, error) {
+	orders, changed := planOrder(idx, oldOrders)
+
+	previous := make(map[uuid.UUID]EntryMeta, len(old))
+	for _, meta := range old {
+		previous[meta.Id] = meta
+	}
+	for id := range previous {
+		if _, ok := orders[id]; !ok {
+			if err := bb.metas.Delete(id[:]); err != nil {
+				return nil, err
 			}
-			idx[i+1], idx[i] = idx[i], idx[i+1]
-			err = b.updateIndex(idx)
-			return idx, err
 		}
 	}
-	return idx, ErrNoSuchEntry
+
+	write := make(map[int]bool, len(changed))
+	for _, i := range changed {
+		write[i] = true
+	}
+	for i, meta := range idx {
+		if !write[i] && previous[meta.Id].same(meta) {
+			continue
+		}
+		if err := bb.putMeta(meta, orders[meta.Id]); err != nil {
+			return nil, err
+		}
+	}
+	return orders, nil
+}
+
+func (bb boltBatch) putMeta(meta EntryMeta, order int64) error {
+	data, err := Harden(bb.cipher, metaRecord{Meta: meta, Order: order}, metaAD(meta.Id[:]))
+	if err != nil {
+		return err
+	}
+	return bb.metas.Put(meta.Id[:], data)
+}
+
+func (bb boltBatch) putEntry(entry Entry) error {
+	data, err := Harden(bb.cipher, entry, boltAD(entry.Id[:]))
+	if err != nil {
+		return err
+	}
+	if bb.written != nil {
+		bb.written[entry.Id] = &entry
+	}
+	return bb.entries.Put(entry.Id[:], data)
+}
+
+func (bb boltBatch) getEntry(id uuid.UUID) (Entry, error) {
+	entry := Entry{}
+	raw := bb.entries.Get(id[:])
+	if raw == nil {
+		return entry, ErrNoSuchEntry
+	}
+	return entry, Soften(bb.cipher, raw, &entry, boltAD(id[:]))
 }
 
-func (b BoltStorage) Create(name, initialText string) (Entry, Index, error) {
-	entry := Entry{
-		Text: initialText,
+func (bb boltBatch) deleteEntry(id uuid.UUID) error {
+	revisions, err := bb.listRevisions(id)
+	if err != nil {
+		return err
 	}
+	if err := bb.forgetRevisions(revisions); err != nil {
+		return err
+	}
+	if bb.written != nil {
+		bb.written[id] = nil
+	}
+	return bb.entries.Delete(id[:])
+}
 
-	idx, err := b.Index()
+func (bb boltBatch) trashEntry(meta EntryMeta, deleted time.Time) error {
+	entry, err := bb.getEntry(meta.Id)
 	if err != nil {
-		return entry, idx, err
+		return err
+	}
+	data, err := Harden(bb.cipher, TrashedEntry{Meta: meta, Text: entry.Text, Deleted: deleted}, trashAD(meta.Id[:]))
+	if err != nil {
+		return err
+	}
+	if err := bb.trash.Put(meta.Id[:], data); err != nil {
+		return err
+	}
+	if bb.written != nil {
+		bb.written[meta.Id] = nil
 	}
+	return bb.entries.Delete(meta.Id[:]) // The revisions stay, in case it is restored
+}
+
+func (bb boltBatch) getTrash(id uuid.UUID) (TrashedEntry, error) {
+	trashed := TrashedEntry{}
+	raw := bb.trash.Get(id[:])
+	if raw == nil {
+		return trashed, ErrNoSuchEntry
+	}
+	return trashed, Soften(bb.cipher, raw, &trashed, trashAD(id[:]))
+}
+
+func (bb boltBatch) restoreEntry(id uuid.UUID) (EntryMeta, error) {
+	trashed, err := bb.getTrash(id)
+	if err != nil {
+		return trashed.Meta, err
+	}
+	if err := bb.putEntry(Entry{Id: id, Text: trashed.Text}); err != nil {
+		return trashed.Meta, err
+	}
+	trashed.Meta.Size = len(trashed.Text) // It may have been trashed before sizes were kept
+	return trashed.Meta, bb.trash.Delete(id[:])
+}
 
-	id, err := uuid.NewV7()
+func (bb boltBatch) purgeEntry(id uuid.UUID) error {
+	if bb.trash.Get(id[:]) == nil {
+		return ErrNoSuchEntry
+	}
+	revisions, err := bb.listRevisions(id)
 	if err != nil {
-		return entry, idx, err
+		return err
 	}
-	entry.Id = id
+	if err := bb.forgetRevisions(revisions); err != nil {
+		return err
+	}
+	return bb.trash.Delete(id[:])
+}
 
-	idx = append(idx, EntryMeta{
-		Name: name,
-		Id:   entry.Id,
+// listTrash decrypts everything in the trash, most recently deleted first.
+func (bb boltBatch) listTrash() ([]TrashedEntry, error) {
+	trash := []TrashedEntry{}
+	err := bb.trash.ForEach(func(k, v []byte) error {
+		trashed := TrashedEntry{}
+		if err := Soften(bb.cipher, v, &trashed, trashAD(k)); err != nil {
+			return err
+		}
+		trash = append(trash, trashed)
+		return nil
 	})
+	slices.SortFunc(trash, func(a, b TrashedEntry) int {
+		return b.Deleted.Compare(a.Deleted)
+	})
+	return trash, err
+}
+
+// purgeExpiredTrash purges the entries that have been in the trash for longer than the settings allow.
+func (bb boltBatch) purgeExpiredTrash(now time.Time) error {
+	trash, err := bb.listTrash()
+	if err != nil {
+		return err
+	}
+	for _, trashed := range trash {
+		if !bb.settings.trashExpired(trashed, now) {
+			continue
+		}
+		if err := bb.purgeEntry(trashed.Meta.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func revisionKey(entryId uuid.UUID, revisionId uuid.UUID) []byte {
+	return append(entryId[:], revisionId[:]...)
+}
 
-	err = b.updateIndex(idx)
+func (bb boltBatch) keepRevision(revision Revision) error {
+	key := revisionKey(revision.EntryId, revision.Id)
+	data, err := Harden(bb.cipher, revision, revisionAD(key))
 	if err != nil {
-		return entry, idx, err
+		return err
+	}
+	if err := bb.revisions.Put(key, data); err != nil {
+		return err
 	}
+	return bb.pruneRevisions(revision.EntryId)
+}
 
-	err = b.storeEntry(entry)
+// listRevisions decrypts the revisions of an entry, oldest first.
+func (bb boltBatch) listRevisions(entryId uuid.UUID) ([]Revision, error) {
+	revisions := []Revision{}
+	c := bb.revisions.Cursor()
+	for k, v := c.Seek(entryId[:]); k != nil && bytes.HasPrefix(k, entryId[:]); k, v = c.Next() {
+		revision := Revision{}
+		if err := Soften(bb.cipher, v, &revision, revisionAD(k)); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, nil
+}
 
-	return entry, idx, err
+func (bb boltBatch) forgetRevisions(revisions []Revision) error {
+	for _, revision := range revisions {
+		if err := bb.revisions.Delete(revisionKey(revision.EntryId, revision.Id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneRevisions forgets the revisions of an entry that are past the retention settings.
+func (bb boltBatch) pruneRevisions(entryId uuid.UUID) error {
+	revisions, err := bb.listRevisions(entryId)
+	if err != nil {
+		return err
+	}
+	return bb.forgetRevisions(bb.settings.expired(revisions, timestamp()))
 }
 
-func (b BoltStorage) storeEntry(entry Entry) error {
-	return b.bolt.Update(func(tx *bolt.Tx) error {
-		bucket, err := b.bucket(tx)
+// Index returns a copy of the cached index, without touching the file.
+func (b *BoltStorage) Index() (Index, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return slices.Clone(b.index), nil
+}
+
+// Batch applies all the ops in a single transaction, so either all of them happen or none of them do.
+// It returns the entries made by any CreateOp, in order, and the resulting index.
+func (b *BoltStorage) Batch(ops ...Op) ([]Entry, Index, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var created []Entry
+	var idx Index
+	var orders map[uuid.UUID]int64
+	var written map[uuid.UUID]*Entry
+	err := b.update(func(tx *bolt.Tx) error {
+		bb, err := newBoltBatch(tx, b.cipher, b.settings)
 		if err != nil {
 			return err
 		}
-		data, err := Harden(b.cipher, entry)
+		written = bb.written
+		created, idx, err = applyOps(slices.Clone(b.index), bb, ops)
 		if err != nil {
 			return err
 		}
-		return bucket.Put(entry.Id[:], data)
+		orders, err = bb.saveIndex(b.index, b.orders, idx)
+		return err
 	})
+	if err != nil {
+		return nil, nil, err
+	}
+	b.index = idx
+	b.orders = orders
+	for id, entry := range written {
+		if entry == nil {
+			b.search.remove(id)
+		} else {
+			b.search.put(id, entry.Text)
+		}
+	}
+	return created, slices.Clone(idx), nil
+}
+
+func (b *BoltStorage) Rename(id uuid.UUID, newName string) (Index, error) {
+	_, idx, err := b.Batch(RenameOp{Id: id, Name: newName})
+	return idx, err
+}
+
+func (b *BoltStorage) MoveUp(id uuid.UUID) (Index, error) {
+	_, idx, err := b.Batch(MoveUpOp{Id: id})
+	return idx, err
+}
+
+func (b *BoltStorage) MoveDown(id uuid.UUID) (Index, error) {
+	_, idx, err := b.Batch(MoveDownOp{Id: id})
+	return idx, err
+}
+
+func (b *BoltStorage) Tag(id uuid.UUID, tags []string) (Index, error) {
+	_, idx, err := b.Batch(TagOp{Id: id, Tags: tags})
+	return idx, err
+}
+
+func (b *BoltStorage) Pin(id uuid.UUID, pinned bool) (Index, error) {
+	_, idx, err := b.Batch(PinOp{Id: id, Pinned: pinned})
+	return idx, err
+}
+
+// CreateFolder makes a new folder, last in the parent folder.
+func (b *BoltStorage) CreateFolder(name string, parent uuid.UUID) (EntryMeta, Index, error) {
+	created, idx, err := b.Batch(CreateFolderOp{Name: name, Parent: parent})
+	if err != nil {
+		return EntryMeta{}, idx, err
+	}
+	return idx[idx.position(created[0].Id)], idx, nil
+}
+
+// Move puts the entry or folder last in the parent folder.
+func (b *BoltStorage) Move(id uuid.UUID, parent uuid.UUID) (Index, error) {
+	_, idx, err := b.Batch(MoveToOp{Id: id, Parent: parent})
+	return idx, err
 }
 
-func (b BoltStorage) Read(id uuid.UUID) (Entry, error) {
+func (b *BoltStorage) Create(name, initialText string) (Entry, Index, error) {
+	created, idx, err := b.Batch(CreateOp{Name: name, Text: initialText})
+	if err != nil {
+		return Entry{Text: initialText}, idx, err
+	}
+	return created[0], idx, nil
+}
+
+// Read returns the entry, and marks it as opened. That alone is not worth writing the file for,
+// so it is saved along with the next change, or when closing.
+func (b *BoltStorage) Read(id uuid.UUID) (Entry, error) {
+	entry, err := b.Peek(id)
+	if err != nil {
+		return entry, err
+	}
+	b.markOpened(id)
+	return entry, nil
+}
+
+// Peek returns the entry without marking it as opened, for looking at it rather than opening it.
+func (b *BoltStorage) Peek(id uuid.UUID) (Entry, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
 	entry := Entry{}
 	err := b.bolt.View(func(tx *bolt.Tx) error {
-		bucket, err := b.bucket(tx)
-		if err != nil {
-			return err
+		bucket := tx.Bucket(bucketKey)
+		if bucket == nil {
+			return ErrNoSuchEntry
 		}
 		raw := bucket.Get(id[:])
 		if raw == nil {
 			return ErrNoSuchEntry
 		}
-		return Soften(b.cipher, raw, &entry)
-
+		return Soften(b.cipher, raw, &entry, boltAD(id[:]))
 	})
 	return entry, err
 }
 
-func (b BoltStorage) Update(entry Entry) error {
-	idx, err := b.Index()
+// markOpened records in the index that the entry was opened just now, for the next write to save.
+func (b *BoltStorage) markOpened(id uuid.UUID) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	i := b.index.position(id)
+	if i < 0 {
+		return // Orphans can be read, but have no meta record to mark
+	}
+	b.index[i].Opened = timestamp()
+	b.opened[id] = true
+}
+
+// Update writes the entry, and marks it as modified.
+func (b *BoltStorage) Update(entry Entry) (Index, error) {
+	_, idx, err := b.Batch(UpdateOp{Entry: entry})
+	return idx, err
+}
+
+// Revisions lists the earlier texts of an entry, newest first.
+func (b *BoltStorage) Revisions(id uuid.UUID) ([]Revision, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	var revisions []Revision
+	err := b.bolt.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(revisionsKey)
+		if bucket == nil {
+			revisions = []Revision{}
+			return nil
+		}
+		var err error
+		revisions, err = boltBatch{cipher: b.cipher, revisions: bucket}.listRevisions(id)
+		return err
+	})
+	slices.Reverse(revisions)
+	return revisions, err
+}
+
+func (b *BoltStorage) Settings() (Settings, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.settings, nil
+}
+
+// UpdateSettings stores the settings, and right away forgets any revisions and purges any trash past the new limits.
+func (b *BoltStorage) UpdateSettings(settings Settings) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	err := b.update(func(tx *bolt.Tx) error {
+		bb, err := newBoltBatch(tx, b.cipher, settings)
+		if err != nil {
+			return err
+		}
+		if err := bb.saveSettings(settings); err != nil {
+			return err
+		}
+		for _, meta := range b.index {
+			if err := bb.pruneRevisions(meta.Id); err != nil {
+				return err
+			}
+		}
+		return bb.purgeExpiredTrash(timestamp())
+	})
 	if err != nil {
 		return err
 	}
-	for _, candidate := range idx {
-		if candidate.Id == entry.Id {
-			return b.storeEntry(entry)
+	b.settings = settings
+	return nil
+}
+
+// SetSort stores how the listing is sorted, leaving the rest of the settings, and what they keep, alone.
+func (b *BoltStorage) SetSort(sort SortMode) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	settings := b.settings
+	settings.Sort = sort
+	err := b.update(func(tx *bolt.Tx) error {
+		bb, err := newBoltBatch(tx, b.cipher, settings)
+		if err != nil {
+			return err
 		}
+		return bb.saveSettings(settings)
+	})
+	if err != nil {
+		return err
 	}
-	return ErrNoSuchEntry
+	b.settings = settings
+	return nil
+}
+
+// Search finds the entries that have words starting with every word of the query, in index order.
+// It works from memory, without touching the file.
+func (b *BoltStorage) Search(query string) ([]SearchResult, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.search.search(b.index, query), nil
 }
 
-func (b BoltStorage) Delete(id uuid.UUID) (Index, error) {
-	idx, err := b.Index()
+// Delete removes the entry for ever. Use Trash for something that can be undone.
+func (b *BoltStorage) Delete(id uuid.UUID) (Index, error) {
+	_, idx, err := b.Batch(DeleteOp{Id: id})
+	return idx, err
+}
+
+// Trash moves the entry out of the index and into the trash, where it can be restored from.
+func (b *BoltStorage) Trash(id uuid.UUID) (Index, error) {
+	_, idx, err := b.Batch(TrashOp{Id: id})
+	return idx, err
+}
+
+// TrashBin lists what is in the trash, most recently deleted first.
+func (b *BoltStorage) TrashBin() ([]TrashedEntry, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	var trash []TrashedEntry
+	err := b.bolt.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(trashKey)
+		if bucket == nil {
+			trash = []TrashedEntry{}
+			return nil
+		}
+		var err error
+		trash, err = boltBatch{cipher: b.cipher, trash: bucket}.listTrash()
+		return err
+	})
+	return trash, err
+}
+
+// Restore puts a trashed entry back, at the end of the index.
+func (b *BoltStorage) Restore(id uuid.UUID) (Index, error) {
+	_, idx, err := b.Batch(RestoreOp{Id: id})
+	return idx, err
+}
+
+// Purge removes an entry from the trash for ever.
+func (b *BoltStorage) Purge(id uuid.UUID) error {
+	_, _, err := b.Batch(PurgeOp{Id: id})
+	return err
+}
+
+// EmptyTrash purges everything in the trash, all at once.
+func (b *BoltStorage) EmptyTrash() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.update(func(tx *bolt.Tx) error {
+		bb, err := newBoltBatch(tx, b.cipher, b.settings)
+		if err != nil {
+			return err
+		}
+		ids := [][]byte{}
+		err = bb.trash.ForEach(func(k, v []byte) error {
+			ids = append(ids, slices.Clone(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range ids {
+			id, err := uuid.FromBytes(k)
+			if err != nil {
+				if err := bb.trash.Delete(k); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := bb.purgeEntry(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// quarantineRecord moves a record that can't be decrypted out of its bucket and into the quarantine bucket, as it is.
+// It is out of the way there, and never read or resealed, but not lost in case it can be recovered some other way.
+func quarantineRecord(tx *bolt.Tx, from []byte, k []byte) (string, error) {
+	quarantine, err := tx.CreateBucketIfNotExists(quarantineKey)
 	if err != nil {
-		return idx, err
+		return "", err
 	}
-	remove := -1
-	for i, candidate := range idx {
-		if candidate.Id == id {
-			remove = i
-			break
+	bucket := tx.Bucket(from)
+	key := slices.Concat(from, []byte("/"), k)
+	if err := quarantine.Put(key, bytes.Clone(bucket.Get(k))); err != nil {
+		return "", err
+	}
+	return quarantinedName(key), bucket.Delete(k)
+}
+
+// quarantinedName is how a record in the quarantine bucket is reported, with the name of the bucket it came from.
+func quarantinedName(key []byte) string {
+	from, k, _ := bytes.Cut(key, []byte("/"))
+	return fmt.Sprintf("%s %x", from, k)
+}
+
+// Check decrypts everything in the vault and reports anything that doesn't add up.
+// With repair, the problems are fixed in the same transaction: Undecryptable records are moved to the
+// quarantine bucket as they are, meta records of missing entries are dropped, orphans are put back in
+// the index as RecoveredName and strays are moved to the top level.
+func (b *BoltStorage) Check(repair bool) (CheckReport, error) {
+	report := CheckReport{}
+	check := func(tx *bolt.Tx) error {
+		entriesBucket := tx.Bucket(bucketKey)
+		metasBucket := tx.Bucket(metaBucketKey)
+		if entriesBucket == nil || metasBucket == nil {
+			return nil
+		}
+
+		var unreadableEntries, unreadableMetas [][]byte
+		records := []metaRecord{}
+		err := metasBucket.ForEach(func(k, v []byte) error {
+			record := metaRecord{}
+			if err := Soften(b.cipher, v, &record, metaAD(k)); err != nil || !bytes.Equal(record.Meta.Id[:], k) {
+				report.Undecryptable = append(report.Undecryptable, fmt.Sprintf("meta %x", k))
+				unreadableMetas = append(unreadableMetas, k)
+				return nil
+			}
+			records = append(records, record)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		slices.SortFunc(records, func(a, b metaRecord) int {
+			return cmp.Compare(a.Order, b.Order)
+		})
+
+		entries := map[uuid.UUID]bool{}
+		sizes := map[uuid.UUID]int{}
+		err = entriesBucket.ForEach(func(k, v []byte) error {
+			id, err := uuid.FromBytes(k)
+			if err != nil {
+				report.Undecryptable = append(report.Undecryptable, fmt.Sprintf("%x", k))
+				unreadableEntries = append(unreadableEntries, k)
+				return nil
+			}
+			entry := Entry{}
+			if err := Soften(b.cipher, v, &entry, boltAD(k)); err != nil || entry.Id != id {
+				report.Undecryptable = append(report.Undecryptable, id.String())
+				unreadableEntries = append(unreadableEntries, k)
+				return nil
+			}
+			entries[id] = true
+			sizes[id] = len(entry.Text)
+			report.Entries++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if quarantine := tx.Bucket(quarantineKey); quarantine != nil {
+			err = quarantine.ForEach(func(k, v []byte) error {
+				report.Quarantined = append(report.Quarantined, quarantinedName(k))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		var unreadableTrash [][]byte
+		if trashBucket := tx.Bucket(trashKey); trashBucket != nil {
+			err = trashBucket.ForEach(func(k, v []byte) error {
+				trashed := TrashedEntry{}
+				if err := Soften(b.cipher, v, &trashed, trashAD(k)); err != nil || !bytes.Equal(trashed.Meta.Id[:], k) {
+					report.Undecryptable = append(report.Undecryptable, fmt.Sprintf("trash %x", k))
+					unreadableTrash = append(unreadableTrash, k)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		seen := map[uuid.UUID]bool{}
+		folders := map[uuid.UUID]bool{uuid.Nil: true}
+		lastOrder := int64(0)
+		for _, record := range records {
+			if record.Meta.Folder {
+				folders[record.Meta.Id] = true
+			} else if !entries[record.Meta.Id] {
+				report.Dangling = append(report.Dangling, record.Meta)
+			}
+			seen[record.Meta.Id] = true
+			lastOrder = max(lastOrder, record.Order)
+		}
+		strays := map[uuid.UUID]int64{}
+		for _, record := range records {
+			if !folders[record.Meta.Parent] {
+				report.Strays = append(report.Strays, record.Meta)
+				strays[record.Meta.Id] = record.Order
+			}
+		}
+		for id := range entries {
+			if !seen[id] {
+				report.Orphans = append(report.Orphans, id)
+			}
+		}
+		slices.SortFunc(report.Orphans, func(a, b uuid.UUID) int {
+			return bytes.Compare(a[:], b[:]) // UUIDv7 sorts by creation time
+		})
+
+		if !repair || report.Clean() {
+			return nil
+		}
+
+		for _, unreadable := range []struct {
+			bucket []byte
+			keys   [][]byte
+		}{
+			{bucketKey, unreadableEntries},
+			{metaBucketKey, unreadableMetas},
+			{trashKey, unreadableTrash},
+		} {
+			for _, k := range unreadable.keys {
+				name, err := quarantineRecord(tx, unreadable.bucket, k)
+				if err != nil {
+					return err
+				}
+				report.Quarantined = append(report.Quarantined, name)
+			}
+		}
+		for _, meta := range report.Dangling {
+			if err := metasBucket.Delete(meta.Id[:]); err != nil {
+				return err
+			}
+		}
+		bb := boltBatch{cipher: b.cipher, entries: entriesBucket, metas: metasBucket}
+		for _, meta := range report.Strays {
+			if !entries[meta.Id] && !meta.Folder {
+				continue // Dangling as well, and already gone
+			}
+			meta.Parent = uuid.Nil
+			if err := bb.putMeta(meta, strays[meta.Id]); err != nil {
+				return err
+			}
+		}
+		for _, id := range report.Orphans {
+			lastOrder += orderStep
+			created := createdFromId(id)
+			meta := EntryMeta{Name: RecoveredName, Id: id, Created: created, Modified: created, Size: sizes[id]}
+			if err := bb.putMeta(meta, lastOrder); err != nil {
+				return err
+			}
 		}
+		report.Repaired = true
+		return nil
 	}
-	if remove < 0 {
-		return idx, ErrNoSuchEntry
+
+	if !repair {
+		b.lock.RLock()
+		defer b.lock.RUnlock()
+		return report, b.bolt.View(check)
 	}
-	idx = append(idx[:remove], idx[remove+1:]...)
-	err = b.updateIndex(idx)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var idx Index
+	var orders map[uuid.UUID]int64
+	var search *searchIndex
+	err := b.update(func(tx *bolt.Tx) error {
+		if err := check(tx); err != nil {
+			return err
+		}
+		bb, err := newBoltBatch(tx, b.cipher, b.settings)
+		if err != nil {
+			return err
+		}
+		idx, orders, err = bb.loadIndex()
+		if err != nil {
+			return err
+		}
+		search = bb.loadSearch(idx)
+		return nil
+	})
 	if err != nil {
-		return idx, err
+		return report, err
+	}
+	b.index = idx
+	b.orders = orders
+	b.search = search
+	return report, nil
+}
+
+// dump decrypts everything in the vault. Unlike opening it, this fails on anything unreadable, which Check can fix first.
+func (b *BoltStorage) dump() (vaultContents, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	contents := newVaultContents()
+	contents.Index = slices.Clone(b.index)
+	contents.Settings = b.settings
+	err := b.bolt.View(func(tx *bolt.Tx) error {
+		bb := boltBatch{cipher: b.cipher, entries: tx.Bucket(bucketKey), revisions: tx.Bucket(revisionsKey), trash: tx.Bucket(trashKey)}
+		if bb.entries != nil {
+			err := bb.entries.ForEach(func(k, v []byte) error {
+				id, err := uuid.FromBytes(k)
+				if err != nil {
+					return fmt.Errorf("%w: entry %x", ErrInvalidStorage, k)
+				}
+				entry, err := bb.getEntry(id)
+				if err != nil {
+					return fmt.Errorf("entry %s: %w", id, err)
+				}
+				contents.Entries[id] = entry
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if bb.revisions != nil {
+			err := bb.revisions.ForEach(func(k, v []byte) error {
+				revision := Revision{}
+				if err := Soften(b.cipher, v, &revision, revisionAD(k)); err != nil {
+					return fmt.Errorf("revision %x: %w", k, err)
+				}
+				contents.Revisions[revision.EntryId] = append(contents.Revisions[revision.EntryId], revision)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if bb.trash != nil {
+			trash, err := bb.listTrash()
+			if err != nil {
+				return err
+			}
+			for _, trashed := range trash {
+				contents.Trash[trashed.Meta.Id] = trashed
+			}
+		}
+		return nil
+	})
+	return contents, err
+}
+
+// load writes the contents of another vault into this one, if nothing has been put in it yet.
+func (b *BoltStorage) load(contents vaultContents) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.index) > 0 {
+		return fmt.Errorf("%w: only an empty vault can be loaded into", ErrInvalidStorage)
 	}
-	return idx, b.bolt.Update(func(tx *bolt.Tx) error {
-		bucket, err := b.bucket(tx)
+	var orders map[uuid.UUID]int64
+	var search *searchIndex
+	err := b.update(func(tx *bolt.Tx) error {
+		bb, err := newBoltBatch(tx, b.cipher, contents.Settings)
 		if err != nil {
 			return err
 		}
-		return bucket.Delete(id[:])
+		if bb.entries.Stats().KeyN > 0 || bb.trash.Stats().KeyN > 0 {
+			return fmt.Errorf("%w: only an empty vault can be loaded into", ErrInvalidStorage)
+		}
+		if err := bb.saveSettings(contents.Settings); err != nil {
+			return err
+		}
+		for _, entry := range contents.Entries {
+			if err := bb.putEntry(entry); err != nil {
+				return err
+			}
+		}
+		for _, revisions := range contents.Revisions {
+			for _, revision := range revisions {
+				key := revisionKey(revision.EntryId, revision.Id)
+				data, err := Harden(b.cipher, revision, revisionAD(key))
+				if err != nil {
+					return err
+				}
+				if err := bb.revisions.Put(key, data); err != nil {
+					return err
+				}
+			}
+		}
+		for id, trashed := range contents.Trash {
+			data, err := Harden(b.cipher, trashed, trashAD(id[:]))
+			if err != nil {
+				return err
+			}
+			if err := bb.trash.Put(id[:], data); err != nil {
+				return err
+			}
+		}
+		orders, err = bb.saveIndex(Index{}, map[uuid.UUID]int64{}, contents.Index)
+		if err != nil {
+			return err
+		}
+		search = bb.loadSearch(contents.Index)
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+	b.index = slices.Clone(contents.Index)
+	b.orders = orders
+	b.settings = contents.Settings
+	b.search = search
+	return nil
 }
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const benchEntries = 10_000
+
+func benchStorage(b *testing.B) *BoltStorage {
+	b.Helper()
+	kdf, err := NewKDF(1, 1024, 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	store, err := NewBoltStorage(filepath.Join(b.TempDir(), "hardnote.bench"), []byte("benchmark"), WithKDF(kdf))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		store.Close()
+	})
+	ops := make([]Op, benchEntries)
+	for i := range ops {
+		ops[i] = CreateOp{Name: fmt.Sprintf("Entry number %d", i), Text: "Some text that is not very long at all"}
+	}
+	if _, _, err := store.Batch(ops...); err != nil {
+		b.Fatal(err)
+	}
+	return store.(*BoltStorage)
+}
+
+// BenchmarkBoltIndexFromDisk is what every Index call would cost without the cached index.
+func BenchmarkBoltIndexFromDisk(b *testing.B) {
+	store := benchStorage(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := store.bolt.View(func(tx *bolt.Tx) error {
+			bb := boltBatch{cipher: store.cipher, entries: tx.Bucket(bucketKey), metas: tx.Bucket(metaBucketKey)}
+			_, _, err := bb.loadIndex()
+			return err
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBoltIndex(b *testing.B) {
+	store := benchStorage(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.Index(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBoltRename(b *testing.B) {
+	store := benchStorage(b)
+	id := store.index[benchEntries/2].Id
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.Rename(id, fmt.Sprintf("Renamed %d times", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBoltMoveUp(b *testing.B) {
+	store := benchStorage(b)
+	id := store.index[benchEntries-1].Id
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.MoveUp(id); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBoltUpdate(b *testing.B) {
+	store := benchStorage(b)
+	entry, err := store.Read(store.index[benchEntries/2].Id)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		entry.Text = fmt.Sprintf("Updated %d times", i)
+		if _, err := store.Update(entry); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBoltRead(b *testing.B) {
+	store := benchStorage(b)
+	id := store.index[benchEntries/2].Id
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := store.Read(id); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
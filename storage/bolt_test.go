@@ -1,13 +1,30 @@
 package storage_test
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/DemmyDemon/hardnote/storage"
 	"github.com/DemmyDemon/hardnote/test"
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
 )
 
+// withoutTimes strips the timestamps from index rows, for comparing with rows made up in a test.
+func withoutTimes[T ~[]storage.EntryMeta](idx T) T {
+	stripped := make(T, len(idx))
+	for i, meta := range idx {
+		stripped[i] = storage.EntryMeta{Name: meta.Name, Id: meta.Id, Tags: meta.Tags, Parent: meta.Parent, Folder: meta.Folder}
+	}
+	return stripped
+}
+
 func TestBolt(t *testing.T) {
 	filename := filepath.Join(t.TempDir(), "hardnote.test")
 	store, err := storage.NewBoltStorage(filename, []byte("Please don't tell anyone my secret key!"))
@@ -25,8 +42,8 @@ func TestBolt(t *testing.T) {
 	test.Result(t, err, "create initial entry", entry, idx)
 
 	entry.Text = "Updated text body of the entry"
-	err = store.Update(entry)
-	test.Result(t, err, "update initial entry", entry)
+	idx, err = store.Update(entry)
+	test.Result(t, err, "update initial entry", entry, idx)
 
 	compareEntry, err := store.Read(entry.Id)
 	test.Result(t, err, "read initial entry back", compareEntry)
@@ -56,3 +73,799 @@ func TestBolt(t *testing.T) {
 	idx, err = store.Delete(additionalEntry.Id)
 	test.Result(t, err, "delete additional entry", idx)
 }
+
+func TestBoltLegacyUpgrade(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "hardnote.test")
+	passphrase := []byte("This used to be hashed once and that was it")
+
+	legacy, err := storage.NewGCM(passphrase)
+	test.Result(t, err, "instantiate legacy GCM")
+
+	entry := storage.Entry{Id: uuid.Must(uuid.NewV7()), Text: "Old but gold"}
+	idx := storage.Index{{Name: "Legacy entry", Id: entry.Id}}
+
+	db, err := bolt.Open(filename, 0600, nil)
+	test.Result(t, err, "open raw bolt file", filename)
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("hardnote"))
+		if err != nil {
+			return err
+		}
+		data, err := storage.Harden(legacy, idx, nil)
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte("index"), data); err != nil {
+			return err
+		}
+		data, err = storage.Harden(legacy, entry, nil)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(entry.Id[:], data)
+	})
+	test.Result(t, err, "write legacy vault")
+	test.Result(t, db.Close(), "close raw bolt file")
+
+	kdf := storage.CheapKDF(t)
+
+	_, err = storage.NewBoltStorage(filename, []byte("Not the legacy passphrase"), storage.WithKDF(kdf))
+	if !errors.Is(err, storage.ErrInvalidKey) {
+		t.Fatalf("expected %v opening a legacy vault with the wrong passphrase, got %v", storage.ErrInvalidKey, err)
+	}
+
+	store, err := storage.NewBoltStorage(filename, passphrase, storage.WithKDF(kdf))
+	test.Result(t, err, "open legacy vault")
+	upgradedIdx, err := store.Index()
+	test.Result(t, err, "read upgraded index", upgradedIdx)
+	test.Compare(t, "compare upgraded index", idx, withoutTimes(upgradedIdx))
+	test.Compare(t, "upgraded index has creation time from UUIDv7", time.Unix(entry.Id.Time().UnixTime()).UTC(), upgradedIdx[0].Created)
+	test.Compare(t, "upgraded index has the size of the entry", len(entry.Text), upgradedIdx[0].Size)
+	test.Result(t, store.Close(), "close upgraded vault")
+
+	store, err = storage.NewBoltStorage(filename, passphrase)
+	test.Result(t, err, "reopen upgraded vault")
+	upgradedEntry, err := store.Read(entry.Id)
+	test.Result(t, err, "read upgraded entry", upgradedEntry)
+	test.Compare(t, "compare upgraded entry", entry, upgradedEntry)
+	test.Result(t, store.Close(), "close upgraded vault again")
+
+	db, err = bolt.Open(filename, 0600, nil)
+	test.Result(t, err, "open raw bolt file again", filename)
+	err = db.View(func(tx *bolt.Tx) error {
+		err := storage.Soften(legacy, tx.Bucket([]byte("hardnote")).Get([]byte("index")), &storage.Index{}, nil)
+		if err == nil {
+			return errors.New("index still readable with the legacy key")
+		}
+		return nil
+	})
+	test.Result(t, err, "legacy key no longer works")
+	test.Result(t, db.Close(), "close raw bolt file again")
+}
+
+func TestBoltRekey(t *testing.T) {
+	oldKey := []byte("The old and busted passphrase")
+	newKey := []byte("The new hotness passphrase")
+	store, filename := storage.OpenTestVault(t, storage.BackendBolt, oldKey)
+
+	entry, idx, err := store.Create("Rekeyed entry", "Still readable after rekey")
+	test.Result(t, err, "create entry", entry, idx)
+
+	err = store.Rekey(newKey)
+	test.Result(t, err, "rekey")
+
+	compareEntry, err := store.Read(entry.Id)
+	test.Result(t, err, "read entry after rekey", compareEntry)
+	test.Compare(t, "compare entry after rekey", entry, compareEntry)
+	test.Result(t, store.Close(), "close file")
+
+	_, err = storage.NewBoltStorage(filename, oldKey)
+	if !errors.Is(err, storage.ErrInvalidKey) {
+		t.Fatalf("expected %v with the old passphrase, got %v", storage.ErrInvalidKey, err)
+	}
+
+	store, err = storage.NewBoltStorage(filename, newKey)
+	test.Result(t, err, "open with new passphrase")
+	compareEntry, err = store.Read(entry.Id)
+	test.Result(t, err, "read entry with new passphrase", compareEntry)
+	test.Compare(t, "compare entry with new passphrase", entry, compareEntry)
+	test.Result(t, store.Close(), "close file again")
+}
+
+func TestBoltFormatVersion(t *testing.T) {
+	passphrase := []byte("Versions all the way down")
+	store, filename := storage.OpenTestVault(t, storage.BackendBolt, passphrase)
+	test.Result(t, store.Close(), "close vault")
+
+	db, err := bolt.Open(filename, 0600, nil)
+	test.Result(t, err, "open raw bolt file", filename)
+	format := storage.Format{}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte("header"))
+		if err := storage.Decode(bucket.Get([]byte("format")), &format); err != nil {
+			return err
+		}
+		future := format
+		future.Version = storage.FormatVersion + 1
+		data, err := storage.Encode(future)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("format"), data)
+	})
+	test.Result(t, err, "replace format record with a future one", format)
+	test.Compare(t, "new vault has the current format", storage.CurrentFormat(), format)
+	test.Result(t, db.Close(), "close raw bolt file")
+
+	_, err = storage.NewBoltStorage(filename, passphrase)
+	if !errors.Is(err, storage.ErrVaultTooNew) {
+		t.Fatalf("expected %v when opening a vault from the future, got %v", storage.ErrVaultTooNew, err)
+	}
+}
+
+func TestBoltTampering(t *testing.T) {
+	passphrase := []byte("Nobody touches my notes")
+	store, filename := storage.OpenTestVault(t, storage.BackendBolt, passphrase)
+	one, _, err := store.Create("One", "The first entry")
+	test.Result(t, err, "create first entry", one)
+	other, _, err := store.Create("Other", "The other entry")
+	test.Result(t, err, "create other entry", other)
+	test.Result(t, store.Close(), "close vault")
+
+	tamper := func(what string, change func(bucket *bolt.Bucket) error) {
+		db, err := bolt.Open(filename, 0600, nil)
+		test.Result(t, err, "open raw bolt file", filename)
+		err = db.Update(func(tx *bolt.Tx) error {
+			return change(tx.Bucket([]byte("hardnote")))
+		})
+		test.Result(t, err, what)
+		test.Result(t, db.Close(), "close raw bolt file")
+	}
+
+	tamper("swap entries", func(bucket *bolt.Bucket) error {
+		oneData := append([]byte{}, bucket.Get(one.Id[:])...)
+		otherData := append([]byte{}, bucket.Get(other.Id[:])...)
+		if err := bucket.Put(one.Id[:], otherData); err != nil {
+			return err
+		}
+		return bucket.Put(other.Id[:], oneData)
+	})
+
+	store, err = storage.NewBoltStorage(filename, passphrase)
+	test.Result(t, err, "open vault with swapped entries")
+	_, err = store.Read(one.Id)
+	if !errors.Is(err, storage.ErrIntegrity) {
+		t.Errorf("expected %v reading a swapped entry, got %v", storage.ErrIntegrity, err)
+	}
+	test.Result(t, store.Close(), "close vault with swapped entries")
+
+	tamper("replace meta record with an entry", func(bucket *bolt.Bucket) error {
+		return bucket.Tx().Bucket([]byte("meta")).Put(one.Id[:], append([]byte{}, bucket.Get(one.Id[:])...))
+	})
+
+	_, err = storage.NewBoltStorage(filename, passphrase)
+	if !errors.Is(err, storage.ErrIntegrity) {
+		t.Errorf("expected %v opening a vault with an entry as a meta record, got %v", storage.ErrIntegrity, err)
+	}
+}
+
+func TestBoltInvalidKey(t *testing.T) {
+	store, filename := storage.OpenTestVault(t, storage.BackendBolt, []byte("The right one"))
+	entry, _, err := store.Create("Truncated", "This entry is about to get damaged")
+	test.Result(t, err, "create entry", entry)
+	test.Result(t, store.Close(), "close vault")
+
+	_, err = storage.NewBoltStorage(filename, []byte("The wrong one"))
+	if !errors.Is(err, storage.ErrInvalidKey) {
+		t.Fatalf("expected %v with the wrong passphrase, got %v", storage.ErrInvalidKey, err)
+	}
+
+	db, err := bolt.Open(filename, 0600, nil)
+	test.Result(t, err, "open raw bolt file", filename)
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("hardnote")).Put(entry.Id[:], []byte("short"))
+	})
+	test.Result(t, err, "truncate entry")
+	test.Result(t, db.Close(), "close raw bolt file")
+
+	store, err = storage.NewBoltStorage(filename, []byte("The right one"))
+	test.Result(t, err, "open vault with a truncated entry")
+	_, err = store.Read(entry.Id)
+	if !errors.Is(err, storage.ErrInvalidStorage) || errors.Is(err, storage.ErrInvalidKey) {
+		t.Errorf("expected %v reading a truncated entry, got %v", storage.ErrInvalidStorage, err)
+	}
+	test.Result(t, store.Close(), "close vault with a truncated entry")
+}
+
+func TestBoltCheck(t *testing.T) {
+	passphrase := []byte("Check yourself before you wreck yourself")
+	store, filename := storage.OpenTestVault(t, storage.BackendBolt, passphrase)
+
+	report, err := store.Check(false)
+	test.Result(t, err, "check empty vault", report)
+	test.Compare(t, "empty vault is clean", true, report.Clean())
+
+	kept, _, err := store.Create("Kept", "This one is fine")
+	test.Result(t, err, "create kept entry", kept)
+	orphan, _, err := store.Create("Orphan", "This one loses its meta record")
+	test.Result(t, err, "create orphaned entry", orphan)
+	danglingEntry, _, err := store.Create("Dangling", "This one loses its entry record")
+	test.Result(t, err, "create dangling entry", danglingEntry)
+	test.Result(t, store.Close(), "close vault")
+
+	dangling := storage.EntryMeta{Name: "Dangling", Id: danglingEntry.Id}
+	garbage := uuid.New()
+
+	db, err := bolt.Open(filename, 0600, nil)
+	test.Result(t, err, "open raw bolt file", filename)
+	err = db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket([]byte("hardnote"))
+		if err := tx.Bucket([]byte("meta")).Delete(orphan.Id[:]); err != nil {
+			return err
+		}
+		if err := entries.Delete(dangling.Id[:]); err != nil {
+			return err
+		}
+		return entries.Put(garbage[:], []byte("This is not a sealed value, not even close"))
+	})
+	test.Result(t, err, "break the vault")
+	test.Result(t, db.Close(), "close raw bolt file")
+
+	store, err = storage.NewBoltStorage(filename, passphrase)
+	test.Result(t, err, "open broken vault")
+
+	report, err = store.Check(false)
+	test.Result(t, err, "check broken vault", report)
+	test.Compare(t, "found dangling", []storage.EntryMeta{dangling}, withoutTimes(report.Dangling))
+	test.Compare(t, "found orphan", []uuid.UUID{orphan.Id}, report.Orphans)
+	test.Compare(t, "found undecryptable", []string{garbage.String()}, report.Undecryptable)
+
+	report, err = store.Check(true)
+	test.Result(t, err, "repair broken vault", report)
+	test.Compare(t, "repaired", true, report.Repaired)
+
+	report, err = store.Check(false)
+	test.Result(t, err, "check repaired vault", report)
+	test.Compare(t, "repaired vault is clean", true, report.Clean())
+
+	test.Compare(t, "undecryptable record is quarantined", []string{fmt.Sprintf("hardnote %x", garbage[:])}, report.Quarantined)
+	test.Result(t, store.Rekey([]byte("Quarantine stays out of the way")), "rekey repaired vault")
+
+	idx, err := store.Index()
+	test.Result(t, err, "read repaired index", idx)
+	test.Compare(t, "repaired index", storage.Index{
+		{Name: "Kept", Id: kept.Id},
+		{Name: storage.RecoveredName, Id: orphan.Id},
+	}, withoutTimes(idx))
+	test.Result(t, store.Close(), "close repaired vault")
+
+	db, err = bolt.Open(filename, 0600, &bolt.Options{ReadOnly: true})
+	test.Result(t, err, "open raw bolt file", filename)
+	err = db.View(func(tx *bolt.Tx) error {
+		kept := tx.Bucket([]byte("quarantine")).Get(append([]byte("hardnote/"), garbage[:]...))
+		test.Compare(t, "quarantined record is kept as it was", "This is not a sealed value, not even close", string(kept))
+		return nil
+	})
+	test.Result(t, err, "look in the quarantine")
+	test.Result(t, db.Close(), "close raw bolt file")
+}
+
+func TestBoltBatch(t *testing.T) {
+	store, _ := storage.OpenTestVault(t, storage.BackendBolt, []byte("All or nothing"))
+	defer func() {
+		test.Result(t, store.Close(), "close vault")
+	}()
+
+	created, idx, err := store.Batch(
+		storage.CreateOp{Name: "First", Text: "First text"},
+		storage.CreateOp{Name: "Second", Text: "Second text"},
+		storage.CreateOp{Name: "Third", Text: "Third text"},
+	)
+	test.Result(t, err, "batch create", created, idx)
+	test.Compare(t, "three created", 3, len(created))
+
+	_, _, err = store.Batch(
+		storage.RenameOp{Id: created[0].Id, Name: "Never happened"},
+		storage.DeleteOp{Id: created[1].Id},
+		storage.RenameOp{Id: uuid.New(), Name: "No such entry"},
+	)
+	if !errors.Is(err, storage.ErrNoSuchEntry) {
+		t.Fatalf("expected %v from batch with a bad op, got %v", storage.ErrNoSuchEntry, err)
+	}
+
+	unchanged, err := store.Index()
+	test.Result(t, err, "read index after failed batch", unchanged)
+	test.Compare(t, "failed batch changed nothing", idx, unchanged)
+	_, err = store.Read(created[1].Id)
+	test.Result(t, err, "entry deleted in failed batch still exists")
+
+	updated := created[2]
+	updated.Text = "Updated third text"
+	_, idx, err = store.Batch(
+		storage.RenameOp{Id: created[0].Id, Name: "Renamed"},
+		storage.MoveDownOp{Id: created[0].Id},
+		storage.DeleteOp{Id: created[1].Id},
+		storage.UpdateOp{Entry: updated},
+	)
+	test.Result(t, err, "batch of changes", idx)
+	test.Compare(t, "index after batch", storage.Index{
+		{Name: "Renamed", Id: created[0].Id},
+		{Name: "Third", Id: created[2].Id},
+	}, withoutTimes(idx))
+
+	_, err = store.Read(created[1].Id)
+	if !errors.Is(err, storage.ErrNoSuchEntry) {
+		t.Errorf("expected %v reading entry deleted in batch, got %v", storage.ErrNoSuchEntry, err)
+	}
+	compareEntry, err := store.Read(updated.Id)
+	test.Result(t, err, "read entry updated in batch", compareEntry)
+	test.Compare(t, "entry updated in batch", updated, compareEntry)
+}
+
+func TestBoltReopen(t *testing.T) {
+	passphrase := []byte("Same as it ever was")
+	store, filename := storage.OpenTestVault(t, storage.BackendBolt, passphrase)
+
+	created, _, err := store.Batch(
+		storage.CreateOp{Name: "One"},
+		storage.CreateOp{Name: "Two"},
+		storage.CreateOp{Name: "Three"},
+		storage.CreateOp{Name: "Four"},
+	)
+	test.Result(t, err, "create entries", len(created))
+	_, err = store.MoveUp(created[3].Id)
+	test.Result(t, err, "move fourth up")
+	_, err = store.MoveDown(created[0].Id)
+	test.Result(t, err, "move first down")
+	_, err = store.Rename(created[1].Id, "Deux")
+	test.Result(t, err, "rename second")
+	idx, err := store.Delete(created[2].Id)
+	test.Result(t, err, "delete third", idx)
+	test.Result(t, store.Close(), "close vault")
+
+	store, err = storage.NewBoltStorage(filename, passphrase)
+	test.Result(t, err, "reopen vault")
+	reopened, err := store.Index()
+	test.Result(t, err, "read reopened index", reopened)
+	test.Compare(t, "index survives reopening", idx, reopened)
+	test.Result(t, store.Close(), "close reopened vault")
+}
+
+func TestBoltTimestamps(t *testing.T) {
+	passphrase := []byte("What time is it?")
+	store, filename := storage.OpenTestVault(t, storage.BackendBolt, passphrase)
+
+	entry, idx, err := store.Create("Timely", "Created")
+	test.Result(t, err, "create entry", entry, idx)
+	created := idx[0]
+	if created.Created.IsZero() || !created.Modified.Equal(created.Created) || !created.Opened.IsZero() {
+		t.Errorf("new entry has unexpected times: %+v", created)
+	}
+
+	entry.Text = "Modified"
+	idx, err = store.Update(entry)
+	test.Result(t, err, "update entry", idx)
+	if !idx[0].Created.Equal(created.Created) || !idx[0].Modified.After(created.Modified) {
+		t.Errorf("updated entry has unexpected times: %+v", idx[0])
+	}
+
+	_, err = store.Read(entry.Id)
+	test.Result(t, err, "read entry")
+	idx, err = store.Index()
+	test.Result(t, err, "read index", idx)
+	if idx[0].Opened.Before(idx[0].Modified) {
+		t.Errorf("read entry has unexpected times: %+v", idx[0])
+	}
+	test.Result(t, store.Close(), "close vault")
+
+	store, err = storage.NewBoltStorage(filename, passphrase)
+	test.Result(t, err, "reopen vault")
+	reopened, err := store.Index()
+	test.Result(t, err, "read reopened index", reopened)
+	test.Compare(t, "times survive reopening", idx, reopened)
+	test.Result(t, store.Close(), "close reopened vault")
+}
+
+func TestBoltRead(t *testing.T) {
+	passphrase := []byte("Read only")
+	store, filename := storage.OpenTestVault(t, storage.BackendBolt, passphrase)
+	entry, _, err := store.Create("Glance", "Just looking")
+	test.Result(t, err, "create entry", entry.Id)
+
+	written, err := os.ReadFile(filename)
+	test.Result(t, err, "read bolt file", len(written))
+	_, err = store.Read(entry.Id)
+	test.Result(t, err, "read entry")
+	unchanged, err := os.ReadFile(filename)
+	test.Result(t, err, "read bolt file again", len(unchanged))
+	test.Compare(t, "reading leaves the file alone", true, bytes.Equal(written, unchanged))
+
+	idx, err := store.Index()
+	test.Result(t, err, "read index", idx)
+	newPassphrase := []byte("Read again")
+	test.Result(t, store.Rekey(newPassphrase), "rekey vault") // Everything is encrypted anew, opened time included
+	test.Result(t, store.Close(), "close vault")
+
+	store, err = storage.NewBoltStorage(filename, newPassphrase)
+	test.Result(t, err, "reopen bolt vault")
+	reopened, err := store.Index()
+	test.Result(t, err, "read reopened index", reopened)
+	test.Compare(t, "opened time is saved with the next change", idx[0].Opened, reopened[0].Opened)
+	test.Result(t, store.Close(), "close vault")
+}
+
+func TestBoltRevisions(t *testing.T) {
+	passphrase := []byte("I didn't mean to save that")
+	store, filename := storage.OpenTestVault(t, storage.BackendBolt, passphrase)
+
+	settings, err := store.Settings()
+	test.Result(t, err, "read default settings", settings)
+	test.Compare(t, "default settings", storage.DefaultSettings(), settings)
+
+	settings.RevisionsKept = 2
+	test.Result(t, store.UpdateSettings(settings), "keep two revisions")
+
+	entry, _, err := store.Create("Revised", "First draft")
+	test.Result(t, err, "create entry", entry)
+	for _, text := range []string{"Second draft", "Third draft", "Third draft", "Final draft"} {
+		entry.Text = text
+		_, err = store.Update(entry)
+		test.Result(t, err, "update entry", text)
+	}
+
+	revisions, err := store.Revisions(entry.Id)
+	test.Result(t, err, "list revisions", len(revisions))
+	texts := []string{}
+	for _, revision := range revisions {
+		texts = append(texts, revision.Text)
+	}
+	test.Compare(t, "two newest revisions are kept", []string{"Third draft", "Second draft"}, texts)
+
+	settings.RevisionsKept = 1
+	test.Result(t, store.UpdateSettings(settings), "keep one revision")
+	revisions, err = store.Revisions(entry.Id)
+	test.Result(t, err, "list revisions after pruning", len(revisions))
+	test.Compare(t, "one revision left", 1, len(revisions))
+
+	test.Result(t, store.Rekey([]byte("Revised passphrase")), "rekey")
+	test.Result(t, store.Close(), "close vault")
+
+	store, err = storage.NewBoltStorage(filename, []byte("Revised passphrase"))
+	test.Result(t, err, "reopen vault")
+	reopened, err := store.Settings()
+	test.Result(t, err, "read settings after reopening", reopened)
+	test.Compare(t, "settings survive reopening", settings, reopened)
+	rekeyed, err := store.Revisions(entry.Id)
+	test.Result(t, err, "list revisions after rekey", len(rekeyed))
+	test.Compare(t, "revisions survive rekey", revisions, rekeyed)
+
+	_, err = store.Delete(entry.Id)
+	test.Result(t, err, "delete entry")
+	revisions, err = store.Revisions(entry.Id)
+	test.Result(t, err, "list revisions of deleted entry", len(revisions))
+	test.Compare(t, "revisions are deleted with the entry", 0, len(revisions))
+	test.Result(t, store.Close(), "close reopened vault")
+}
+
+func TestBoltTrash(t *testing.T) {
+	passphrase := []byte("Second thoughts")
+	store, _ := storage.OpenTestVault(t, storage.BackendBolt, passphrase)
+
+	first, _, err := store.Create("First", "Keep me")
+	test.Result(t, err, "create first entry", first)
+	second, _, err := store.Create("Second", "Throw me out")
+	test.Result(t, err, "create second entry", second)
+	second.Text = "Throw me out, please"
+	_, err = store.Update(second)
+	test.Result(t, err, "update second entry")
+
+	idx, err := store.Trash(second.Id)
+	test.Result(t, err, "trash second entry", idx)
+	test.Compare(t, "trashed entry leaves the index", storage.Index{{Name: "First", Id: first.Id}}, withoutTimes(idx))
+	_, err = store.Read(second.Id)
+	test.Compare(t, "trashed entry can't be read", storage.ErrNoSuchEntry, err)
+
+	trash, err := store.TrashBin()
+	test.Result(t, err, "list trash", len(trash))
+	test.Compare(t, "one entry in the trash", 1, len(trash))
+	test.Compare(t, "trash keeps the name", "Second", trash[0].Meta.Name)
+	test.Compare(t, "trash keeps the text", second.Text, trash[0].Text)
+	test.Compare(t, "trash knows when", false, trash[0].Deleted.IsZero())
+
+	idx, err = store.Restore(second.Id)
+	test.Result(t, err, "restore second entry", idx)
+	test.Compare(t, "restored entry is back in the index",
+		storage.Index{{Name: "First", Id: first.Id}, {Name: "Second", Id: second.Id}}, withoutTimes(idx))
+	restored, err := store.Read(second.Id)
+	test.Result(t, err, "read restored entry", restored)
+	test.Compare(t, "restored text", second, restored)
+	revisions, err := store.Revisions(second.Id)
+	test.Result(t, err, "list revisions of restored entry", len(revisions))
+	test.Compare(t, "revisions survive the trash", 1, len(revisions))
+	_, err = store.Restore(second.Id)
+	test.Compare(t, "restoring twice", storage.ErrNoSuchEntry, err)
+
+	_, err = store.Trash(first.Id)
+	test.Result(t, err, "trash first entry")
+	_, err = store.Trash(second.Id)
+	test.Result(t, err, "trash second entry again")
+	test.Result(t, store.Rekey([]byte("Third thoughts")), "rekey with things in the trash")
+	trash, err = store.TrashBin()
+	test.Result(t, err, "list trash after rekey", len(trash))
+	test.Compare(t, "most recently deleted first", []uuid.UUID{second.Id, first.Id}, []uuid.UUID{trash[0].Meta.Id, trash[1].Meta.Id})
+
+	test.Result(t, store.Purge(second.Id), "purge second entry")
+	test.Compare(t, "purging twice", storage.ErrNoSuchEntry, store.Purge(second.Id))
+	revisions, err = store.Revisions(second.Id)
+	test.Result(t, err, "list revisions of purged entry", len(revisions))
+	test.Compare(t, "revisions are purged with the entry", 0, len(revisions))
+
+	report, err := store.Check(false)
+	test.Result(t, err, "check vault with trash", report)
+	test.Compare(t, "trash is not a problem", true, report.Clean())
+
+	test.Result(t, store.EmptyTrash(), "empty trash")
+	trash, err = store.TrashBin()
+	test.Result(t, err, "list emptied trash", len(trash))
+	test.Compare(t, "trash is empty", 0, len(trash))
+
+	third, _, err := store.Create("Third", "Short lived")
+	test.Result(t, err, "create third entry", third)
+	_, err = store.Trash(third.Id)
+	test.Result(t, err, "trash third entry")
+	settings, err := store.Settings()
+	test.Result(t, err, "read settings", settings)
+	settings.TrashMaxAge = time.Nanosecond
+	test.Result(t, store.UpdateSettings(settings), "purge trash after a nanosecond")
+	trash, err = store.TrashBin()
+	test.Result(t, err, "list expired trash", len(trash))
+	test.Compare(t, "expired trash is purged", 0, len(trash))
+	test.Result(t, store.Close(), "close vault")
+}
+
+func TestBoltTags(t *testing.T) {
+	passphrase := []byte("Tag, you're it")
+	store, filename := storage.OpenTestVault(t, storage.BackendBolt, passphrase)
+
+	work, _, err := store.Create("Work", "")
+	test.Result(t, err, "create work entry", work)
+	home, _, err := store.Create("Home", "")
+	test.Result(t, err, "create home entry", home)
+
+	idx, err := store.Tag(work.Id, []string{" todo", "work", "", "todo"})
+	test.Result(t, err, "tag work entry", idx)
+	test.Compare(t, "tags are normalized", []string{"todo", "work"}, idx[0].Tags)
+	idx, err = store.Tag(home.Id, []string{"todo"})
+	test.Result(t, err, "tag home entry", idx)
+	test.Compare(t, "every tag in the index", []string{"todo", "work"}, idx.Tags())
+	test.Compare(t, "work has all tags", true, idx[0].HasTags([]string{"todo", "work"}))
+	test.Compare(t, "home lacks a tag", false, idx[1].HasTags([]string{"todo", "work"}))
+	test.Compare(t, "no tags always match", true, idx[1].HasTags(nil))
+
+	_, err = store.Tag(uuid.New(), []string{"nope"})
+	test.Compare(t, "tagging a missing entry", storage.ErrNoSuchEntry, err)
+
+	test.Result(t, store.Close(), "close vault")
+	store, err = storage.NewBoltStorage(filename, passphrase)
+	test.Result(t, err, "reopen vault")
+	reopened, err := store.Index()
+	test.Result(t, err, "index after reopening", reopened)
+	test.Compare(t, "tags survive reopening", idx, reopened)
+
+	idx, err = store.Tag(work.Id, nil)
+	test.Result(t, err, "untag work entry", idx)
+	test.Compare(t, "tags are removed", []string(nil), idx[0].Tags)
+	test.Result(t, store.Close(), "close reopened vault")
+}
+
+func TestBoltFolders(t *testing.T) {
+	passphrase := []byte("A place for everything")
+	store, filename := storage.OpenTestVault(t, storage.BackendBolt, passphrase)
+
+	work, _, err := store.CreateFolder("Work", uuid.Nil)
+	test.Result(t, err, "create work folder", work)
+	projects, _, err := store.CreateFolder("Projects", work.Id)
+	test.Result(t, err, "create projects folder", projects)
+	created, _, err := store.Batch(
+		storage.CreateOp{Name: "Loose"},
+		storage.CreateOp{Name: "Plan", Parent: projects.Id},
+		storage.CreateOp{Name: "Timesheet", Parent: work.Id},
+		storage.CreateOp{Name: "Budget", Parent: projects.Id},
+	)
+	test.Result(t, err, "create entries in folders", len(created))
+	loose, plan, timesheet, budget := created[0], created[1], created[2], created[3]
+
+	_, _, err = store.Batch(storage.CreateOp{Name: "Nowhere", Parent: uuid.New()})
+	test.Compare(t, "create in missing folder", storage.ErrNoSuchEntry, err)
+	_, _, err = store.Batch(storage.CreateOp{Name: "Inside an entry", Parent: loose.Id})
+	test.Compare(t, "create inside an entry", storage.ErrNotAFolder, err)
+
+	idx, err := store.Index()
+	test.Result(t, err, "read index", idx)
+	test.Compare(t, "top level", storage.Index{
+		{Name: "Work", Id: work.Id, Folder: true},
+		{Name: "Loose", Id: loose.Id},
+	}, withoutTimes(idx.Children(uuid.Nil)))
+	test.Compare(t, "inside projects", storage.Index{
+		{Name: "Plan", Id: plan.Id, Parent: projects.Id},
+		{Name: "Budget", Id: budget.Id, Parent: projects.Id},
+	}, withoutTimes(idx.Children(projects.Id)))
+	test.Compare(t, "path to projects", storage.Index{
+		{Name: "Work", Id: work.Id, Folder: true},
+		{Name: "Projects", Id: projects.Id, Parent: work.Id, Folder: true},
+	}, withoutTimes(idx.Path(projects.Id)))
+
+	idx, err = store.MoveUp(budget.Id)
+	test.Result(t, err, "move budget up past an entry in another folder", idx)
+	test.Compare(t, "budget swapped with plan", storage.Index{
+		{Name: "Budget", Id: budget.Id, Parent: projects.Id},
+		{Name: "Plan", Id: plan.Id, Parent: projects.Id},
+	}, withoutTimes(idx.Children(projects.Id)))
+	test.Compare(t, "timesheet stays put", storage.Index{
+		{Name: "Projects", Id: projects.Id, Parent: work.Id, Folder: true},
+		{Name: "Timesheet", Id: timesheet.Id, Parent: work.Id},
+	}, withoutTimes(idx.Children(work.Id)))
+
+	_, err = store.Move(work.Id, projects.Id)
+	test.Compare(t, "move folder into itself", storage.ErrFolderLoop, err)
+	_, err = store.Move(loose.Id, timesheet.Id)
+	test.Compare(t, "move into an entry", storage.ErrNotAFolder, err)
+	idx, err = store.Move(loose.Id, projects.Id)
+	test.Result(t, err, "move loose entry into projects", idx)
+	test.Compare(t, "loose entry is last in projects", storage.Index{
+		{Name: "Budget", Id: budget.Id, Parent: projects.Id},
+		{Name: "Plan", Id: plan.Id, Parent: projects.Id},
+		{Name: "Loose", Id: loose.Id, Parent: projects.Id},
+	}, withoutTimes(idx.Children(projects.Id)))
+
+	_, err = store.Read(work.Id)
+	test.Compare(t, "folders can't be read", storage.ErrNoSuchEntry, err)
+	_, err = store.Update(storage.Entry{Id: work.Id, Text: "Folders have no text"})
+	test.Compare(t, "folders can't be written", storage.ErrNoSuchEntry, err)
+	_, err = store.Trash(projects.Id)
+	test.Compare(t, "trash folder with things in it", storage.ErrFolderNotEmpty, err)
+	_, err = store.Delete(projects.Id)
+	test.Compare(t, "delete folder with things in it", storage.ErrFolderNotEmpty, err)
+
+	report, err := store.Check(false)
+	test.Result(t, err, "check vault with folders", report)
+	test.Compare(t, "folders are not dangling", true, report.Clean())
+
+	_, err = store.Trash(plan.Id)
+	test.Result(t, err, "trash plan")
+	for _, id := range []uuid.UUID{budget.Id, loose.Id} {
+		_, err = store.Move(id, uuid.Nil)
+		test.Result(t, err, "move out of projects", id)
+	}
+	idx, err = store.Trash(projects.Id)
+	test.Result(t, err, "trash empty folder", idx)
+	test.Compare(t, "empty folder is gone", -1, slices.IndexFunc(idx, func(meta storage.EntryMeta) bool {
+		return meta.Id == projects.Id
+	}))
+	trash, err := store.TrashBin()
+	test.Result(t, err, "list trash", len(trash))
+	test.Compare(t, "folders don't go in the trash", 1, len(trash))
+
+	idx, err = store.Restore(plan.Id)
+	test.Result(t, err, "restore plan", idx)
+	test.Compare(t, "plan is restored to the top level", storage.EntryMeta{Name: "Plan", Id: plan.Id}, withoutTimes(idx[len(idx)-1:])[0])
+
+	test.Result(t, store.Close(), "close vault")
+	store, err = storage.NewBoltStorage(filename, passphrase)
+	test.Result(t, err, "reopen vault")
+	reopened, err := store.Index()
+	test.Result(t, err, "index after reopening", reopened)
+	test.Compare(t, "folders survive reopening", idx, reopened)
+	test.Result(t, store.Close(), "close reopened vault")
+}
+
+func TestBoltSearch(t *testing.T) {
+	passphrase := []byte("Needle in a haystack")
+	store, filename := storage.OpenTestVault(t, storage.BackendBolt, passphrase)
+
+	created, _, err := store.Batch(
+		storage.CreateOp{Name: "Groceries", Text: "Milk\nBread, butter and Cheese"},
+		storage.CreateOp{Name: "Recipe", Text: "Melt the butter, then add the bread"},
+		storage.CreateOp{Name: "Empty"},
+	)
+	test.Result(t, err, "create entries", len(created))
+	groceries, recipe := created[0], created[1]
+
+	names := func(results []storage.SearchResult) []string {
+		found := []string{}
+		for _, result := range results {
+			found = append(found, result.Meta.Name)
+		}
+		return found
+	}
+
+	results, err := store.Search("BUTTER")
+	test.Result(t, err, "search for a word", len(results))
+	test.Compare(t, "both have butter", []string{"Groceries", "Recipe"}, names(results))
+	test.Compare(t, "where the butter is", storage.SearchMatch{
+		Offset:  12,
+		Line:    1,
+		Column:  7,
+		Snippet: "Bread, butter and Cheese",
+		Start:   7,
+		End:     13,
+	}, results[0].Matches[0])
+
+	results, err = store.Search("chee")
+	test.Result(t, err, "search for the start of a word", len(results))
+	test.Compare(t, "only groceries have cheese", []string{"Groceries"}, names(results))
+
+	results, err = store.Search("butter melt")
+	test.Result(t, err, "search for two words", len(results))
+	test.Compare(t, "only the recipe has both", []string{"Recipe"}, names(results))
+	test.Compare(t, "both words are matched", 2, results[0].Count)
+
+	results, err = store.Search("  ,. ")
+	test.Result(t, err, "search for nothing", len(results))
+	test.Compare(t, "nothing is found", 0, len(results))
+
+	recipe.Text = "Toast the bread"
+	_, err = store.Update(recipe)
+	test.Result(t, err, "update recipe")
+	results, err = store.Search("butter")
+	test.Result(t, err, "search after update", len(results))
+	test.Compare(t, "recipe has no butter now", []string{"Groceries"}, names(results))
+	results, err = store.Search("toast")
+	test.Result(t, err, "search for new words", len(results))
+	test.Compare(t, "recipe has toast", []string{"Recipe"}, names(results))
+
+	_, err = store.Trash(groceries.Id)
+	test.Result(t, err, "trash groceries")
+	results, err = store.Search("bread")
+	test.Result(t, err, "search after trashing", len(results))
+	test.Compare(t, "trash is not searched", []string{"Recipe"}, names(results))
+	_, err = store.Restore(groceries.Id)
+	test.Result(t, err, "restore groceries")
+	results, err = store.Search("bread")
+	test.Result(t, err, "search after restoring", len(results))
+	test.Compare(t, "restored entries are searched", []string{"Recipe", "Groceries"}, names(results))
+
+	test.Result(t, store.Close(), "close vault")
+	store, err = storage.NewBoltStorage(filename, passphrase)
+	test.Result(t, err, "reopen vault")
+	results, err = store.Search("milk")
+	test.Result(t, err, "search after reopening", len(results))
+	test.Compare(t, "search is rebuilt when opening", []string{"Groceries"}, names(results))
+	test.Result(t, store.Close(), "close reopened vault")
+}
+
+func TestBoltPins(t *testing.T) {
+	passphrase := []byte("Pin it to the fridge")
+	store, filename := storage.OpenTestVault(t, storage.BackendBolt, passphrase)
+
+	created, _, err := store.Batch(
+		storage.CreateOp{Name: "Daily"},
+		storage.CreateOp{Name: "Rarely"},
+		storage.CreateOp{Name: "Weekly"},
+	)
+	test.Result(t, err, "create entries", len(created))
+
+	_, err = store.Pin(created[2].Id, true)
+	test.Result(t, err, "pin weekly")
+	idx, err := store.Pin(created[0].Id, true)
+	test.Result(t, err, "pin daily", idx)
+	test.Compare(t, "pinned entries in order", storage.Index{
+		{Name: "Daily", Id: created[0].Id},
+		{Name: "Weekly", Id: created[2].Id},
+	}, withoutTimes(idx.Pinned()))
+	test.Compare(t, "pinning keeps the order", "Rarely", idx[1].Name)
+
+	idx, err = store.Pin(created[2].Id, false)
+	test.Result(t, err, "unpin weekly", idx)
+	test.Compare(t, "one pinned entry left", 1, len(idx.Pinned()))
+	_, err = store.Pin(uuid.New(), true)
+	test.Compare(t, "pin a missing entry", storage.ErrNoSuchEntry, err)
+
+	test.Result(t, store.Close(), "close vault")
+	store, err = storage.NewBoltStorage(filename, passphrase)
+	test.Result(t, err, "reopen vault")
+	reopened, err := store.Index()
+	test.Result(t, err, "index after reopening", reopened)
+	test.Compare(t, "pins survive reopening", idx, reopened)
+	test.Result(t, store.Close(), "close reopened vault")
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// RecoveredName is what orphaned entries are called when a repair puts them back in the index.
+const RecoveredName = "Recovered"
+
+// CheckReport describes what a vault check found, and what it did about it if asked to repair.
+type CheckReport struct {
+	Entries       int         // Entries that decrypted fine
+	Dangling      []EntryMeta // Meta records of entries that don't exist
+	Orphans       []uuid.UUID // Entries without a meta record
+	Strays        []EntryMeta // Meta records in a folder that doesn't exist
+	Undecryptable []string    // Keys of records that could not be decrypted
+	Quarantined   []string    // Keys of undecryptable records a repair has set aside, where they are kept but never read
+	Repaired      bool
+}
+
+// Clean is true if the check found nothing wrong.
+func (r CheckReport) Clean() bool {
+	return len(r.Dangling) == 0 && len(r.Orphans) == 0 && len(r.Strays) == 0 && len(r.Undecryptable) == 0
+}
+
+// Summary is a one line description of the problems found.
+func (r CheckReport) Summary() string {
+	quarantined := ""
+	if len(r.Quarantined) > 0 {
+		quarantined = fmt.Sprintf(", %d records in quarantine", len(r.Quarantined))
+	}
+	if r.Clean() {
+		return fmt.Sprintf("%d entries, no problems found%s", r.Entries, quarantined)
+	}
+	return fmt.Sprintf("%d entries, %d dangling, %d orphaned, %d strays, %d undecryptable%s",
+		r.Entries, len(r.Dangling), len(r.Orphans), len(r.Strays), len(r.Undecryptable), quarantined)
+}
+
+func (r CheckReport) String() string {
+	var sb strings.Builder
+	sb.WriteString(r.Summary())
+	for _, meta := range r.Dangling {
+		sb.WriteString(fmt.Sprintf("\ndangling meta record [%s] %s", meta.Id, meta.Name))
+	}
+	for _, id := range r.Orphans {
+		sb.WriteString(fmt.Sprintf("\norphaned entry [%s]", id))
+	}
+	for _, meta := range r.Strays {
+		sb.WriteString(fmt.Sprintf("\nstray meta record [%s] %s in missing folder [%s]", meta.Id, meta.Name, meta.Parent))
+	}
+	for _, key := range r.Undecryptable {
+		sb.WriteString(fmt.Sprintf("\nundecryptable record %s", key))
+	}
+	for _, key := range r.Quarantined {
+		sb.WriteString(fmt.Sprintf("\nquarantined record %s", key))
+	}
+	if r.Repaired {
+		sb.WriteString("\nrepaired")
+	}
+	return sb.String()
+}
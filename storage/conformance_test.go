@@ -0,0 +1,471 @@
+package storage_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DemmyDemon/hardnote/storage"
+	"github.com/DemmyDemon/hardnote/test"
+	"github.com/google/uuid"
+)
+
+// implementations makes a new, empty store of every kind there is. A new backend goes here to prove it behaves like the rest.
+var implementations = []struct {
+	name string
+	open func(t *testing.T) storage.Storage
+}{
+	{"bolt", func(t *testing.T) storage.Storage {
+		store, _ := storage.OpenTestVault(t, storage.BackendBolt, []byte("Conformity is the jailer of freedom"))
+		return store
+	}},
+	{"sealed", func(t *testing.T) storage.Storage {
+		store, _ := storage.OpenTestVault(t, storage.BackendSealed, []byte("Conformity is the jailer of freedom"))
+		return store
+	}},
+	{"memory", func(t *testing.T) storage.Storage {
+		return storage.NewMemoryStorage()
+	}},
+}
+
+// conformance runs the test against a new store of every kind.
+func conformance(t *testing.T, run func(t *testing.T, store storage.Storage)) {
+	for _, implementation := range implementations {
+		t.Run(implementation.name, func(t *testing.T) {
+			store := implementation.open(t)
+			defer func() {
+				test.Result(t, store.Close(), "close store")
+			}()
+			run(t, store)
+		})
+	}
+}
+
+func TestConformanceEntries(t *testing.T) {
+	conformance(t, func(t *testing.T, store storage.Storage) {
+		idx, err := store.Index()
+		test.Result(t, err, "read empty index", idx)
+		test.Compare(t, "index starts empty", 0, len(idx))
+
+		first, _, err := store.Create("First", "First text")
+		test.Result(t, err, "create first entry", first)
+		second, idx, err := store.Create("Second", "Second text")
+		test.Result(t, err, "create second entry", second, idx)
+		test.Compare(t, "created in order", storage.Index{
+			{Name: "First", Id: first.Id},
+			{Name: "Second", Id: second.Id},
+		}, withoutTimes(idx))
+		test.Compare(t, "size of the text", len("Second text"), idx[1].Size)
+
+		read, err := store.Read(first.Id)
+		test.Result(t, err, "read first entry", read)
+		test.Compare(t, "read what was created", first, read)
+
+		first.Text = "Longer first text"
+		idx, err = store.Update(first)
+		test.Result(t, err, "update first entry", idx)
+		test.Compare(t, "size follows the text", len(first.Text), idx[0].Size)
+		read, err = store.Read(first.Id)
+		test.Result(t, err, "read updated entry", read)
+		test.Compare(t, "read what was updated", first, read)
+
+		idx, err = store.Rename(first.Id, "Renamed")
+		test.Result(t, err, "rename first entry", idx)
+		test.Compare(t, "renamed", "Renamed", idx[0].Name)
+
+		idx, err = store.MoveUp(first.Id)
+		test.Result(t, err, "move top entry up", idx)
+		idx, err = store.MoveUp(second.Id)
+		test.Result(t, err, "move second entry up", idx)
+		test.Compare(t, "second is first", second.Id, idx[0].Id)
+		idx, err = store.MoveDown(second.Id)
+		test.Result(t, err, "move it back down", idx)
+		idx, err = store.MoveDown(second.Id)
+		test.Result(t, err, "move bottom entry down", idx)
+		test.Compare(t, "second is last", second.Id, idx[1].Id)
+
+		idx, err = store.Delete(first.Id)
+		test.Result(t, err, "delete first entry", idx)
+		test.Compare(t, "deleted entry leaves the index", storage.Index{{Name: "Second", Id: second.Id}}, withoutTimes(idx))
+		_, err = store.Read(first.Id)
+		test.Compare(t, "read deleted entry", storage.ErrNoSuchEntry, err)
+
+		missing := uuid.New()
+		_, err = store.Read(missing)
+		test.Compare(t, "read missing entry", storage.ErrNoSuchEntry, err)
+		_, err = store.Update(storage.Entry{Id: missing})
+		test.Compare(t, "update missing entry", storage.ErrNoSuchEntry, err)
+		_, err = store.Rename(missing, "Nobody")
+		test.Compare(t, "rename missing entry", storage.ErrNoSuchEntry, err)
+		_, err = store.MoveUp(missing)
+		test.Compare(t, "move missing entry up", storage.ErrNoSuchEntry, err)
+		_, err = store.MoveDown(missing)
+		test.Compare(t, "move missing entry down", storage.ErrNoSuchEntry, err)
+		_, err = store.Delete(missing)
+		test.Compare(t, "delete missing entry", storage.ErrNoSuchEntry, err)
+
+		report, err := store.Check(false)
+		test.Result(t, err, "check store", report)
+		test.Compare(t, "store is clean", storage.CheckReport{Entries: 1}, report)
+	})
+}
+
+func TestConformanceBatch(t *testing.T) {
+	conformance(t, func(t *testing.T, store storage.Storage) {
+		created, idx, err := store.Batch(
+			storage.CreateOp{Name: "First", Text: "First text"},
+			storage.CreateOp{Name: "Second", Text: "Second text"},
+			storage.CreateOp{Name: "Third", Text: "Third text"},
+		)
+		test.Result(t, err, "batch create", len(created))
+		test.Compare(t, "three created", 3, len(created))
+
+		_, _, err = store.Batch(
+			storage.RenameOp{Id: created[0].Id, Name: "Never happened"},
+			storage.DeleteOp{Id: created[1].Id},
+			storage.UpdateOp{Entry: storage.Entry{Id: created[2].Id, Text: "Never written"}},
+			storage.RenameOp{Id: uuid.New(), Name: "No such entry"},
+		)
+		test.Compare(t, "batch with a bad op", storage.ErrNoSuchEntry, err)
+
+		unchanged, err := store.Index()
+		test.Result(t, err, "read index after failed batch", unchanged)
+		test.Compare(t, "failed batch changed nothing", idx, unchanged)
+		for _, entry := range created {
+			read, err := store.Read(entry.Id)
+			test.Result(t, err, "read entry after failed batch", read)
+			test.Compare(t, "entry is untouched", entry, read)
+		}
+		revisions, err := store.Revisions(created[2].Id)
+		test.Result(t, err, "list revisions after failed batch", len(revisions))
+		test.Compare(t, "failed batch kept no revision", 0, len(revisions))
+		results, err := store.Search("written")
+		test.Result(t, err, "search after failed batch", len(results))
+		test.Compare(t, "failed batch is not searchable", 0, len(results))
+	})
+}
+
+func TestConformanceTimestamps(t *testing.T) {
+	conformance(t, func(t *testing.T, store storage.Storage) {
+		entry, idx, err := store.Create("Timely", "Created")
+		test.Result(t, err, "create entry", entry, idx)
+		created := idx[0]
+		if created.Created.IsZero() || !created.Modified.Equal(created.Created) || !created.Opened.IsZero() {
+			t.Errorf("new entry has unexpected times: %+v", created)
+		}
+
+		entry.Text = "Modified"
+		idx, err = store.Update(entry)
+		test.Result(t, err, "update entry", idx)
+		if !idx[0].Created.Equal(created.Created) || !idx[0].Modified.After(created.Modified) {
+			t.Errorf("updated entry has unexpected times: %+v", idx[0])
+		}
+
+		peeked, err := store.Peek(entry.Id)
+		test.Result(t, err, "peek at entry")
+		test.Compare(t, "peeked at what was updated", entry, peeked)
+		idx, err = store.Index()
+		test.Result(t, err, "read index", idx)
+		test.Compare(t, "peeking doesn't count as opening", true, idx[0].Opened.IsZero())
+
+		_, err = store.Read(entry.Id)
+		test.Result(t, err, "read entry")
+		idx, err = store.Index()
+		test.Result(t, err, "read index", idx)
+		if idx[0].Opened.Before(idx[0].Modified) {
+			t.Errorf("read entry has unexpected times: %+v", idx[0])
+		}
+	})
+}
+
+func TestConformanceRevisions(t *testing.T) {
+	conformance(t, func(t *testing.T, store storage.Storage) {
+		settings, err := store.Settings()
+		test.Result(t, err, "read default settings", settings)
+		test.Compare(t, "default settings", storage.DefaultSettings(), settings)
+
+		settings.RevisionsKept = 2
+		test.Result(t, store.UpdateSettings(settings), "keep two revisions")
+		kept, err := store.Settings()
+		test.Result(t, err, "read updated settings", kept)
+		test.Compare(t, "settings are kept", settings, kept)
+
+		entry, _, err := store.Create("Revised", "First draft")
+		test.Result(t, err, "create entry", entry)
+		for _, text := range []string{"Second draft", "Third draft", "Third draft", "Final draft"} {
+			entry.Text = text
+			_, err = store.Update(entry)
+			test.Result(t, err, "update entry", text)
+		}
+
+		revisions, err := store.Revisions(entry.Id)
+		test.Result(t, err, "list revisions", len(revisions))
+		texts := []string{}
+		for _, revision := range revisions {
+			texts = append(texts, revision.Text)
+		}
+		test.Compare(t, "two newest revisions are kept, newest first", []string{"Third draft", "Second draft"}, texts)
+		test.Compare(t, "revisions know their entry", entry.Id, revisions[0].EntryId)
+
+		settings.RevisionsKept = 1
+		test.Result(t, store.UpdateSettings(settings), "keep one revision")
+		revisions, err = store.Revisions(entry.Id)
+		test.Result(t, err, "list revisions after pruning", len(revisions))
+		test.Compare(t, "one revision left", 1, len(revisions))
+
+		_, err = store.Delete(entry.Id)
+		test.Result(t, err, "delete entry")
+		revisions, err = store.Revisions(entry.Id)
+		test.Result(t, err, "list revisions of deleted entry", len(revisions))
+		test.Compare(t, "revisions are deleted with the entry", []storage.Revision{}, revisions)
+	})
+}
+
+func TestConformanceTrash(t *testing.T) {
+	conformance(t, func(t *testing.T, store storage.Storage) {
+		first, _, err := store.Create("First", "Keep me")
+		test.Result(t, err, "create first entry", first)
+		second, _, err := store.Create("Second", "Throw me out")
+		test.Result(t, err, "create second entry", second)
+		second.Text = "Throw me out, please"
+		_, err = store.Update(second)
+		test.Result(t, err, "update second entry")
+
+		idx, err := store.Trash(second.Id)
+		test.Result(t, err, "trash second entry", idx)
+		test.Compare(t, "trashed entry leaves the index", storage.Index{{Name: "First", Id: first.Id}}, withoutTimes(idx))
+		_, err = store.Read(second.Id)
+		test.Compare(t, "trashed entry can't be read", storage.ErrNoSuchEntry, err)
+		_, err = store.Trash(second.Id)
+		test.Compare(t, "trashing twice", storage.ErrNoSuchEntry, err)
+
+		trash, err := store.TrashBin()
+		test.Result(t, err, "list trash", len(trash))
+		test.Compare(t, "one entry in the trash", 1, len(trash))
+		test.Compare(t, "trash keeps the name", "Second", trash[0].Meta.Name)
+		test.Compare(t, "trash keeps the text", second.Text, trash[0].Text)
+		test.Compare(t, "trash knows when", false, trash[0].Deleted.IsZero())
+
+		idx, err = store.Restore(second.Id)
+		test.Result(t, err, "restore second entry", idx)
+		test.Compare(t, "restored entry is back at the end",
+			storage.Index{{Name: "First", Id: first.Id}, {Name: "Second", Id: second.Id}}, withoutTimes(idx))
+		restored, err := store.Read(second.Id)
+		test.Result(t, err, "read restored entry", restored)
+		test.Compare(t, "restored text", second, restored)
+		revisions, err := store.Revisions(second.Id)
+		test.Result(t, err, "list revisions of restored entry", len(revisions))
+		test.Compare(t, "revisions survive the trash", 1, len(revisions))
+		_, err = store.Restore(second.Id)
+		test.Compare(t, "restoring twice", storage.ErrNoSuchEntry, err)
+
+		_, err = store.Trash(first.Id)
+		test.Result(t, err, "trash first entry")
+		_, err = store.Trash(second.Id)
+		test.Result(t, err, "trash second entry again")
+		trash, err = store.TrashBin()
+		test.Result(t, err, "list trash again", len(trash))
+		test.Compare(t, "most recently deleted first", []uuid.UUID{second.Id, first.Id}, []uuid.UUID{trash[0].Meta.Id, trash[1].Meta.Id})
+
+		test.Result(t, store.Purge(second.Id), "purge second entry")
+		test.Compare(t, "purging twice", storage.ErrNoSuchEntry, store.Purge(second.Id))
+		revisions, err = store.Revisions(second.Id)
+		test.Result(t, err, "list revisions of purged entry", len(revisions))
+		test.Compare(t, "revisions are purged with the entry", 0, len(revisions))
+
+		test.Result(t, store.EmptyTrash(), "empty trash")
+		trash, err = store.TrashBin()
+		test.Result(t, err, "list emptied trash", len(trash))
+		test.Compare(t, "trash is empty", []storage.TrashedEntry{}, trash)
+
+		third, _, err := store.Create("Third", "Short lived")
+		test.Result(t, err, "create third entry", third)
+		_, err = store.Trash(third.Id)
+		test.Result(t, err, "trash third entry")
+		settings, err := store.Settings()
+		test.Result(t, err, "read settings", settings)
+		settings.TrashMaxAge = time.Nanosecond
+		test.Result(t, store.UpdateSettings(settings), "purge trash after a nanosecond")
+		trash, err = store.TrashBin()
+		test.Result(t, err, "list expired trash", len(trash))
+		test.Compare(t, "expired trash is purged", 0, len(trash))
+	})
+}
+
+func TestConformanceSetSort(t *testing.T) {
+	conformance(t, func(t *testing.T, store storage.Storage) {
+		settings, err := store.Settings()
+		test.Result(t, err, "read settings", settings)
+		settings.TrashMaxAge = 10 * time.Millisecond
+		test.Result(t, store.UpdateSettings(settings), "purge trash after ten milliseconds")
+		entry, _, err := store.Create("Overdue", "Left in the trash too long")
+		test.Result(t, err, "create entry", entry)
+		_, err = store.Trash(entry.Id)
+		test.Result(t, err, "trash entry")
+		time.Sleep(20 * time.Millisecond)
+
+		sort := storage.SortMode{Key: storage.SortName, Descending: true}
+		test.Result(t, store.SetSort(sort), "sort by name")
+		sorted, err := store.Settings()
+		test.Result(t, err, "read settings", sorted)
+		test.Compare(t, "sort is kept", sort, sorted.Sort)
+		test.Compare(t, "other settings are left alone", settings.TrashMaxAge, sorted.TrashMaxAge)
+		trash, err := store.TrashBin()
+		test.Result(t, err, "list trash", len(trash))
+		test.Compare(t, "sorting purges nothing", 1, len(trash))
+	})
+}
+
+func TestConformanceTagsAndPins(t *testing.T) {
+	conformance(t, func(t *testing.T, store storage.Storage) {
+		created, _, err := store.Batch(
+			storage.CreateOp{Name: "Work", Tags: []string{"work"}},
+			storage.CreateOp{Name: "Home"},
+		)
+		test.Result(t, err, "create entries", len(created))
+		work, home := created[0], created[1]
+
+		idx, err := store.Tag(work.Id, []string{" todo", "work", "", "todo"})
+		test.Result(t, err, "tag work entry", idx)
+		test.Compare(t, "tags are normalized", []string{"todo", "work"}, idx[0].Tags)
+		idx, err = store.Tag(home.Id, []string{"todo"})
+		test.Result(t, err, "tag home entry", idx)
+		test.Compare(t, "every tag in the index", []string{"todo", "work"}, idx.Tags())
+		idx, err = store.Tag(work.Id, nil)
+		test.Result(t, err, "untag work entry", idx)
+		test.Compare(t, "tags are removed", []string(nil), idx[0].Tags)
+
+		idx, err = store.Pin(home.Id, true)
+		test.Result(t, err, "pin home entry", idx)
+		test.Compare(t, "home is pinned", storage.Index{{Name: "Home", Id: home.Id, Tags: []string{"todo"}}}, withoutTimes(idx.Pinned()))
+		test.Compare(t, "pinning keeps the order", "Work", idx[0].Name)
+		idx, err = store.Pin(home.Id, false)
+		test.Result(t, err, "unpin home entry", idx)
+		test.Compare(t, "nothing is pinned", 0, len(idx.Pinned()))
+
+		_, err = store.Tag(uuid.New(), []string{"nope"})
+		test.Compare(t, "tag a missing entry", storage.ErrNoSuchEntry, err)
+		_, err = store.Pin(uuid.New(), true)
+		test.Compare(t, "pin a missing entry", storage.ErrNoSuchEntry, err)
+	})
+}
+
+func TestConformanceFolders(t *testing.T) {
+	conformance(t, func(t *testing.T, store storage.Storage) {
+		work, _, err := store.CreateFolder("Work", uuid.Nil)
+		test.Result(t, err, "create work folder", work)
+		projects, _, err := store.CreateFolder("Projects", work.Id)
+		test.Result(t, err, "create projects folder", projects)
+		_, _, err = store.CreateFolder("Nowhere", uuid.New())
+		test.Compare(t, "create folder in missing folder", storage.ErrNoSuchEntry, err)
+
+		created, idx, err := store.Batch(
+			storage.CreateOp{Name: "Loose"},
+			storage.CreateOp{Name: "Plan", Parent: projects.Id},
+			storage.CreateOp{Name: "Budget", Parent: projects.Id},
+		)
+		test.Result(t, err, "create entries in folders", len(created))
+		loose, plan, budget := created[0], created[1], created[2]
+		test.Compare(t, "inside projects", storage.Index{
+			{Name: "Plan", Id: plan.Id, Parent: projects.Id},
+			{Name: "Budget", Id: budget.Id, Parent: projects.Id},
+		}, withoutTimes(idx.Children(projects.Id)))
+
+		_, _, err = store.Batch(storage.CreateOp{Name: "Inside an entry", Parent: loose.Id})
+		test.Compare(t, "create inside an entry", storage.ErrNotAFolder, err)
+		_, err = store.Move(work.Id, projects.Id)
+		test.Compare(t, "move folder into itself", storage.ErrFolderLoop, err)
+		_, err = store.Move(loose.Id, plan.Id)
+		test.Compare(t, "move into an entry", storage.ErrNotAFolder, err)
+
+		idx, err = store.Move(loose.Id, projects.Id)
+		test.Result(t, err, "move loose entry into projects", idx)
+		test.Compare(t, "loose entry is last in projects", loose.Id, idx.Children(projects.Id)[2].Id)
+
+		_, err = store.Read(work.Id)
+		test.Compare(t, "folders can't be read", storage.ErrNoSuchEntry, err)
+		_, err = store.Update(storage.Entry{Id: work.Id, Text: "Folders have no text"})
+		test.Compare(t, "folders can't be written", storage.ErrNoSuchEntry, err)
+		_, err = store.Trash(projects.Id)
+		test.Compare(t, "trash folder with things in it", storage.ErrFolderNotEmpty, err)
+		_, err = store.Delete(projects.Id)
+		test.Compare(t, "delete folder with things in it", storage.ErrFolderNotEmpty, err)
+
+		_, err = store.Trash(plan.Id)
+		test.Result(t, err, "trash plan")
+		_, err = store.Delete(budget.Id)
+		test.Result(t, err, "delete budget")
+		_, err = store.Move(loose.Id, uuid.Nil)
+		test.Result(t, err, "move loose entry out")
+		idx, err = store.Trash(projects.Id)
+		test.Result(t, err, "trash empty folder", idx)
+		test.Compare(t, "only the work folder and the loose entry are left", storage.Index{
+			{Name: "Work", Id: work.Id, Folder: true},
+			{Name: "Loose", Id: loose.Id},
+		}, withoutTimes(idx))
+		trash, err := store.TrashBin()
+		test.Result(t, err, "list trash", len(trash))
+		test.Compare(t, "folders don't go in the trash", 1, len(trash))
+
+		idx, err = store.Restore(plan.Id)
+		test.Result(t, err, "restore plan", idx)
+		test.Compare(t, "plan is restored to the top level", storage.EntryMeta{Name: "Plan", Id: plan.Id}, withoutTimes(idx[len(idx)-1:])[0])
+
+		report, err := store.Check(false)
+		test.Result(t, err, "check store with folders", report)
+		test.Compare(t, "folders are not dangling", true, report.Clean())
+	})
+}
+
+func TestConformanceSearch(t *testing.T) {
+	conformance(t, func(t *testing.T, store storage.Storage) {
+		created, _, err := store.Batch(
+			storage.CreateOp{Name: "Groceries", Text: "Milk\nBread, butter and Cheese"},
+			storage.CreateOp{Name: "Recipe", Text: "Melt the butter, then add the bread"},
+			storage.CreateOp{Name: "Empty"},
+		)
+		test.Result(t, err, "create entries", len(created))
+		groceries, recipe := created[0], created[1]
+
+		names := func(results []storage.SearchResult) []string {
+			found := []string{}
+			for _, result := range results {
+				found = append(found, result.Meta.Name)
+			}
+			return found
+		}
+
+		results, err := store.Search("BUTTER")
+		test.Result(t, err, "search for a word", len(results))
+		test.Compare(t, "both have butter", []string{"Groceries", "Recipe"}, names(results))
+		test.Compare(t, "where the butter is", storage.SearchMatch{
+			Offset:  12,
+			Line:    1,
+			Column:  7,
+			Snippet: "Bread, butter and Cheese",
+			Start:   7,
+			End:     13,
+		}, results[0].Matches[0])
+
+		results, err = store.Search("butter melt")
+		test.Result(t, err, "search for two words", len(results))
+		test.Compare(t, "only the recipe has both", []string{"Recipe"}, names(results))
+
+		recipe.Text = "Toast the bread"
+		_, err = store.Update(recipe)
+		test.Result(t, err, "update recipe")
+		results, err = store.Search("butter")
+		test.Result(t, err, "search after update", len(results))
+		test.Compare(t, "recipe has no butter now", []string{"Groceries"}, names(results))
+
+		_, err = store.Trash(groceries.Id)
+		test.Result(t, err, "trash groceries")
+		results, err = store.Search("bread")
+		test.Result(t, err, "search after trashing", len(results))
+		test.Compare(t, "trash is not searched", []string{"Recipe"}, names(results))
+		_, err = store.Restore(groceries.Id)
+		test.Result(t, err, "restore groceries")
+		results, err = store.Search("bread")
+		test.Result(t, err, "search after restoring", len(results))
+		test.Compare(t, "restored entries are searched", []string{"Recipe", "Groceries"}, names(results))
+	})
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// nonWordChars is anything but ASCII letters, digits and underscores, including path separators of every kind.
+var nonWordChars = regexp.MustCompile(`[^\w]+`)
+
+// SafeName turns the name of an entry or folder into something that is safe to use as a file name.
+func SafeName(original string) string {
+	name := strings.ToLower(original)
+	name = nonWordChars.ReplaceAllString(name, "_")
+	name = strings.Trim(name, "_")
+	if name == "" {
+		return "untitled"
+	}
+	return name
+}
+
+// WriteFolder makes the directory, refusing if it exists, and writes what is in the folder to it, one file per note.
+// It returns how many notes it wrote.
+func WriteFolder(store Storage, idx Index, folder uuid.UUID, dirname string) (int, error) {
+	if err := os.Mkdir(dirname, 0700); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return 0, errors.New("directory exists, refusing to overwrite")
+		}
+		return 0, err
+	}
+	count := 0
+	taken := map[string]bool{}
+	for _, meta := range idx.Children(folder) {
+		name := SafeName(meta.Name)
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s_%d", SafeName(meta.Name), n)
+		}
+		taken[name] = true
+
+		if meta.Folder {
+			written, err := WriteFolder(store, idx, meta.Id, filepath.Join(dirname, name))
+			count += written
+			if err != nil {
+				return count, err
+			}
+			continue
+		}
+		entry, err := store.Read(meta.Id)
+		if err != nil {
+			return count, err
+		}
+		filename := filepath.Join(dirname, name+".txt")
+		if err := os.WriteFile(filename, []byte(entry.Text), 0600); err != nil {
+			return count, err
+		}
+		if err := os.Chtimes(filename, time.Time{}, meta.Modified); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,59 @@
+package storage_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DemmyDemon/hardnote/storage"
+	"github.com/DemmyDemon/hardnote/test"
+	"github.com/google/uuid"
+)
+
+func TestSafeName(t *testing.T) {
+	for _, name := range []struct {
+		original string
+		expected string
+	}{
+		{"Shopping list", "shopping_list"},
+		{"wow", "wow"},
+		{"../../etc/passwd", "etc_passwd"},
+		{`C:\Windows\win.ini`, "c_windows_win_ini"},
+		{"Smørbrød", "sm_rbr_d"},
+		{"***", "untitled"},
+		{"", "untitled"},
+	} {
+		test.Compare(t, "safe name of "+name.original, name.expected, storage.SafeName(name.original))
+	}
+}
+
+func TestWriteFolder(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	defer store.Close()
+	created, idx, err := store.Batch(
+		storage.CreateOp{Name: "Todo", Text: "First"},
+		storage.CreateOp{Name: "todo", Text: "Second"},
+		storage.CreateFolderOp{Name: "Work"},
+	)
+	test.Result(t, err, "create notes and folder", idx)
+	_, idx, err = store.Batch(storage.CreateOp{Name: "Plans", Text: "Third", Parent: created[2].Id})
+	test.Result(t, err, "create note in folder", idx)
+
+	dirname := filepath.Join(t.TempDir(), "export")
+	count, err := storage.WriteFolder(store, idx, uuid.Nil, dirname)
+	test.Result(t, err, "write folder", count)
+	test.Compare(t, "notes written", 3, count)
+	for filename, expected := range map[string]string{
+		"todo.txt":       "First",
+		"todo_2.txt":     "Second",
+		"work/plans.txt": "Third",
+	} {
+		text, err := os.ReadFile(filepath.Join(dirname, filepath.FromSlash(filename)))
+		test.Result(t, err, "read "+filename)
+		test.Compare(t, "text of "+filename, expected, string(text))
+	}
+
+	if _, err := storage.WriteFolder(store, idx, uuid.Nil, dirname); err == nil {
+		t.Error("expected writing to a directory that exists to be refused")
+	}
+}
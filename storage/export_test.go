@@ -0,0 +1,7 @@
+package storage
+
+// The test helpers, for the tests outside the package.
+var (
+	CheapKDF      = cheapKDF
+	OpenTestVault = openTestVault
+)
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"github.com/google/uuid"
+)
+
+// CreateFolderOp makes a new, empty folder at the end of the index.
+// The folder is part of the batch result as an entry without text, so its id is known.
+type CreateFolderOp struct {
+	Name   string
+	Parent uuid.UUID // uuid.Nil for the top level
+}
+
+// MoveToOp puts an entry or folder in another folder, last among what is already there.
+type MoveToOp struct {
+	Id     uuid.UUID
+	Parent uuid.UUID // uuid.Nil for the top level
+}
+
+func (op CreateFolderOp) apply(idx Index, target batchTarget) (Index, *Entry, error) {
+	if err := idx.checkParent(op.Parent); err != nil {
+		return idx, nil, err
+	}
+	id, err := uuid.NewV7()
+	if err != nil {
+		return idx, nil, err
+	}
+	now := timestamp()
+	idx = append(idx, EntryMeta{
+		Name:     op.Name,
+		Id:       id,
+		Created:  now,
+		Modified: now,
+		Parent:   op.Parent,
+		Folder:   true,
+	})
+	return idx, &Entry{Id: id}, nil
+}
+
+func (op MoveToOp) apply(idx Index, target batchTarget) (Index, *Entry, error) {
+	i := idx.position(op.Id)
+	if i < 0 {
+		return idx, nil, ErrNoSuchEntry
+	}
+	if err := idx.checkParent(op.Parent); err != nil {
+		return idx, nil, err
+	}
+	for _, ancestor := range idx.Path(op.Parent) {
+		if ancestor.Id == op.Id {
+			return idx, nil, ErrFolderLoop
+		}
+	}
+	meta := idx[i]
+	meta.Parent = op.Parent
+	idx = append(idx[:i], idx[i+1:]...)
+	return append(idx, meta), nil, nil
+}
+
+// checkParent makes sure the parent is a folder in the index, or the top level.
+func (idx Index) checkParent(parent uuid.UUID) error {
+	if parent == uuid.Nil {
+		return nil
+	}
+	i := idx.position(parent)
+	if i < 0 {
+		return ErrNoSuchEntry
+	}
+	if !idx[i].Folder {
+		return ErrNotAFolder
+	}
+	return nil
+}
+
+// Children lists what is directly in the folder, in order. Use uuid.Nil for the top level.
+func (idx Index) Children(parent uuid.UUID) Index {
+	children := Index{}
+	for _, meta := range idx {
+		if meta.Parent == parent {
+			children = append(children, meta)
+		}
+	}
+	return children
+}
+
+// Path lists the folders leading to the given one, from the top level down and including itself.
+// The top level itself has an empty path.
+func (idx Index) Path(id uuid.UUID) Index {
+	path := Index{}
+	for id != uuid.Nil && len(path) <= len(idx) { // The length check guards against loops in a damaged index
+		i := idx.position(id)
+		if i < 0 {
+			break
+		}
+		path = append(Index{idx[i]}, path...)
+		id = idx[i].Parent
+	}
+	return path
+}
+
+// sibling finds the nearest entry in the same folder as idx[i], in the given direction, or -1 if there is none.
+func (idx Index) sibling(i int, direction int) int {
+	for j := i + direction; j >= 0 && j < len(idx); j += direction {
+		if idx[j].Parent == idx[i].Parent {
+			return j
+		}
+	}
+	return -1
+}
+
+// hasChildren is true if anything is in the folder.
+func (idx Index) hasChildren(id uuid.UUID) bool {
+	for _, meta := range idx {
+		if meta.Parent == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package storage
+
+// Header is the unencrypted part of a vault, describing how to unlock the rest of it.
+type Header struct {
+	KDF   KDF       // How the key was derived from the passphrase, before vaults had key slots
+	Slots []KeySlot // Every way of unlocking the master key
+}
+
+// Format records which version of the on-disk layout a vault uses, and what produced it.
+// It is stored unencrypted next to the header, so a vault can be identified without the passphrase.
+type Format struct {
+	Version  int
+	Cipher   string
+	Encoding string
+}
+
+const (
+	formatCipher   = "AES-256-GCM"
+	formatEncoding = "gob"
+)
+
+// CurrentFormat is the layout this build of hardnote writes.
+func CurrentFormat() Format {
+	return Format{
+		Version:  FormatVersion,
+		Cipher:   formatCipher,
+		Encoding: formatEncoding,
+	}
+}
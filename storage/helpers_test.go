@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/DemmyDemon/hardnote/test"
+)
+
+// cheapKDF makes a KDF that costs next to nothing, as tests derive a lot of keys.
+func cheapKDF(t *testing.T) KDF {
+	t.Helper()
+	kdf, err := NewKDF(1, 1024, 1)
+	test.Result(t, err, "make cheap KDF", kdf)
+	return kdf
+}
+
+// openTestVault creates a vault with the backend and a cheap KDF, in a directory of its own.
+// The vault is closed when the test is over, in case the test stops before closing it.
+// The filename is for tests that reopen or damage the vault.
+func openTestVault(t *testing.T, backend Backend, passphrase []byte, opts ...Option) (Storage, string) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "hardnote.test")
+	opts = append([]Option{WithKDF(cheapKDF(t)), WithBackend(backend)}, opts...)
+	store, err := Open(filename, passphrase, opts...)
+	test.Result(t, err, "create vault", backend, filename)
+	t.Cleanup(func() {
+		store.Close() // Closing twice is harmless, and the test checks the first close itself
+	})
+	return store, filename
+}
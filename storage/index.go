@@ -3,14 +3,23 @@ package storage
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 type Index []EntryMeta
 type EntryMeta struct {
-	Name string
-	Id   uuid.UUID
+	Name     string
+	Id       uuid.UUID
+	Created  time.Time
+	Modified time.Time
+	Opened   time.Time // Zero if the entry was never read
+	Tags     []string  // Sorted, without duplicates
+	Parent   uuid.UUID // The folder this is in, or uuid.Nil for the top level
+	Folder   bool      // Folders have no entry of their own, only what has them as Parent
+	Size     int       // Length of the text in bytes
+	Pinned   bool      // Shown before everything else, and in the quick switcher
 }
 
 func (idx Index) String() string {
@@ -23,3 +32,28 @@ func (idx Index) String() string {
 	}
 	return sb.String()
 }
+
+// Pinned lists the pinned entries, in order.
+func (idx Index) Pinned() Index {
+	pinned := Index{}
+	for _, meta := range idx {
+		if meta.Pinned {
+			pinned = append(pinned, meta)
+		}
+	}
+	return pinned
+}
+
+// timestamp is the current time the way it reads back from storage, without a monotonic clock or local zone.
+func timestamp() time.Time {
+	return time.Now().UTC().Round(0)
+}
+
+// createdFromId is the creation time embedded in a UUIDv7, or the zero time for other kinds of UUID.
+func createdFromId(id uuid.UUID) time.Time {
+	if id.Version() != 7 {
+		return time.Time{}
+	}
+	sec, nsec := id.Time().UnixTime()
+	return time.Unix(sec, nsec).UTC()
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	KDFLegacySHA256 = "sha256"   // Unsalted single SHA-256, as used before vaults had a header
+	KDFArgon2id     = "argon2id" // Salted, memory-hard Argon2id
+
+	keySize     = 32 // AES-256
+	saltSize    = 32
+	keyfileSize = 64
+
+	defaultKDFTime    = 3
+	defaultKDFMemory  = 64 * 1024 // KiB
+	maxKDFTime        = 64
+	maxKDFThreads     = 4
+	calibrationRounds = 3
+)
+
+// KDF describes how a passphrase is turned into the key of a vault.
+// It is stored unencrypted in the vault header, as it is needed before anything can be decrypted.
+type KDF struct {
+	Algorithm string
+	Salt      []byte
+	Time      uint32
+	Memory    uint32 // KiB
+	Threads   uint8
+	Keyfile   bool // A keyfile is mixed in with the passphrase
+}
+
+// LegacyKDF is the key derivation used by vaults created before the vault header existed.
+var LegacyKDF = KDF{Algorithm: KDFLegacySHA256}
+
+// NewKDF returns Argon2id parameters with the given cost and a fresh random salt.
+func NewKDF(time uint32, memory uint32, threads uint8) (KDF, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return KDF{}, err
+	}
+	return KDF{
+		Algorithm: KDFArgon2id,
+		Salt:      salt,
+		Time:      time,
+		Memory:    memory,
+		Threads:   threads,
+	}, nil
+}
+
+// DefaultKDF returns reasonable Argon2id parameters with a fresh random salt, without calibrating.
+func DefaultKDF() (KDF, error) {
+	return NewKDF(defaultKDFTime, defaultKDFMemory, kdfThreads())
+}
+
+// CalibrateKDF raises the Argon2id time cost until deriving a key takes at least the target duration on this machine.
+func CalibrateKDF(target time.Duration) (KDF, error) {
+	kdf, err := NewKDF(1, defaultKDFMemory, kdfThreads())
+	if err != nil {
+		return kdf, err
+	}
+	passphrase := []byte("calibration")
+	for kdf.Time < maxKDFTime {
+		var slowest time.Duration
+		for i := 0; i < calibrationRounds; i++ {
+			start := time.Now()
+			if _, err := kdf.Derive(passphrase); err != nil {
+				return kdf, err
+			}
+			slowest = max(slowest, time.Since(start))
+		}
+		if slowest >= target {
+			break
+		}
+		kdf.Time++
+	}
+	return kdf, nil
+}
+
+func kdfThreads() uint8 {
+	return uint8(min(runtime.NumCPU(), maxKDFThreads))
+}
+
+// Derive turns the passphrase into a key suitable for NewCipher.
+func (k KDF) Derive(passphrase []byte) ([]byte, error) {
+	switch k.Algorithm {
+	case KDFLegacySHA256:
+		sum := sha256.Sum256(passphrase)
+		return sum[:], nil
+	case KDFArgon2id:
+		if len(k.Salt) == 0 || k.Time == 0 || k.Memory == 0 || k.Threads == 0 {
+			return nil, fmt.Errorf("%w: incomplete %s parameters", ErrInvalidStorage, k.Algorithm)
+		}
+		return argon2.IDKey(passphrase, k.Salt, k.Time, k.Memory, k.Threads, keySize), nil
+	}
+	return nil, fmt.Errorf("%w: unknown key derivation %q", ErrInvalidStorage, k.Algorithm)
+}
+
+// derive turns the passphrase and the keyfile into a key suitable for NewCipher.
+// The keyfile has to be given if the vault was created with one, and left out if it wasn't.
+// Nothing about the keyfile is stored, so a wrong one only shows as a wrong key.
+func (k KDF) derive(passphrase []byte, keyfile []byte) ([]byte, error) {
+	if err := k.checkKeyfile(keyfile); err != nil {
+		return nil, err
+	}
+	if keyfile == nil {
+		return k.Derive(passphrase)
+	}
+	mixed := hmac.New(sha256.New, keyfile)
+	mixed.Write(passphrase)
+	return k.Derive(mixed.Sum(nil))
+}
+
+// checkKeyfile makes sure a keyfile is given if the key derivation needs one, and only then.
+func (k KDF) checkKeyfile(keyfile []byte) error {
+	switch {
+	case k.Keyfile && keyfile == nil:
+		return ErrKeyfileNeeded
+	case !k.Keyfile && keyfile != nil:
+		return ErrNoKeyfile
+	}
+	return nil
+}
+
+// withKeyfile is the key derivation requiring a keyfile, or needing none if there is none.
+func (k KDF) withKeyfile(keyfile []byte) KDF {
+	k.Keyfile = keyfile != nil
+	return k
+}
+
+// NewKeyfile makes the contents of a new, random keyfile.
+func NewKeyfile() ([]byte, error) {
+	keyfile := make([]byte, keyfileSize)
+	if _, err := io.ReadFull(rand.Reader, keyfile); err != nil {
+		return nil, err
+	}
+	return keyfile, nil
+}
+
+func (k KDF) String() string {
+	if k.Algorithm == KDFLegacySHA256 {
+		return k.Algorithm
+	}
+	keyfile := ""
+	if k.Keyfile {
+		keyfile = " with keyfile"
+	}
+	return fmt.Sprintf("%s t=%d m=%dKiB p=%d%s", k.Algorithm, k.Time, k.Memory, k.Threads, keyfile)
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DemmyDemon/hardnote/test"
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// unsealEntry decrypts the entry as it is stored in the file, with nothing but the master key.
+func unsealEntry(backend Backend, filename string, id uuid.UUID, master []byte) error {
+	gcm, err := NewCipher(master)
+	if err != nil {
+		return err
+	}
+	if backend == BackendSealed {
+		raw, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		_, sealed, ad, err := splitSealed(raw)
+		if err != nil {
+			return err
+		}
+		_, err = unseal(gcm, sealed, ad)
+		return err
+	}
+	db, err := bolt.Open(filename, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		_, err := unseal(gcm, tx.Bucket(bucketKey).Get(id[:]), boltAD(id[:]))
+		return err
+	})
+}
+
+func TestRotatedMasterKey(t *testing.T) {
+	passphrase := []byte("Leaked some day")
+	for _, backend := range Backends {
+		t.Run(string(backend), func(t *testing.T) {
+			store, filename := openTestVault(t, backend, passphrase)
+			code, err := NewRecoveryCode()
+			test.Result(t, err, "make recovery code", code)
+			recovery, err := store.AddSlot(SlotRecovery, "", []byte(code), nil)
+			test.Result(t, err, "add recovery slot", recovery.Id)
+			oldSlots, err := store.Slots()
+			test.Result(t, err, "list slots", len(oldSlots))
+
+			test.Result(t, store.Rekey([]byte("Changed in time")), "rekey")
+			rekeyed, _, err := store.Create("After rekey", "Not for the old passphrase")
+			test.Result(t, err, "create entry", rekeyed.Id)
+			newSlots, err := store.Slots()
+			test.Result(t, err, "list slots", len(newSlots))
+			test.Result(t, store.RevokeSlot(recovery.Id), "revoke recovery slot")
+			revoked, _, err := store.Create("After revoke", "Not for the recovery code")
+			test.Result(t, err, "create entry", revoked.Id)
+			test.Result(t, store.Close(), "close vault")
+
+			old, err := options{}.unlockSlots(oldSlots, passphrase)
+			test.Result(t, err, "unlock the old header with the old passphrase")
+			if err := unsealEntry(backend, filename, rekeyed.Id, old.master); !errors.Is(err, ErrIntegrity) {
+				t.Fatalf("expected %v decrypting what was written after rekeying with the old master key, got %v", ErrIntegrity, err)
+			}
+			lost, err := options{}.unlockSlots(newSlots, []byte(code))
+			test.Result(t, err, "unlock the header before revoking with the recovery code")
+			if err := unsealEntry(backend, filename, revoked.Id, lost.master); !errors.Is(err, ErrIntegrity) {
+				t.Fatalf("expected %v decrypting what was written after revoking with the revoked master key, got %v", ErrIntegrity, err)
+			}
+
+			store, err = Open(filename, []byte("Changed in time"))
+			test.Result(t, err, "open with the new passphrase")
+			for _, entry := range []Entry{rekeyed, revoked} {
+				read, err := store.Read(entry.Id)
+				test.Result(t, err, "read entry", read.Text)
+				test.Compare(t, "entry text", entry.Text, read.Text)
+			}
+			test.Result(t, store.Close(), "close vault")
+		})
+	}
+}
+
+func TestUpgradedMasterKey(t *testing.T) {
+	passphrase := []byte("Older than slots")
+	for _, backend := range Backends {
+		t.Run(string(backend), func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "hardnote.test")
+			kdf := cheapKDF(t)
+			derived, err := kdf.derive(passphrase, nil)
+			test.Result(t, err, "derive key", len(derived))
+			gcm, err := NewCipher(derived)
+			test.Result(t, err, "instantiate cipher")
+			entry := Entry{Id: uuid.New(), Text: "From before key slots"}
+			meta := EntryMeta{Name: "Old", Id: entry.Id}
+
+			// Written the way a vault was right before key slots, encrypted with the key derived from the passphrase.
+			if backend == BackendSealed {
+				contents := newVaultContents()
+				contents.Index = Index{meta}
+				contents.Entries[entry.Id] = entry
+				old := &SealedStorage{filename: filename, header: Header{KDF: kdf}, cipher: gcm}
+				test.Result(t, old.write(contents), "write sealed vault without slots")
+			} else {
+				db, err := bolt.Open(filename, 0600, nil)
+				test.Result(t, err, "create bolt file")
+				err = db.Update(func(tx *bolt.Tx) error {
+					if err := writeHeader(tx, Header{KDF: kdf}); err != nil {
+						return err
+					}
+					if err := writeKeyCheck(tx, gcm); err != nil {
+						return err
+					}
+					bb, err := newBoltBatch(tx, gcm, DefaultSettings())
+					if err != nil {
+						return err
+					}
+					if err := bb.putEntry(entry); err != nil {
+						return err
+					}
+					if err := bb.putMeta(meta, 0); err != nil {
+						return err
+					}
+					format := CurrentFormat()
+					format.Version = keySlotsVersion - 1
+					return writeFormat(tx, format)
+				})
+				test.Result(t, err, "write bolt vault without slots")
+				test.Result(t, db.Close(), "close bolt file")
+			}
+
+			store, err := Open(filename, passphrase)
+			test.Result(t, err, "open and upgrade vault")
+			read, err := store.Read(entry.Id)
+			test.Result(t, err, "read entry", read.Text)
+			test.Compare(t, "entry text", entry.Text, read.Text)
+			test.Result(t, store.Close(), "close vault")
+
+			if err := unsealEntry(backend, filename, entry.Id, derived); !errors.Is(err, ErrIntegrity) {
+				t.Fatalf("expected %v decrypting the upgraded vault with the key derived from the passphrase, got %v", ErrIntegrity, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,488 @@
+package storage
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// vaultContents is everything in a vault, decrypted, as a single value.
+type vaultContents struct {
+	Index     Index
+	Entries   map[uuid.UUID]Entry
+	Revisions map[uuid.UUID][]Revision // Oldest first
+	Trash     map[uuid.UUID]TrashedEntry
+	Settings  Settings
+}
+
+func newVaultContents() vaultContents {
+	return vaultContents{
+		Index:     Index{},
+		Entries:   map[uuid.UUID]Entry{},
+		Revisions: map[uuid.UUID][]Revision{},
+		Trash:     map[uuid.UUID]TrashedEntry{},
+		Settings:  DefaultSettings(),
+	}
+}
+
+// clone copies the contents deep enough that changing the copy leaves the original alone.
+func (vc vaultContents) clone() vaultContents {
+	return vaultContents{
+		Index:     slices.Clone(vc.Index),
+		Entries:   maps.Clone(vc.Entries),
+		Revisions: maps.Clone(vc.Revisions), // The slices are replaced, never changed in place
+		Trash:     maps.Clone(vc.Trash),
+		Settings:  vc.Settings,
+	}
+}
+
+// MemoryStorage keeps a vault in memory only, unencrypted, and forgets all of it when closed.
+// It behaves like BoltStorage in every other way, which makes it handy for tests and for embedding.
+type MemoryStorage struct {
+	lock     sync.RWMutex
+	closed   bool
+	contents vaultContents
+	search   *searchIndex
+	save     func(contents vaultContents) error // If set, every change is only kept once this accepts it
+	unsaved  bool                               // Entries were opened since the last save, which waits for the next change or Close
+}
+
+func NewMemoryStorage() Storage {
+	return newMemoryStorage(newVaultContents(), nil)
+}
+
+func newMemoryStorage(contents vaultContents, save func(contents vaultContents) error) *MemoryStorage {
+	search := newSearchIndex()
+	for _, meta := range contents.Index {
+		if entry, ok := contents.Entries[meta.Id]; ok {
+			search.put(entry.Id, entry.Text)
+		}
+	}
+	return &MemoryStorage{
+		contents: contents,
+		search:   search,
+		save:     save,
+	}
+}
+
+// memoryBatch works on a copy of the contents of a MemoryStorage, which replaces the original only if every op succeeds.
+type memoryBatch struct {
+	vaultContents
+	written map[uuid.UUID]*Entry // Entries put or deleted (nil) in the batch, for keeping the search index in step
+}
+
+func (m *MemoryStorage) newBatch() memoryBatch {
+	return memoryBatch{
+		vaultContents: m.contents.clone(),
+		written:       map[uuid.UUID]*Entry{},
+	}
+}
+
+// commit makes the batch the contents of the storage, as long as it can be saved.
+func (m *MemoryStorage) commit(mb memoryBatch) error {
+	if m.save != nil {
+		if err := m.save(mb.vaultContents); err != nil {
+			return err
+		}
+	}
+	m.contents = mb.vaultContents
+	m.unsaved = false
+	for id, entry := range mb.written {
+		if entry == nil {
+			m.search.remove(id)
+		} else {
+			m.search.put(id, entry.Text)
+		}
+	}
+	return nil
+}
+
+func (mb memoryBatch) getEntry(id uuid.UUID) (Entry, error) {
+	entry, ok := mb.Entries[id]
+	if !ok {
+		return entry, ErrNoSuchEntry
+	}
+	return entry, nil
+}
+
+func (mb memoryBatch) putEntry(entry Entry) error {
+	mb.Entries[entry.Id] = entry
+	mb.written[entry.Id] = &entry
+	return nil
+}
+
+func (mb memoryBatch) deleteEntry(id uuid.UUID) error {
+	delete(mb.Revisions, id)
+	delete(mb.Entries, id)
+	mb.written[id] = nil
+	return nil
+}
+
+func (mb memoryBatch) keepRevision(revision Revision) error {
+	mb.Revisions[revision.EntryId] = append(slices.Clone(mb.Revisions[revision.EntryId]), revision)
+	mb.pruneRevisions(revision.EntryId)
+	return nil
+}
+
+// pruneRevisions forgets the revisions of an entry that are past the retention settings.
+func (mb memoryBatch) pruneRevisions(entryId uuid.UUID) {
+	revisions := mb.Revisions[entryId]
+	revisions = revisions[len(mb.Settings.expired(revisions, timestamp())):]
+	if len(revisions) == 0 {
+		delete(mb.Revisions, entryId)
+		return
+	}
+	mb.Revisions[entryId] = revisions
+}
+
+func (mb memoryBatch) trashEntry(meta EntryMeta, deleted time.Time) error {
+	entry, err := mb.getEntry(meta.Id)
+	if err != nil {
+		return err
+	}
+	mb.Trash[meta.Id] = TrashedEntry{Meta: meta, Text: entry.Text, Deleted: deleted}
+	delete(mb.Entries, meta.Id) // The revisions stay, in case it is restored
+	mb.written[meta.Id] = nil
+	return nil
+}
+
+func (mb memoryBatch) restoreEntry(id uuid.UUID) (EntryMeta, error) {
+	trashed, ok := mb.Trash[id]
+	if !ok {
+		return trashed.Meta, ErrNoSuchEntry
+	}
+	if err := mb.putEntry(Entry{Id: id, Text: trashed.Text}); err != nil {
+		return trashed.Meta, err
+	}
+	delete(mb.Trash, id)
+	trashed.Meta.Size = len(trashed.Text)
+	return trashed.Meta, nil
+}
+
+func (mb memoryBatch) purgeEntry(id uuid.UUID) error {
+	if _, ok := mb.Trash[id]; !ok {
+		return ErrNoSuchEntry
+	}
+	delete(mb.Revisions, id)
+	delete(mb.Trash, id)
+	return nil
+}
+
+// purgeExpiredTrash purges the entries that have been in the trash for longer than the settings allow.
+func (mb memoryBatch) purgeExpiredTrash(now time.Time) {
+	for id, trashed := range mb.Trash {
+		if mb.Settings.trashExpired(trashed, now) {
+			delete(mb.Revisions, id)
+			delete(mb.Trash, id)
+		}
+	}
+}
+
+// Rekey has no passphrase to change, as nothing is encrypted.
+func (m *MemoryStorage) Rekey(keyText []byte) error {
+	return fmt.Errorf("%w: passphrases in memory", ErrNotImplemented)
+}
+
+// Slots has no key slots to list, as there is nothing to unlock.
+func (m *MemoryStorage) Slots() ([]KeySlot, error) {
+	return nil, fmt.Errorf("%w: key slots in memory", ErrNotImplemented)
+}
+
+// AddSlot has nowhere to put a key slot.
+func (m *MemoryStorage) AddSlot(kind SlotKind, label string, secret []byte, keyfile []byte) (KeySlot, error) {
+	return KeySlot{}, fmt.Errorf("%w: key slots in memory", ErrNotImplemented)
+}
+
+// RevokeSlot has no key slots to revoke.
+func (m *MemoryStorage) RevokeSlot(id uuid.UUID) error {
+	return fmt.Errorf("%w: key slots in memory", ErrNotImplemented)
+}
+
+// Close saves when entries were opened since the last change, and forgets everything in the storage.
+func (m *MemoryStorage) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var err error
+	if m.unsaved && m.save != nil {
+		err = m.save(m.contents)
+	}
+	m.closed = true
+	m.unsaved = false
+	m.contents = newVaultContents()
+	m.search = newSearchIndex()
+	return err
+}
+
+// Check can't find anything wrong, as nothing is ever stored half way, but it counts the entries like BoltStorage does.
+func (m *MemoryStorage) Check(repair bool) (CheckReport, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return CheckReport{}, ErrAlreadyClosed
+	}
+	return CheckReport{Entries: len(m.contents.Entries)}, nil
+}
+
+func (m *MemoryStorage) Index() (Index, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return slices.Clone(m.contents.Index), nil
+}
+
+// Batch applies all the ops to copies of everything, and keeps the copies only if all of them succeed.
+// It returns the entries made by any CreateOp, in order, and the resulting index.
+func (m *MemoryStorage) Batch(ops ...Op) ([]Entry, Index, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil, nil, ErrAlreadyClosed
+	}
+	mb := m.newBatch()
+	created, idx, err := applyOps(mb.Index, mb, ops)
+	if err != nil {
+		return nil, nil, err
+	}
+	mb.Index = idx
+	if err := m.commit(mb); err != nil {
+		return nil, nil, err
+	}
+	return created, slices.Clone(idx), nil
+}
+
+func (m *MemoryStorage) Rename(id uuid.UUID, newName string) (Index, error) {
+	_, idx, err := m.Batch(RenameOp{Id: id, Name: newName})
+	return idx, err
+}
+
+func (m *MemoryStorage) MoveUp(id uuid.UUID) (Index, error) {
+	_, idx, err := m.Batch(MoveUpOp{Id: id})
+	return idx, err
+}
+
+func (m *MemoryStorage) MoveDown(id uuid.UUID) (Index, error) {
+	_, idx, err := m.Batch(MoveDownOp{Id: id})
+	return idx, err
+}
+
+func (m *MemoryStorage) Tag(id uuid.UUID, tags []string) (Index, error) {
+	_, idx, err := m.Batch(TagOp{Id: id, Tags: tags})
+	return idx, err
+}
+
+func (m *MemoryStorage) Pin(id uuid.UUID, pinned bool) (Index, error) {
+	_, idx, err := m.Batch(PinOp{Id: id, Pinned: pinned})
+	return idx, err
+}
+
+// CreateFolder makes a new folder, last in the parent folder.
+func (m *MemoryStorage) CreateFolder(name string, parent uuid.UUID) (EntryMeta, Index, error) {
+	created, idx, err := m.Batch(CreateFolderOp{Name: name, Parent: parent})
+	if err != nil {
+		return EntryMeta{}, idx, err
+	}
+	return idx[idx.position(created[0].Id)], idx, nil
+}
+
+// Move puts the entry or folder last in the parent folder.
+func (m *MemoryStorage) Move(id uuid.UUID, parent uuid.UUID) (Index, error) {
+	_, idx, err := m.Batch(MoveToOp{Id: id, Parent: parent})
+	return idx, err
+}
+
+func (m *MemoryStorage) Create(name, initialText string) (Entry, Index, error) {
+	created, idx, err := m.Batch(CreateOp{Name: name, Text: initialText})
+	if err != nil {
+		return Entry{Text: initialText}, idx, err
+	}
+	return created[0], idx, nil
+}
+
+// Read returns the entry, and marks it as opened. That alone is not worth saving for,
+// so it is saved along with the next change, or when closing.
+func (m *MemoryStorage) Read(id uuid.UUID) (Entry, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return Entry{}, ErrAlreadyClosed
+	}
+	entry, ok := m.contents.Entries[id]
+	if !ok {
+		return Entry{}, ErrNoSuchEntry
+	}
+	i := m.contents.Index.position(id)
+	if i < 0 {
+		return entry, nil // Orphans can be read, but have no meta to mark
+	}
+	m.contents.Index[i].Opened = timestamp()
+	m.unsaved = true
+	return entry, nil
+}
+
+// Peek returns the entry without marking it as opened, for looking at it rather than opening it.
+func (m *MemoryStorage) Peek(id uuid.UUID) (Entry, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return Entry{}, ErrAlreadyClosed
+	}
+	entry, ok := m.contents.Entries[id]
+	if !ok {
+		return Entry{}, ErrNoSuchEntry
+	}
+	return entry, nil
+}
+
+// Update writes the entry, and marks it as modified.
+func (m *MemoryStorage) Update(entry Entry) (Index, error) {
+	_, idx, err := m.Batch(UpdateOp{Entry: entry})
+	return idx, err
+}
+
+// Delete removes the entry for ever. Use Trash for something that can be undone.
+func (m *MemoryStorage) Delete(id uuid.UUID) (Index, error) {
+	_, idx, err := m.Batch(DeleteOp{Id: id})
+	return idx, err
+}
+
+// Trash moves the entry out of the index and into the trash, where it can be restored from.
+func (m *MemoryStorage) Trash(id uuid.UUID) (Index, error) {
+	_, idx, err := m.Batch(TrashOp{Id: id})
+	return idx, err
+}
+
+// TrashBin lists what is in the trash, most recently deleted first.
+func (m *MemoryStorage) TrashBin() ([]TrashedEntry, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrAlreadyClosed
+	}
+	trash := make([]TrashedEntry, 0, len(m.contents.Trash))
+	for _, trashed := range m.contents.Trash {
+		trash = append(trash, trashed)
+	}
+	slices.SortFunc(trash, func(a, b TrashedEntry) int {
+		return b.Deleted.Compare(a.Deleted)
+	})
+	return trash, nil
+}
+
+// Restore puts a trashed entry back, at the end of the index.
+func (m *MemoryStorage) Restore(id uuid.UUID) (Index, error) {
+	_, idx, err := m.Batch(RestoreOp{Id: id})
+	return idx, err
+}
+
+// Purge removes an entry from the trash for ever.
+func (m *MemoryStorage) Purge(id uuid.UUID) error {
+	_, _, err := m.Batch(PurgeOp{Id: id})
+	return err
+}
+
+// EmptyTrash purges everything in the trash, all at once.
+func (m *MemoryStorage) EmptyTrash() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return ErrAlreadyClosed
+	}
+	mb := m.newBatch()
+	for id := range mb.Trash {
+		delete(mb.Revisions, id)
+	}
+	mb.Trash = map[uuid.UUID]TrashedEntry{}
+	return m.commit(mb)
+}
+
+// Search finds the entries that have words starting with every word of the query, in index order.
+func (m *MemoryStorage) Search(query string) ([]SearchResult, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrAlreadyClosed
+	}
+	return m.search.search(m.contents.Index, query), nil
+}
+
+// Revisions lists the earlier texts of an entry, newest first.
+func (m *MemoryStorage) Revisions(id uuid.UUID) ([]Revision, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrAlreadyClosed
+	}
+	revisions := slices.Clone(m.contents.Revisions[id])
+	if revisions == nil {
+		revisions = []Revision{}
+	}
+	slices.Reverse(revisions)
+	return revisions, nil
+}
+
+func (m *MemoryStorage) Settings() (Settings, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.contents.Settings, nil
+}
+
+// UpdateSettings keeps the settings, and right away forgets any revisions and purges any trash past the new limits.
+func (m *MemoryStorage) UpdateSettings(settings Settings) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return ErrAlreadyClosed
+	}
+	mb := m.newBatch()
+	mb.Settings = settings
+	for _, meta := range mb.Index {
+		mb.pruneRevisions(meta.Id)
+	}
+	mb.purgeExpiredTrash(timestamp())
+	return m.commit(mb)
+}
+
+// SetSort keeps how the listing is sorted, leaving the rest of the settings, and what they keep, alone.
+func (m *MemoryStorage) SetSort(sort SortMode) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return ErrAlreadyClosed
+	}
+	mb := m.newBatch()
+	mb.Settings.Sort = sort
+	return m.commit(mb)
+}
+
+func (m *MemoryStorage) dump() (vaultContents, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return vaultContents{}, ErrAlreadyClosed
+	}
+	return m.contents.clone(), nil
+}
+
+// load takes the contents of another vault, if nothing has been put in this one yet.
+func (m *MemoryStorage) load(contents vaultContents) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return ErrAlreadyClosed
+	}
+	if len(m.contents.Index) > 0 || len(m.contents.Entries) > 0 || len(m.contents.Trash) > 0 {
+		return fmt.Errorf("%w: only an empty vault can be loaded into", ErrInvalidStorage)
+	}
+	mb := memoryBatch{
+		vaultContents: contents.clone(),
+		written:       map[uuid.UUID]*Entry{},
+	}
+	mb.fill()
+	for id, entry := range mb.Entries {
+		mb.written[id] = &entry
+	}
+	return m.commit(mb)
+}
@@ -0,0 +1,21 @@
+package storage_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DemmyDemon/hardnote/storage"
+	"github.com/DemmyDemon/hardnote/test"
+)
+
+func TestMemoryRefusals(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	if err := store.Rekey([]byte("Nothing to lock")); !errors.Is(err, storage.ErrNotImplemented) {
+		t.Errorf("expected rekeying memory to be refused as not implemented, got %v", err)
+	}
+
+	test.Result(t, store.Close(), "close store")
+	if _, err := store.Search("anything"); !errors.Is(err, storage.ErrAlreadyClosed) {
+		t.Errorf("expected searching a closed store to fail with ErrAlreadyClosed, got %v", err)
+	}
+}
@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A migration upgrades a vault from one format version to the next, inside the transaction that opens it.
+type migration struct {
+	description string
+	apply       func(tx *bolt.Tx, vault *unlockedVault) error
+}
+
+// migrations is the registry of upgrades, where migrations[n] takes a vault from version n to n+1.
+// Append to it when changing the on-disk format, never reorder or remove entries.
+// A format change with nothing to upgrade still gets a version, so builds from before it refuse
+// the vault instead of quietly losing what they don't know about.
+var migrations = []migration{
+	// 1: A header with a salted Argon2id KDF, instead of an unsalted SHA-256 of the passphrase.
+	{"salted key derivation", migrateLegacyKDF},
+	// 2: The format record itself. Version 1 vaults are told apart by having a header.
+	{"format record", migrateNothing},
+	// 3: Every value is bound to its key and record kind with associated data.
+	{"associated data", migrateAssociatedData},
+	// 4: A key check record, telling a wrong key apart from damaged data.
+	{"key check", migrateKeyCheck},
+	// 5: One meta record per entry, with an order key, instead of a single index record.
+	{"per-entry meta records", migrateMetaRecords},
+	// 6: Created, modified and opened times in the meta records.
+	{"timestamps", migrateTimestamps},
+	// 7: The revisions and settings buckets. Version 6 builds would rekey the vault without them.
+	{"revisions and settings", migrateNothing},
+	// 8: The trash bucket. Version 7 builds would rekey the vault without it.
+	{"trash", migrateNothing},
+	// 9: Tags in the meta records. Version 8 builds would drop them whenever they rewrote a meta record.
+	{"tags", migrateNothing},
+	// 10: Folders, as meta records without an entry. Version 9 builds would repair them away as dangling.
+	{"folders", migrateNothing},
+	// 11: The size of every entry in its meta record, for sorting by size.
+	{"sizes", migrateSizes},
+	// 12: Pins in the meta records. Version 11 builds would drop them whenever they rewrote a meta record.
+	{"pins", migrateNothing},
+	// 13: Key slots wrapping a random master key, instead of the key derived from the passphrase.
+	{"key slots", migrateKeySlots},
+	// 14: The default trash age in settings saved before the trash existed, which version 8 forgot to give them.
+	{"trash settings", migrateTrashSettings},
+}
+
+// keySlotsVersion is the first format version where every vault has key slots.
+// Getting there takes the passphrase, as it makes the first slot.
+const keySlotsVersion = 13
+
+// keyCheckVersion is the first format version where every vault has a key check record.
+const keyCheckVersion = 4
+
+// FormatVersion is the newest vault format this build understands, and the one it writes.
+var FormatVersion = len(migrations)
+
+// unlockedVault carries what migrations need to read and rewrite a vault.
+type unlockedVault struct {
+	keyText []byte
+	options options
+	header  Header
+	keys    unlocked
+	cipher  cipher.AEAD
+}
+
+// detectVersion works out the format of a vault, including those from before the format record existed.
+// A vault with nothing in it at all is reported as not found.
+func detectVersion(tx *bolt.Tx) (int, bool, error) {
+	format, found, err := readFormat(tx)
+	if err != nil {
+		return 0, false, err
+	}
+	if found {
+		return format.Version, true, nil
+	}
+	_, found, err = readHeader(tx)
+	if err != nil {
+		return 0, false, err
+	}
+	if found {
+		return 1, true, nil
+	}
+	bucket := tx.Bucket(bucketKey)
+	if bucket != nil && bucket.Get(indexKey) != nil {
+		return 0, true, nil
+	}
+	return 0, false, nil
+}
+
+// openVault unlocks the vault in the transaction, creating it if it is empty and upgrading it if it is old.
+func openVault(tx *bolt.Tx, keyText []byte, options options) (*unlockedVault, error) {
+	vault := &unlockedVault{
+		keyText: keyText,
+		options: options,
+	}
+
+	version, found, err := detectVersion(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		if options.derivedKey != nil {
+			return nil, ErrNeedPassphrase
+		}
+		kdf, err := options.newKDF()
+		if err != nil {
+			return nil, err
+		}
+		vault.keys, vault.header.Slots, err = options.newSlots(kdf, keyText)
+		if err != nil {
+			return nil, err
+		}
+		vault.cipher, err = NewCipher(vault.keys.master)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeHeader(tx, vault.header); err != nil {
+			return nil, err
+		}
+		if err := writeKeyCheck(tx, vault.cipher); err != nil {
+			return nil, err
+		}
+		return vault, writeFormat(tx, CurrentFormat())
+	}
+
+	if version > FormatVersion {
+		return nil, fmt.Errorf("%w: vault is format version %d, but this hardnote only understands up to %d", ErrVaultTooNew, version, FormatVersion)
+	}
+
+	if version < keySlotsVersion && options.derivedKey != nil {
+		return nil, ErrNeedPassphrase // Derived keys are for key slots, and making the first one takes the passphrase
+	}
+	if version > 0 {
+		vault.header, _, err = readHeader(tx)
+		if err != nil {
+			return nil, err
+		}
+		if len(vault.header.Slots) > 0 {
+			vault.keys, err = options.unlockSlots(vault.header.Slots, keyText)
+		} else {
+			vault.keys.master, err = vault.header.KDF.derive(keyText, options.keyfile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		vault.cipher, err = NewCipher(vault.keys.master)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	verified, err := verifyKeyCheck(tx, vault.cipher)
+	if err != nil {
+		return nil, err
+	}
+	if !verified && version >= keyCheckVersion {
+		return nil, fmt.Errorf("%w: key check record is missing", ErrInvalidStorage)
+	}
+
+	if version == FormatVersion {
+		return vault, nil
+	}
+
+	for v := version; v < FormatVersion; v++ {
+		if err := migrations[v].apply(tx, vault); err != nil {
+			if !verified && errors.Is(err, ErrIntegrity) {
+				// Without a key check, a wrong key looks just like damaged data. It is far more likely to be the key.
+				return nil, fmt.Errorf("%w (or the vault is damaged): %v", ErrInvalidKey, err)
+			}
+			return nil, fmt.Errorf("migrating vault from version %d (%s): %w", v, migrations[v].description, err)
+		}
+	}
+	return vault, writeFormat(tx, CurrentFormat())
+}
+
+// migrateNothing is for format changes that only need the format record to be rewritten.
+func migrateNothing(tx *bolt.Tx, vault *unlockedVault) error {
+	return nil
+}
+
+// migrateLegacyKDF re-encrypts every value of a vault from before the header existed.
+// Such vaults used an unsalted SHA-256 of the passphrase as the key.
+func migrateLegacyKDF(tx *bolt.Tx, vault *unlockedVault) error {
+	var err error
+	vault.header.KDF, err = vault.options.newKDF()
+	if err != nil {
+		return err
+	}
+	vault.keys.master, err = vault.header.KDF.derive(vault.keyText, vault.options.keyfile)
+	if err != nil {
+		return err
+	}
+	vault.cipher, err = NewCipher(vault.keys.master)
+	if err != nil {
+		return err
+	}
+	legacy, err := NewGCM(vault.keyText)
+	if err != nil {
+		return err
+	}
+	bucket := tx.Bucket(bucketKey)
+	if err := reseal(bucket, legacy, noAD, vault.cipher, noAD); err != nil {
+		return err
+	}
+	return writeHeader(tx, vault.header)
+}
+
+// migrateAssociatedData binds every value to its key, as they were sealed without associated data before.
+func migrateAssociatedData(tx *bolt.Tx, vault *unlockedVault) error {
+	bucket := tx.Bucket(bucketKey)
+	if bucket == nil {
+		return nil
+	}
+	return reseal(bucket, vault.cipher, noAD, vault.cipher, boltAD)
+}
+
+// migrateKeyCheck adds the record that tells a wrong key apart from damaged data.
+// The key is proven right by reading the index before the record is written, or the vault would be locked out for good.
+func migrateKeyCheck(tx *bolt.Tx, vault *unlockedVault) error {
+	bucket := tx.Bucket(bucketKey)
+	if bucket != nil {
+		if raw := bucket.Get(indexKey); raw != nil {
+			if _, err := unseal(vault.cipher, raw, boltAD(indexKey)); err != nil {
+				return err
+			}
+		}
+	}
+	return writeKeyCheck(tx, vault.cipher)
+}
+
+// migrateMetaRecords splits the single index record into one meta record per entry.
+func migrateMetaRecords(tx *bolt.Tx, vault *unlockedVault) error {
+	bb, err := newBoltBatch(tx, vault.cipher, DefaultSettings())
+	if err != nil {
+		return err
+	}
+	raw := bb.entries.Get(indexKey)
+	if raw == nil {
+		return nil
+	}
+	idx := Index{}
+	if err := Soften(vault.cipher, raw, &idx, boltAD(indexKey)); err != nil {
+		return err
+	}
+	orders, _ := renumberOrder(idx)
+	for _, meta := range idx {
+		if err := bb.putMeta(meta, orders[meta.Id]); err != nil {
+			return err
+		}
+	}
+	return bb.entries.Delete(indexKey)
+}
+
+// migrateTimestamps gives entries from before timestamps were kept a creation time, taken from their UUIDv7.
+// They are considered modified at the same time, and never opened.
+func migrateTimestamps(tx *bolt.Tx, vault *unlockedVault) error {
+	bb, err := newBoltBatch(tx, vault.cipher, DefaultSettings())
+	if err != nil {
+		return err
+	}
+	idx, orders, err := bb.loadIndex()
+	if err != nil {
+		return err
+	}
+	for _, meta := range idx {
+		if !meta.Created.IsZero() {
+			continue
+		}
+		meta.Created = createdFromId(meta.Id)
+		meta.Modified = meta.Created
+		if err := bb.putMeta(meta, orders[meta.Id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateTrashSettings gives settings saved before the trash existed the default trash age.
+// They decode with no age at all, which would keep trashed entries forever. Settings saved since then
+// with the age set to never purge look just the same, so those get the default as well.
+func migrateTrashSettings(tx *bolt.Tx, vault *unlockedVault) error {
+	if bucket := tx.Bucket(settingsKey); bucket == nil || bucket.Get(settingsKey) == nil {
+		return nil
+	}
+	bb, err := newBoltBatch(tx, vault.cipher, DefaultSettings())
+	if err != nil {
+		return err
+	}
+	settings, err := bb.loadSettings()
+	if err != nil {
+		return err
+	}
+	if settings.TrashMaxAge != 0 {
+		return nil
+	}
+	settings.TrashMaxAge = defaultTrashMaxAge
+	return bb.saveSettings(settings)
+}
+
+// migrateSizes records the size of every entry in its meta record, so the listing can be sorted by size.
+// Entries that can't be read are left for Check to find.
+func migrateSizes(tx *bolt.Tx, vault *unlockedVault) error {
+	bb, err := newBoltBatch(tx, vault.cipher, DefaultSettings())
+	if err != nil {
+		return err
+	}
+	idx, orders, err := bb.loadIndex()
+	if err != nil {
+		return err
+	}
+	for _, meta := range idx {
+		if meta.Folder {
+			continue
+		}
+		entry, err := bb.getEntry(meta.Id)
+		if err != nil {
+			continue
+		}
+		meta.Size = len(entry.Text)
+		if err := bb.putMeta(meta, orders[meta.Id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateKeySlots puts the vault under a random master key, with a passphrase slot to open it,
+// so more ways of unlocking the vault can be added. Everything is encrypted anew, as the key derived
+// from the passphrase would otherwise stay the key of the vault, whatever slots are added or revoked.
+func migrateKeySlots(tx *bolt.Tx, vault *unlockedVault) error {
+	kdf, err := NewKDF(vault.header.KDF.Time, vault.header.KDF.Memory, vault.header.KDF.Threads)
+	if err != nil {
+		return err
+	}
+	keys, slots, err := vault.options.newSlots(kdf, vault.keyText)
+	if err != nil {
+		return err
+	}
+	gcm, err := NewCipher(keys.master)
+	if err != nil {
+		return err
+	}
+	if err := resealVault(tx, vault.cipher, gcm); err != nil {
+		return err
+	}
+	vault.keys, vault.cipher = keys, gcm
+	vault.header = Header{Slots: slots}
+	return writeHeader(tx, vault.header)
+}
@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/DemmyDemon/hardnote/test"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestTrashSettingsUpgrade(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "hardnote.test")
+	passphrase := []byte("Kept before the trash")
+	kdf := cheapKDF(t)
+	derived, err := kdf.derive(passphrase, nil)
+	test.Result(t, err, "derive key", len(derived))
+	gcm, err := NewCipher(derived)
+	test.Result(t, err, "instantiate cipher")
+
+	// Written the way a vault was right before the trash, with settings that have no trash age.
+	db, err := bolt.Open(filename, 0600, nil)
+	test.Result(t, err, "create bolt file")
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := writeHeader(tx, Header{KDF: kdf}); err != nil {
+			return err
+		}
+		if err := writeKeyCheck(tx, gcm); err != nil {
+			return err
+		}
+		bb, err := newBoltBatch(tx, gcm, DefaultSettings())
+		if err != nil {
+			return err
+		}
+		if err := bb.saveSettings(Settings{RevisionsKept: 5}); err != nil {
+			return err
+		}
+		format := CurrentFormat()
+		format.Version = 7
+		return writeFormat(tx, format)
+	})
+	test.Result(t, err, "write bolt vault from before the trash")
+	test.Result(t, db.Close(), "close bolt file")
+
+	store, err := Open(filename, passphrase)
+	test.Result(t, err, "open and upgrade vault")
+	settings, err := store.Settings()
+	test.Result(t, err, "read settings", settings)
+	test.Compare(t, "changed settings are kept", 5, settings.RevisionsKept)
+	test.Compare(t, "trash age is the default", defaultTrashMaxAge, settings.TrashMaxAge)
+	test.Result(t, store.Close(), "close vault")
+}
+
+func TestTrashSettingsUpgradeWithKeySlots(t *testing.T) {
+	passphrase := []byte("Kept after the key slots")
+	store, filename := openTestVault(t, BackendBolt, passphrase)
+	test.Result(t, store.UpdateSettings(Settings{RevisionsKept: 5}), "save settings with no trash age")
+	test.Result(t, store.Close(), "close vault")
+
+	// Version 13 builds upgraded vaults past the trash without giving their settings a trash age.
+	db, err := bolt.Open(filename, 0600, nil)
+	test.Result(t, err, "open bolt file")
+	err = db.Update(func(tx *bolt.Tx) error {
+		format := CurrentFormat()
+		format.Version = 13
+		return writeFormat(tx, format)
+	})
+	test.Result(t, err, "write format from before the trash settings")
+	test.Result(t, db.Close(), "close bolt file")
+
+	store, err = Open(filename, passphrase)
+	test.Result(t, err, "open and upgrade vault")
+	settings, err := store.Settings()
+	test.Result(t, err, "read settings", settings)
+	test.Compare(t, "changed settings are kept", 5, settings.RevisionsKept)
+	test.Compare(t, "trash age is the default", defaultTrashMaxAge, settings.TrashMaxAge)
+	test.Result(t, store.Close(), "close vault")
+}
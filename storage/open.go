@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Backend is a way of keeping a vault in a file.
+type Backend string
+
+const (
+	BackendBolt   Backend = "bolt"   // A bbolt database, with a record per entry, changed in place
+	BackendSealed Backend = "sealed" // A single sealed file, replaced as a whole on every change
+)
+
+// vaultLockTimeout is how long opening a vault waits for another process to let go of it, before giving up with ErrVaultInUse.
+const vaultLockTimeout = time.Second
+
+// Backends lists every backend, the default first.
+var Backends = []Backend{BackendBolt, BackendSealed}
+
+// ParseBackend turns the name of a backend into a Backend.
+func ParseBackend(name string) (Backend, error) {
+	for _, backend := range Backends {
+		if string(backend) == name {
+			return backend, nil
+		}
+	}
+	return "", fmt.Errorf("unknown backend %q, expected one of %v", name, Backends)
+}
+
+// WithBackend sets the backend used when creating a new vault. Existing vaults keep the backend they have.
+func WithBackend(backend Backend) Option {
+	return func(o *options) {
+		o.backend = backend
+	}
+}
+
+// DetectBackend tells which backend the vault in the file uses, or false if there is no such file.
+func DetectBackend(filename string) (Backend, bool, error) {
+	sealed, err := sniffSealed(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if sealed {
+		return BackendSealed, true, nil
+	}
+	return BackendBolt, true, nil
+}
+
+// Open opens the vault in the file with whatever backend it uses, or creates it with the backend from the options.
+func Open(filename string, keyText []byte, opts ...Option) (Storage, error) {
+	backend, found, err := DetectBackend(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		options := collectOptions(opts)
+		if options.derivedKey != nil {
+			return nil, ErrNeedPassphrase // Before bolt makes an empty file of it
+		}
+		backend = options.backend
+	}
+	switch backend {
+	case BackendSealed:
+		return NewSealedStorage(filename, keyText, opts...)
+	case BackendBolt, "":
+		return NewBoltStorage(filename, keyText, opts...)
+	}
+	return nil, fmt.Errorf("unknown backend %q", backend)
+}
+
+// DeriveKey finds the key slot of an existing vault that opens with the passphrase, and returns the key derived for it,
+// for opening the vault with WithDerivedKey later. Only the keyfile option matters here.
+// A vault from before key slots has to be opened with the passphrase once, to be upgraded.
+func DeriveKey(filename string, keyText []byte, opts ...Option) ([]byte, error) {
+	backend, found, err := DetectBackend(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: %w", filename, os.ErrNotExist)
+	}
+	var header Header
+	switch backend {
+	case BackendSealed:
+		header, err = readSealedHeader(filename)
+	default:
+		header, err = readBoltHeader(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(header.Slots) == 0 {
+		return nil, ErrNeedPassphrase
+	}
+	keys, err := collectOptions(opts).unlockSlots(header.Slots, keyText)
+	return keys.slotKey, err
+}
+
+// dumper is a storage that can hand over everything in it at once.
+type dumper interface {
+	dump() (vaultContents, error)
+}
+
+// loader is a storage that can take everything from another at once, when it is new and empty.
+type loader interface {
+	load(contents vaultContents) error
+}
+
+// Convert copies everything in the storage, revisions, trash and settings included, to a new vault in the file.
+// The new vault is created with the options, and refuses to overwrite a file that already exists.
+func Convert(from Storage, filename string, keyText []byte, opts ...Option) error {
+	source, ok := from.(dumper)
+	if !ok {
+		return fmt.Errorf("%w: converting from %T", ErrNotImplemented, from)
+	}
+	if _, err := os.Stat(filename); err == nil {
+		return fmt.Errorf("%s: %w", filename, os.ErrExist)
+	}
+	contents, err := source.dump()
+	if err != nil {
+		return err
+	}
+	to, err := Open(filename, keyText, opts...)
+	if err != nil {
+		return err
+	}
+	target, ok := to.(loader)
+	if !ok {
+		to.Close()
+		return fmt.Errorf("%w: converting to %T", ErrNotImplemented, to)
+	}
+	if err := target.load(contents); err != nil {
+		to.Close()
+		os.Remove(filename) // It was only just created, and is no use half filled
+		return err
+	}
+	return to.Close()
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"github.com/google/uuid"
+)
+
+// orderStep is the gap left between the sort keys of neighbouring entries when numbering from scratch.
+// Moving an entry halves a gap, so this allows a lot of moves before everything has to be renumbered.
+const orderStep = int64(1) << 32
+
+// planOrder works out a sort key for every entry in the index, so that sorting by key gives the index order.
+// Old keys are kept where they are still in order, and changed lists the positions that got a new one.
+func planOrder(idx Index, old map[uuid.UUID]int64) (orders map[uuid.UUID]int64, changed []int) {
+	// nextOld[i] is the first position from i onwards with an old key, or len(idx) if there is none.
+	nextOld := make([]int, len(idx)+1)
+	nextOld[len(idx)] = len(idx)
+	for i := len(idx) - 1; i >= 0; i-- {
+		nextOld[i] = nextOld[i+1]
+		if _, ok := old[idx[i].Id]; ok {
+			nextOld[i] = i
+		}
+	}
+
+	orders = make(map[uuid.UUID]int64, len(idx))
+	prev := int64(0)
+	for i, meta := range idx {
+		if o, ok := old[meta.Id]; ok && o > prev {
+			orders[meta.Id] = o
+			prev = o
+			continue
+		}
+		upper := prev + 2*orderStep
+		for j := nextOld[i+1]; j < len(idx); j = nextOld[j+1] {
+			if o := old[idx[j].Id]; o > prev {
+				upper = o
+				break
+			}
+		}
+		if upper-prev < 2 {
+			return renumberOrder(idx)
+		}
+		prev += (upper - prev) / 2
+		orders[meta.Id] = prev
+		changed = append(changed, i)
+	}
+	return orders, changed
+}
+
+// renumberOrder gives every entry a fresh, evenly spaced sort key.
+func renumberOrder(idx Index) (map[uuid.UUID]int64, []int) {
+	orders := make(map[uuid.UUID]int64, len(idx))
+	changed := make([]int, len(idx))
+	for i, meta := range idx {
+		orders[meta.Id] = int64(i+1) * orderStep
+		changed[i] = i
+	}
+	return orders, changed
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/DemmyDemon/hardnote/test"
+	"github.com/google/uuid"
+)
+
+func sortedByOrder(idx Index, orders map[uuid.UUID]int64) bool {
+	return slices.IsSortedFunc(idx, func(a, b EntryMeta) int {
+		return int(max(-1, min(1, orders[a.Id]-orders[b.Id])))
+	})
+}
+
+func TestPlanOrder(t *testing.T) {
+	idx := make(Index, 5)
+	for i := range idx {
+		idx[i] = EntryMeta{Id: uuid.New()}
+	}
+
+	orders, changed := planOrder(idx, nil)
+	test.Compare(t, "fresh index changes everything", []int{0, 1, 2, 3, 4}, changed)
+	test.Compare(t, "fresh index is in order", true, sortedByOrder(idx, orders))
+
+	idx[1], idx[2] = idx[2], idx[1]
+	orders, changed = planOrder(idx, orders)
+	test.Compare(t, "swap changes one entry", []int{2}, changed)
+	test.Compare(t, "swapped index is in order", true, sortedByOrder(idx, orders))
+
+	idx = append(idx, EntryMeta{Id: uuid.New()})
+	orders, changed = planOrder(idx, orders)
+	test.Compare(t, "append changes one entry", []int{5}, changed)
+	test.Compare(t, "appended index is in order", true, sortedByOrder(idx, orders))
+
+	for i := 0; i < 100; i++ {
+		idx[0], idx[1] = idx[1], idx[0]
+		orders, changed = planOrder(idx, orders)
+		if !sortedByOrder(idx, orders) {
+			t.Fatalf("index out of order after %d swaps", i+1)
+		}
+	}
+	test.Compare(t, "index is still in order after running out of gaps", true, sortedByOrder(idx, orders))
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Revision is the text an entry had before it was saved over.
+type Revision struct {
+	Id      uuid.UUID // UUIDv7, so revisions sort by when they were replaced
+	EntryId uuid.UUID
+	Saved   time.Time // When this text was saved, before being replaced
+	Text    string
+}
+
+// Settings are the per-vault preferences, stored encrypted along with the notes.
+type Settings struct {
+	RevisionsKept  int           // Revisions kept per entry, where 0 keeps none
+	RevisionMaxAge time.Duration // Revisions saved longer ago than this are forgotten, where 0 never forgets
+	TrashMaxAge    time.Duration // Entries trashed longer ago than this are purged, where 0 never purges
+	Sort           SortMode      // How the listing was last sorted
+}
+
+const defaultRevisionsKept = 25
+const defaultTrashMaxAge = 30 * 24 * time.Hour
+
+// DefaultSettings are used for a vault that has never had its settings changed.
+func DefaultSettings() Settings {
+	return Settings{
+		RevisionsKept: defaultRevisionsKept,
+		TrashMaxAge:   defaultTrashMaxAge,
+	}
+}
+
+// expired picks the revisions to forget from a list sorted oldest first.
+func (s Settings) expired(revisions []Revision, now time.Time) []Revision {
+	drop := max(0, len(revisions)-max(0, s.RevisionsKept))
+	if s.RevisionMaxAge > 0 {
+		for drop < len(revisions) && now.Sub(revisions[drop].Saved) > s.RevisionMaxAge {
+			drop++
+		}
+	}
+	return revisions[:drop]
+}
@@ -0,0 +1,408 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// sealedMagic starts every sealed vault file, so it can be told apart from a bolt file without the passphrase.
+var sealedMagic = []byte("hardnote sealed\n")
+
+// sealedHeader is the unencrypted part of a sealed vault file.
+// The whole of it is the associated data of the sealed contents, so it can't be changed without being noticed.
+type sealedHeader struct {
+	Format Format
+	Header Header
+}
+
+// SealedStorage keeps the whole vault in memory, and as a single sealed file on disk.
+// Every change writes the file anew, next to the old one, and then renames it over the old one,
+// so the file is always either entirely before or entirely after the change, and holds nothing that was deleted.
+// Like BoltStorage, only one process can have the vault open at a time. As the file itself is replaced all the time,
+// that is down to a lock on a file next to it, which is left behind when closing, as removing it could race another process.
+type SealedStorage struct {
+	*MemoryStorage
+	filename string
+	lockFile *os.File // Held locked for as long as the vault is open
+	header   Header
+	cipher   cipher.AEAD
+	keys     keyring
+}
+
+// NewSealedStorage opens the sealed vault in the file, or creates it if the file doesn't exist.
+func NewSealedStorage(filename string, keyText []byte, opts ...Option) (Storage, error) {
+	lockFile, err := lockVault(filename + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	store, err := openSealed(filename, lockFile, keyText, collectOptions(opts))
+	if err != nil {
+		lockFile.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// lockVault takes the lock on the file, creating it if need be, and waits a little for another process to let go of it.
+func lockVault(filename string) (*os.File, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(vaultLockTimeout)
+	for {
+		locked, err := tryLock(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if locked {
+			return file, nil
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, ErrVaultInUse
+		}
+		time.Sleep(vaultLockTimeout / 20)
+	}
+}
+
+// openSealed opens the sealed vault in the file once it is locked, or creates it if the file doesn't exist.
+func openSealed(filename string, lockFile *os.File, keyText []byte, options options) (*SealedStorage, error) {
+	store := &SealedStorage{filename: filename, lockFile: lockFile}
+
+	raw, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		if options.derivedKey != nil {
+			return nil, ErrNeedPassphrase
+		}
+		kdf, err := options.newKDF()
+		if err != nil {
+			return nil, err
+		}
+		keys, slots, err := options.newSlots(kdf, keyText)
+		if err != nil {
+			return nil, err
+		}
+		store.header.Slots, store.keys = slots, options.newKeyring(keys)
+		store.cipher, err = NewCipher(keys.master)
+		if err != nil {
+			return nil, err
+		}
+		contents := newVaultContents()
+		if err := store.write(contents); err != nil {
+			return nil, err
+		}
+		store.MemoryStorage = newMemoryStorage(contents, store.write)
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	header, sealed, ad, err := splitSealed(raw)
+	if err != nil {
+		return nil, err
+	}
+	if header.Format.Version > FormatVersion {
+		return nil, fmt.Errorf("%w: format version %d, this build knows up to %d", ErrVaultTooNew, header.Format.Version, FormatVersion)
+	}
+	store.header = header.Header
+	keys := unlocked{}
+	switch {
+	case len(store.header.Slots) > 0:
+		keys, err = options.unlockSlots(store.header.Slots, keyText)
+	case options.derivedKey != nil:
+		err = ErrNeedPassphrase // Derived keys are for key slots, and making the first one takes the passphrase
+	default:
+		keys.master, err = store.header.KDF.derive(keyText, options.keyfile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	store.cipher, err = NewCipher(keys.master)
+	if err != nil {
+		return nil, err
+	}
+	contents := vaultContents{}
+	err = Soften(store.cipher, sealed, &contents, ad)
+	if errors.Is(err, ErrIntegrity) {
+		return nil, ErrInvalidKey // The header is bound to the contents, so a wrong key is by far the likeliest cause
+	}
+	if err != nil {
+		return nil, err
+	}
+	contents.fill()
+
+	if len(store.header.Slots) == 0 {
+		// From before key slots, so it gets a random master key and a passphrase slot, like migrateKeySlots does.
+		// Sealing the file with the new master key is left to the commit below.
+		kdf, err := NewKDF(store.header.KDF.Time, store.header.KDF.Memory, store.header.KDF.Threads)
+		if err != nil {
+			return nil, err
+		}
+		var slots []KeySlot
+		keys, slots, err = options.newSlots(kdf, keyText)
+		if err != nil {
+			return nil, err
+		}
+		store.cipher, err = NewCipher(keys.master)
+		if err != nil {
+			return nil, err
+		}
+		store.header = Header{Slots: slots}
+	}
+	store.keys = options.newKeyring(keys)
+
+	store.MemoryStorage = newMemoryStorage(contents, store.write) // Writes the upgraded header along with the purged trash
+	mb := store.newBatch()
+	mb.purgeExpiredTrash(timestamp())
+	if err := store.commit(mb); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// fill replaces whatever didn't survive encoding, as gob leaves out empty maps and slices.
+func (vc *vaultContents) fill() {
+	empty := newVaultContents()
+	if vc.Index == nil {
+		vc.Index = empty.Index
+	}
+	if vc.Entries == nil {
+		vc.Entries = empty.Entries
+	}
+	if vc.Revisions == nil {
+		vc.Revisions = empty.Revisions
+	}
+	if vc.Trash == nil {
+		vc.Trash = empty.Trash
+	}
+}
+
+// splitSealed takes a sealed vault file apart into its header, the sealed contents and the associated data to open them with.
+func splitSealed(raw []byte) (sealedHeader, []byte, []byte, error) {
+	header := sealedHeader{}
+	if !bytes.HasPrefix(raw, sealedMagic) {
+		return header, nil, nil, fmt.Errorf("%w: not a sealed vault", ErrInvalidStorage)
+	}
+	raw = raw[len(sealedMagic):]
+	if len(raw) < 4 {
+		return header, nil, nil, fmt.Errorf("%w: sealed vault is cut short", ErrInvalidStorage)
+	}
+	size := binary.BigEndian.Uint32(raw)
+	raw = raw[4:]
+	if uint64(size) > uint64(len(raw)) {
+		return header, nil, nil, fmt.Errorf("%w: sealed vault is cut short", ErrInvalidStorage)
+	}
+	encodedHeader, sealed := raw[:size], raw[size:]
+	if err := Decode(encodedHeader, &header); err != nil {
+		return header, nil, nil, fmt.Errorf("%w: %v", ErrInvalidStorage, err)
+	}
+	return header, sealed, AssociatedData(RecordVault, encodedHeader), nil
+}
+
+// readSealedHeader reads the unencrypted header of a sealed vault file.
+func readSealedHeader(filename string) (Header, error) {
+	raw, err := os.ReadFile(filename)
+	if err != nil {
+		return Header{}, err
+	}
+	header, _, _, err := splitSealed(raw)
+	return header.Header, err
+}
+
+// write seals the contents and replaces the file with them, all at once.
+func (s *SealedStorage) write(contents vaultContents) error {
+	encodedHeader, err := Encode(sealedHeader{Format: CurrentFormat(), Header: s.header})
+	if err != nil {
+		return err
+	}
+	sealed, err := Harden(s.cipher, contents, AssociatedData(RecordVault, encodedHeader))
+	if err != nil {
+		return err
+	}
+
+	var file bytes.Buffer
+	file.Write(sealedMagic)
+	file.Write(binary.BigEndian.AppendUint32(nil, uint32(len(encodedHeader))))
+	file.Write(encodedHeader)
+	file.Write(sealed)
+	return replaceFile(s.filename, file.Bytes())
+}
+
+// replaceFile writes the data to a temporary file in the same directory, and renames it over the file.
+func replaceFile(filename string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name()) // Only does anything if the rename didn't happen
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp.Name(), filename); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(filename)); err == nil {
+		dir.Sync() // Makes the rename itself stick, where the platform allows it
+		dir.Close()
+	}
+	return nil
+}
+
+// Rekey changes the passphrase of the slot the vault was opened with, as described for keyring.rekey.
+// The file is sealed with a new master key along with it.
+func (s *SealedStorage) Rekey(keyText []byte) error {
+	var slot KeySlot
+	err := s.updateSlots(func(slots []KeySlot) ([]KeySlot, []byte, error) {
+		var master []byte
+		var err error
+		slots, slot, master, err = s.keys.rekey(slots, keyText)
+		return slots, master, err
+	}, func() {
+		s.keys.opened = slot.Id
+	})
+	return err
+}
+
+// Slots lists the ways the vault can be unlocked.
+func (s *SealedStorage) Slots() ([]KeySlot, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return nil, ErrAlreadyClosed
+	}
+	return slices.Clone(s.header.Slots), nil
+}
+
+// AddSlot adds another way of unlocking the vault, taking the same secret and keyfile as BoltStorage.AddSlot.
+func (s *SealedStorage) AddSlot(kind SlotKind, label string, secret []byte, keyfile []byte) (KeySlot, error) {
+	var slot KeySlot
+	err := s.updateSlots(func(slots []KeySlot) ([]KeySlot, []byte, error) {
+		var err error
+		slots, slot, err = s.keys.add(slots, kind, label, secret, keyfile)
+		return slots, nil, err
+	}, nil)
+	return slot, err
+}
+
+// RevokeSlot takes away a way of unlocking the vault, refusing to take away the last one.
+// Like Rekey, it replaces the master key the file is sealed with.
+func (s *SealedStorage) RevokeSlot(id uuid.UUID) error {
+	return s.updateSlots(func(slots []KeySlot) ([]KeySlot, []byte, error) {
+		return s.keys.revoke(slots, id)
+	}, func() {
+		if id == s.keys.opened {
+			s.keys.opened = uuid.Nil
+		}
+	})
+}
+
+// updateSlots changes the key slots in the header, and writes the file anew with them,
+// sealed with the new master key if the change comes with one.
+// Once that worked, the keyring is brought up to date by applied, if given.
+func (s *SealedStorage) updateSlots(change func(slots []KeySlot) ([]KeySlot, []byte, error), applied func()) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrAlreadyClosed
+	}
+	slots, master, err := change(s.header.Slots)
+	if err != nil {
+		return err
+	}
+	previousSlots, previousCipher := s.header.Slots, s.cipher
+	if master != nil {
+		s.cipher, err = NewCipher(master)
+		if err != nil {
+			return err
+		}
+	}
+	s.header.Slots = slots
+	if err := s.write(s.contents); err != nil {
+		s.header.Slots, s.cipher = previousSlots, previousCipher
+		return err
+	}
+	if master != nil {
+		s.keys.master = master
+	}
+	if applied != nil {
+		applied()
+	}
+	return nil
+}
+
+// Close forgets everything in the vault, and lets go of the lock on it.
+func (s *SealedStorage) Close() error {
+	err := s.MemoryStorage.Close()
+	if closeErr := s.lockFile.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Check reads the file back and makes sure it opens to what is in memory.
+func (s *SealedStorage) Check(repair bool) (CheckReport, error) {
+	report, err := s.MemoryStorage.Check(repair)
+	if err != nil {
+		return report, err
+	}
+	if repair {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+	} else {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+	}
+	raw, err := os.ReadFile(s.filename)
+	if err != nil {
+		return report, err
+	}
+	_, sealed, ad, err := splitSealed(raw)
+	if err == nil {
+		_, err = unseal(s.cipher, sealed, ad)
+	}
+	if err != nil {
+		report.Undecryptable = append(report.Undecryptable, s.filename)
+		if repair {
+			if err := s.write(s.contents); err != nil {
+				return report, err
+			}
+			report.Repaired = true
+		}
+	}
+	return report, nil
+}
+
+// sniffSealed tells if the file starts like a sealed vault.
+func sniffSealed(filename string) (bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	start := make([]byte, len(sealedMagic))
+	if _, err := io.ReadFull(file, start); err != nil {
+		return false, nil // Too short to be sealed, so it is up to bolt to make sense of it
+	}
+	return bytes.Equal(start, sealedMagic), nil
+}
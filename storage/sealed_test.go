@@ -0,0 +1,199 @@
+package storage_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DemmyDemon/hardnote/storage"
+	"github.com/DemmyDemon/hardnote/test"
+	"github.com/google/uuid"
+)
+
+func TestSealedReopen(t *testing.T) {
+	passphrase := []byte("Signed, sealed, delivered")
+	store, filename := storage.OpenTestVault(t, storage.BackendSealed, passphrase)
+	backend, found, err := storage.DetectBackend(filename)
+	test.Result(t, err, "detect backend", backend, found)
+	test.Compare(t, "created as sealed", storage.BackendSealed, backend)
+
+	entry, _, err := store.Create("Letter", "Dear diary")
+	test.Result(t, err, "create entry", entry)
+	folder, _, err := store.CreateFolder("Drawer", uuid.Nil)
+	test.Result(t, err, "create folder", folder)
+	_, err = store.Move(entry.Id, folder.Id)
+	test.Result(t, err, "move entry into folder")
+	entry.Text = "Dear diary, today I sealed a vault"
+	_, err = store.Update(entry)
+	test.Result(t, err, "update entry")
+	_, err = store.Read(entry.Id)
+	test.Result(t, err, "read entry")
+	idx, err := store.Index()
+	test.Result(t, err, "read index", idx)
+	test.Result(t, store.Rekey([]byte("Resealed")), "rekey")
+	test.Result(t, store.Close(), "close vault")
+
+	leftovers, err := filepath.Glob(filename + ".*.tmp")
+	test.Result(t, err, "look for temporary files", leftovers)
+	test.Compare(t, "no temporary files are left", 0, len(leftovers))
+
+	_, err = storage.Open(filename, passphrase)
+	if !errors.Is(err, storage.ErrInvalidKey) {
+		t.Fatalf("expected %v opening with the old passphrase, got %v", storage.ErrInvalidKey, err)
+	}
+
+	store, err = storage.Open(filename, []byte("Resealed"))
+	test.Result(t, err, "reopen vault")
+	reopened, err := store.Index()
+	test.Result(t, err, "read reopened index", reopened)
+	test.Compare(t, "index survives reopening", idx, reopened)
+	read, err := store.Read(entry.Id)
+	test.Result(t, err, "read reopened entry", read)
+	test.Compare(t, "entry survives reopening", entry, read)
+	revisions, err := store.Revisions(entry.Id)
+	test.Result(t, err, "list revisions", len(revisions))
+	test.Compare(t, "revisions survive reopening", 1, len(revisions))
+	results, err := store.Search("sealed")
+	test.Result(t, err, "search reopened vault", len(results))
+	test.Compare(t, "search is rebuilt when opening", 1, len(results))
+	test.Result(t, store.Close(), "close reopened vault")
+}
+
+func TestSealedRead(t *testing.T) {
+	passphrase := []byte("Read only")
+	store, filename := storage.OpenTestVault(t, storage.BackendSealed, passphrase)
+	entry, _, err := store.Create("Glance", "Just looking")
+	test.Result(t, err, "create entry", entry.Id)
+
+	written, err := os.ReadFile(filename)
+	test.Result(t, err, "read sealed file", len(written))
+	_, err = store.Read(entry.Id)
+	test.Result(t, err, "read entry")
+	unchanged, err := os.ReadFile(filename)
+	test.Result(t, err, "read sealed file again", len(unchanged))
+	test.Compare(t, "reading leaves the file alone", written, unchanged)
+	test.Result(t, store.Close(), "close vault")
+
+	store, err = storage.NewSealedStorage(filename, passphrase)
+	test.Result(t, err, "reopen sealed vault")
+	idx, err := store.Index()
+	test.Result(t, err, "read index", idx)
+	test.Compare(t, "opened time is saved when closing", false, idx[0].Opened.IsZero())
+	test.Result(t, store.Close(), "close vault")
+}
+
+func TestSealedTampering(t *testing.T) {
+	passphrase := []byte("Tamper evident")
+	store, filename := storage.OpenTestVault(t, storage.BackendSealed, passphrase)
+	_, _, err := store.Create("Precious", "Do not touch")
+	test.Result(t, err, "create entry")
+	test.Result(t, store.Close(), "close vault")
+
+	raw, err := os.ReadFile(filename)
+	test.Result(t, err, "read sealed file", len(raw))
+
+	flipped := append([]byte{}, raw...)
+	flipped[len(flipped)-1] ^= 1
+	test.Result(t, os.WriteFile(filename, flipped, 0600), "flip a bit in the contents")
+	_, err = storage.NewSealedStorage(filename, passphrase)
+	test.Compare(t, "flipped contents are refused", storage.ErrInvalidKey, err)
+
+	test.Result(t, os.WriteFile(filename, raw[:len(raw)/2], 0600), "cut the file short")
+	_, err = storage.NewSealedStorage(filename, passphrase)
+	if !errors.Is(err, storage.ErrInvalidStorage) && !errors.Is(err, storage.ErrInvalidKey) {
+		t.Errorf("expected the cut short file to be refused, got %v", err)
+	}
+
+	test.Result(t, os.WriteFile(filename, []byte("Not a vault at all"), 0600), "write something else")
+	_, err = storage.NewSealedStorage(filename, passphrase)
+	if !errors.Is(err, storage.ErrInvalidStorage) {
+		t.Errorf("expected %v opening something else, got %v", storage.ErrInvalidStorage, err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	passphrase := []byte("Same notes, different file")
+	kdf := storage.CheapKDF(t)
+	store, boltName := storage.OpenTestVault(t, storage.BackendBolt, passphrase)
+	dir := filepath.Dir(boltName)
+
+	folder, _, err := store.CreateFolder("Folder", uuid.Nil)
+	test.Result(t, err, "create folder", folder)
+	created, _, err := store.Batch(
+		storage.CreateOp{Name: "Kept", Text: "First", Tags: []string{"tag"}, Parent: folder.Id},
+		storage.CreateOp{Name: "Trashed", Text: "Gone"},
+		storage.CreateOp{Name: "Pinned", Text: "Here"},
+	)
+	test.Result(t, err, "create entries", len(created))
+	created[0].Text = "Second"
+	_, err = store.Update(created[0])
+	test.Result(t, err, "update entry")
+	_, err = store.Trash(created[1].Id)
+	test.Result(t, err, "trash entry")
+	_, err = store.Pin(created[2].Id, true)
+	test.Result(t, err, "pin entry")
+	settings, err := store.Settings()
+	test.Result(t, err, "read settings", settings)
+	settings.RevisionsKept = 7
+	test.Result(t, store.UpdateSettings(settings), "change settings")
+
+	snapshot := func(store storage.Storage) (storage.Index, []storage.Entry, []storage.Revision, []storage.TrashedEntry, storage.Settings) {
+		idx, err := store.Index()
+		test.Result(t, err, "read index", len(idx))
+		entries := []storage.Entry{}
+		for _, meta := range idx {
+			if meta.Folder {
+				continue
+			}
+			entry, err := store.Read(meta.Id)
+			test.Result(t, err, "read entry", meta.Name)
+			entries = append(entries, entry)
+		}
+		revisions, err := store.Revisions(created[0].Id)
+		test.Result(t, err, "list revisions", len(revisions))
+		trash, err := store.TrashBin()
+		test.Result(t, err, "list trash", len(trash))
+		settings, err := store.Settings()
+		test.Result(t, err, "read settings", settings)
+		idx, err = store.Index()
+		test.Result(t, err, "read index after reading everything", len(idx))
+		for i := range idx {
+			idx[i].Opened = time.Time{} // Reading everything just marked it all, so only the rest can be compared
+		}
+		return idx, entries, revisions, trash, settings
+	}
+	idx, entries, revisions, trash, settings := snapshot(store)
+
+	sealedName := filepath.Join(dir, "hardnote.sealed")
+	test.Result(t, storage.Convert(store, sealedName, passphrase, storage.WithKDF(kdf), storage.WithBackend(storage.BackendSealed)), "convert to sealed")
+	test.Compare(t, "refuses to overwrite", true, errors.Is(storage.Convert(store, sealedName, passphrase), os.ErrExist))
+	test.Result(t, store.Close(), "close bolt vault")
+
+	sealed, err := storage.Open(sealedName, passphrase)
+	test.Result(t, err, "open sealed vault")
+	sealedIdx, sealedEntries, sealedRevisions, sealedTrash, sealedSettings := snapshot(sealed)
+	test.Compare(t, "index is converted", idx, sealedIdx)
+	test.Compare(t, "entries are converted", entries, sealedEntries)
+	test.Compare(t, "revisions are converted", revisions, sealedRevisions)
+	test.Compare(t, "trash is converted", trash, sealedTrash)
+	test.Compare(t, "settings are converted", settings, sealedSettings)
+
+	backName := filepath.Join(dir, "hardnote.back")
+	test.Result(t, storage.Convert(sealed, backName, passphrase, storage.WithKDF(kdf)), "convert back to bolt")
+	test.Result(t, sealed.Close(), "close sealed vault")
+
+	back, err := storage.Open(backName, passphrase)
+	test.Result(t, err, "open converted bolt vault")
+	backIdx, backEntries, backRevisions, backTrash, backSettings := snapshot(back)
+	test.Compare(t, "index survives the round trip", idx, backIdx)
+	test.Compare(t, "entries survive the round trip", entries, backEntries)
+	test.Compare(t, "revisions survive the round trip", revisions, backRevisions)
+	test.Compare(t, "trash survives the round trip", trash, backTrash)
+	test.Compare(t, "settings survive the round trip", settings, backSettings)
+	report, err := back.Check(false)
+	test.Result(t, err, "check converted vault", report)
+	test.Compare(t, "converted vault is clean", true, report.Clean())
+	test.Result(t, back.Close(), "close converted bolt vault")
+}
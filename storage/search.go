@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	searchMatchesKept  = 5  // Matches reported per entry, the rest are only counted
+	searchSnippetRunes = 30 // Context shown on each side of a match
+)
+
+// SearchResult is an entry where every word of the query was found.
+type SearchResult struct {
+	Meta    EntryMeta
+	Matches []SearchMatch // The first few matches, in the order they appear in the text
+	Count   int           // How many matches there are in all
+}
+
+// SearchMatch is a word in the text that starts with one of the query words.
+type SearchMatch struct {
+	Offset  int    // Byte offset of the match in the text
+	Line    int    // Line of the match, counting from 0
+	Column  int    // Column of the match in runes, counting from 0
+	Snippet string // The match with some of the line around it
+	Start   int    // Byte offset of the match in the snippet
+	End     int    // Byte offset of the end of the match in the snippet
+}
+
+// searchIndex maps lower case words to the entries they are in. It only ever lives in memory.
+type searchIndex struct {
+	terms map[string]map[uuid.UUID]bool
+	texts map[uuid.UUID]string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		terms: map[string]map[uuid.UUID]bool{},
+		texts: map[uuid.UUID]string{},
+	}
+}
+
+type searchToken struct {
+	start int
+	end   int
+	term  string
+}
+
+// tokenize splits text into words of letters and digits, remembering where they are.
+func tokenize(text string) []searchToken {
+	tokens := []searchToken{}
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if word && start < 0 {
+			start = i
+		}
+		if !word && start >= 0 {
+			tokens = append(tokens, searchToken{start, i, strings.ToLower(text[start:i])})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, searchToken{start, len(text), strings.ToLower(text[start:])})
+	}
+	return tokens
+}
+
+// put indexes the text of an entry, replacing whatever it was before.
+func (si *searchIndex) put(id uuid.UUID, text string) {
+	si.remove(id)
+	si.texts[id] = text
+	for _, token := range tokenize(text) {
+		ids := si.terms[token.term]
+		if ids == nil {
+			ids = map[uuid.UUID]bool{}
+			si.terms[token.term] = ids
+		}
+		ids[id] = true
+	}
+}
+
+func (si *searchIndex) remove(id uuid.UUID) {
+	text, ok := si.texts[id]
+	if !ok {
+		return
+	}
+	for _, token := range tokenize(text) {
+		delete(si.terms[token.term], id)
+		if len(si.terms[token.term]) == 0 {
+			delete(si.terms, token.term)
+		}
+	}
+	delete(si.texts, id)
+}
+
+// search finds the entries containing words that start with every word of the query, in index order.
+func (si *searchIndex) search(idx Index, query string) []SearchResult {
+	results := []SearchResult{}
+	queryTerms := []string{}
+	for _, token := range tokenize(query) {
+		queryTerms = append(queryTerms, token.term)
+	}
+	if len(queryTerms) == 0 {
+		return results
+	}
+
+	var candidates map[uuid.UUID]bool
+	for _, queryTerm := range queryTerms {
+		found := map[uuid.UUID]bool{}
+		for term, ids := range si.terms {
+			if !strings.HasPrefix(term, queryTerm) {
+				continue
+			}
+			for id := range ids {
+				if candidates == nil || candidates[id] {
+					found[id] = true
+				}
+			}
+		}
+		candidates = found
+	}
+
+	for _, meta := range idx {
+		if !candidates[meta.Id] {
+			continue
+		}
+		text := si.texts[meta.Id]
+		result := SearchResult{Meta: meta}
+		for _, token := range tokenize(text) {
+			for _, queryTerm := range queryTerms {
+				if strings.HasPrefix(token.term, queryTerm) {
+					if result.Count < searchMatchesKept {
+						result.Matches = append(result.Matches, newSearchMatch(text, token.start, token.end))
+					}
+					result.Count++
+					break
+				}
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func newSearchMatch(text string, start int, end int) SearchMatch {
+	lineStart := strings.LastIndexByte(text[:start], '\n') + 1
+	lineEnd := len(text)
+	if i := strings.IndexByte(text[end:], '\n'); i >= 0 {
+		lineEnd = end + i
+	}
+
+	before, prefix := text[lineStart:start], ""
+	if utf8.RuneCountInString(before) > searchSnippetRunes {
+		runes := []rune(before)
+		before, prefix = string(runes[len(runes)-searchSnippetRunes:]), "…"
+	}
+	after, suffix := text[end:lineEnd], ""
+	if utf8.RuneCountInString(after) > searchSnippetRunes {
+		after, suffix = string([]rune(after)[:searchSnippetRunes]), "…"
+	}
+
+	snippetStart := len(prefix) + len(before)
+	return SearchMatch{
+		Offset:  start,
+		Line:    strings.Count(text[:start], "\n"),
+		Column:  utf8.RuneCountInString(text[lineStart:start]),
+		Snippet: prefix + before + text[start:end] + after + suffix,
+		Start:   snippetStart,
+		End:     snippetStart + end - start,
+	}
+}
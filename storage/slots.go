@@ -0,0 +1,395 @@
+package storage
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SlotKind is a way of unlocking a vault.
+type SlotKind string
+
+const (
+	SlotPassphrase SlotKind = "passphrase" // A passphrase, with a keyfile mixed in if the slot was made with one
+	SlotKeyfile    SlotKind = "keyfile"    // A keyfile on its own, given with an empty passphrase
+	SlotRecovery   SlotKind = "recovery"   // A generated recovery code, given instead of the passphrase
+)
+
+// SlotKinds lists every kind of key slot.
+var SlotKinds = []SlotKind{SlotPassphrase, SlotKeyfile, SlotRecovery}
+
+// ParseSlotKind turns the name of a kind of key slot into a SlotKind.
+func ParseSlotKind(name string) (SlotKind, error) {
+	for _, kind := range SlotKinds {
+		if string(kind) == name {
+			return kind, nil
+		}
+	}
+	return "", fmt.Errorf("unknown kind of key slot %q, expected one of %v", name, SlotKinds)
+}
+
+// KeySlot is one way of unlocking a vault. Everything in the vault is encrypted with a random master key,
+// and every slot holds a copy of it, wrapped for the X25519 key pair of the slot. The private key is sealed
+// with the key derived from whatever unlocks the slot, while the public key lets a new master key be wrapped
+// for the slot without it. That way the master key can be replaced whenever a slot goes, leaving nothing
+// that was ever in the header able to decrypt what is written after.
+// Slots are stored unencrypted in the vault header, as they are needed before anything can be decrypted.
+type KeySlot struct {
+	Id        uuid.UUID
+	Kind      SlotKind
+	Label     string
+	Created   time.Time
+	KDF       KDF
+	Public    []byte // X25519 public key of the slot
+	Private   []byte // X25519 private key of the slot, sealed with the key derived for it and bound to its id
+	Ephemeral []byte // Public half of the one-off key pair the master key was wrapped with
+	Wrapped   []byte // The master key, sealed for the public key of the slot and bound to its id
+}
+
+const (
+	recoveryCodeSize  = 20 // Random bytes in a recovery code, which makes 32 characters
+	recoveryGroupSize = 4  // Characters between the dashes of a written recovery code
+)
+
+// recoveryEncoding is Crockford's base32, which leaves out the letters most easily mistaken for others.
+var recoveryEncoding = base32.NewEncoding("0123456789ABCDEFGHJKMNPQRSTVWXYZ").WithPadding(base32.NoPadding)
+
+// NewRecoveryCode makes a random recovery code, in groups separated by dashes so it is easy to write down.
+func NewRecoveryCode() (string, error) {
+	random := make([]byte, recoveryCodeSize)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		return "", err
+	}
+	code := recoveryEncoding.EncodeToString(random)
+	groups := []string{}
+	for len(code) > 0 {
+		size := min(recoveryGroupSize, len(code))
+		groups = append(groups, code[:size])
+		code = code[size:]
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// normalizeRecoveryCode turns a recovery code as typed in back into the one that was generated,
+// forgiving case, dashes, spaces and the letters Crockford's base32 reads as digits.
+func normalizeRecoveryCode(text []byte) ([]byte, bool) {
+	replacer := strings.NewReplacer("-", "", " ", "", "O", "0", "I", "1", "L", "1")
+	code := replacer.Replace(strings.ToUpper(string(text)))
+	decoded, err := recoveryEncoding.DecodeString(code)
+	if err != nil || len(decoded) != recoveryCodeSize {
+		return nil, false
+	}
+	return []byte(code), true
+}
+
+// secret is what the key of the slot is derived from, given what was typed in, or false if that can't open it.
+func (s KeySlot) secret(keyText []byte) ([]byte, bool) {
+	switch s.Kind {
+	case SlotKeyfile:
+		return nil, len(keyText) == 0
+	case SlotRecovery:
+		return normalizeRecoveryCode(keyText)
+	}
+	return keyText, len(keyText) > 0
+}
+
+// unwrap takes the master key out of the slot, with the key derived for it.
+func (s KeySlot) unwrap(slotKey []byte) ([]byte, error) {
+	gcm, err := NewCipher(slotKey)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := unseal(gcm, s.Private, AssociatedData(RecordSlotKey, s.Id[:]))
+	if err != nil {
+		return nil, err
+	}
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidStorage, err)
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(s.Ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidStorage, err)
+	}
+	shared, err := private.ECDH(ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidStorage, err)
+	}
+	gcm, err = s.wrapCipher(shared)
+	if err != nil {
+		return nil, err
+	}
+	return unseal(gcm, s.Wrapped, AssociatedData(RecordSlot, s.Id[:]))
+}
+
+// wrap puts the master key in the slot, sealed for its public key with a one-off key pair of its own.
+func (s *KeySlot) wrap(master []byte) error {
+	public, err := ecdh.X25519().NewPublicKey(s.Public)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidStorage, err)
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	shared, err := ephemeral.ECDH(public)
+	if err != nil {
+		return err
+	}
+	s.Ephemeral = ephemeral.PublicKey().Bytes()
+	gcm, err := s.wrapCipher(shared)
+	if err != nil {
+		return err
+	}
+	s.Wrapped, err = seal(gcm, master, AssociatedData(RecordSlot, s.Id[:]))
+	return err
+}
+
+// wrapCipher is the cipher the master key is wrapped with, from the secret shared by the slot and the one-off key pair.
+func (s KeySlot) wrapCipher(shared []byte) (cipher.AEAD, error) {
+	info := "hardnote key slot\n" + string(s.Ephemeral) + string(s.Public)
+	key, err := hkdf.Key(sha256.New, shared, s.Id[:], info, keySize)
+	if err != nil {
+		return nil, err
+	}
+	return NewCipher(key)
+}
+
+// newSlot makes a slot of the kind, holding the master key. A recovery slot ignores the keyfile,
+// as the recovery code is meant to be all it takes.
+func newSlot(kind SlotKind, label string, kdf KDF, secret []byte, keyfile []byte, master []byte) (KeySlot, []byte, error) {
+	id, err := uuid.NewV7()
+	if err != nil {
+		return KeySlot{}, nil, err
+	}
+	if kind == SlotRecovery {
+		keyfile = nil
+	}
+	if label == "" {
+		label = string(kind)
+	}
+	slot := KeySlot{Id: id, Kind: kind, Label: label, Created: timestamp(), KDF: kdf.withKeyfile(keyfile)}
+
+	secret, ok := slot.secret(secret)
+	switch {
+	case kind == SlotKeyfile && keyfile == nil:
+		return KeySlot{}, nil, ErrKeyfileNeeded
+	case kind == SlotRecovery && !ok:
+		return KeySlot{}, nil, ErrRecoveryCode
+	case !slices.Contains(SlotKinds, kind):
+		return KeySlot{}, nil, fmt.Errorf("unknown kind of key slot %q", kind)
+	case !ok:
+		return KeySlot{}, nil, ErrEmptyPassphrase
+	}
+
+	slotKey, err := slot.KDF.derive(secret, keyfile)
+	if err != nil {
+		return KeySlot{}, nil, err
+	}
+	gcm, err := NewCipher(slotKey)
+	if err != nil {
+		return KeySlot{}, nil, err
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return KeySlot{}, nil, err
+	}
+	slot.Public = private.PublicKey().Bytes()
+	slot.Private, err = seal(gcm, private.Bytes(), AssociatedData(RecordSlotKey, id[:]))
+	if err != nil {
+		return KeySlot{}, nil, err
+	}
+	if err := slot.wrap(master); err != nil {
+		return KeySlot{}, nil, err
+	}
+	return slot, slotKey, nil
+}
+
+// unlocked is the master key of a vault, and the slot it was taken out of.
+type unlocked struct {
+	master  []byte
+	slotKey []byte // What the agent holds on to, so revoking the slot locks it out as well
+	slot    KeySlot
+}
+
+// newSlots makes the master key of a new vault, and the passphrase slot to open it with, using the key derivation given.
+func (o options) newSlots(kdf KDF, keyText []byte) (unlocked, []KeySlot, error) {
+	master, err := newMasterKey()
+	if err != nil {
+		return unlocked{}, nil, err
+	}
+	slot, slotKey, err := newSlot(SlotPassphrase, "", kdf, keyText, o.keyfile, master)
+	if err != nil {
+		return unlocked{}, nil, err
+	}
+	return unlocked{master: master, slotKey: slotKey, slot: slot}, []KeySlot{slot}, nil
+}
+
+// unlockSlots finds the slot that opens with the passphrase and keyfile, or the derived key, and takes the master key out of it.
+// Only the slots that could possibly be opened are tried, as every try costs a key derivation.
+func (o options) unlockSlots(slots []KeySlot, keyText []byte) (unlocked, error) {
+	if o.derivedKey != nil {
+		for _, slot := range slots {
+			if master, err := slot.unwrap(o.derivedKey); err == nil {
+				return unlocked{master: master, slotKey: o.derivedKey, slot: slot}, nil
+			}
+		}
+		return unlocked{}, ErrInvalidKey
+	}
+
+	tried := false
+	var refusal error
+	for _, slot := range slots {
+		secret, ok := slot.secret(keyText)
+		if !ok {
+			continue
+		}
+		keyfile := o.keyfile
+		if slot.Kind == SlotRecovery {
+			keyfile = nil
+		}
+		if err := slot.KDF.checkKeyfile(keyfile); err != nil {
+			if refusal == nil {
+				refusal = err
+			}
+			continue
+		}
+		tried = true
+		slotKey, err := slot.KDF.derive(secret, keyfile)
+		if err != nil {
+			return unlocked{}, err
+		}
+		if master, err := slot.unwrap(slotKey); err == nil {
+			return unlocked{master: master, slotKey: slotKey, slot: slot}, nil
+		}
+	}
+	if !tried && refusal != nil {
+		return unlocked{}, refusal
+	}
+	return unlocked{}, ErrInvalidKey
+}
+
+// keyring is what an unlocked vault keeps to change its key slots.
+type keyring struct {
+	master  []byte
+	opened  uuid.UUID // Slot the vault was opened with, or uuid.Nil if it has been revoked since
+	keyfile []byte    // Keyfile the vault was opened with, mixed in again when rekeying
+}
+
+// newKeyring is the keyring of a vault unlocked with the keyfile from the options.
+func (o options) newKeyring(keys unlocked) keyring {
+	return keyring{master: keys.master, opened: keys.slot.Id, keyfile: o.keyfile}
+}
+
+// slotKDF is the key derivation for a new slot, as costly as that of the slots already there.
+func slotKDF(slots []KeySlot) (KDF, error) {
+	for _, slot := range slots {
+		if slot.KDF.Algorithm == KDFArgon2id {
+			return NewKDF(slot.KDF.Time, slot.KDF.Memory, slot.KDF.Threads)
+		}
+	}
+	return DefaultKDF()
+}
+
+// newMasterKey makes a random master key.
+func newMasterKey() ([]byte, error) {
+	master := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, master); err != nil {
+		return nil, err
+	}
+	return master, nil
+}
+
+// rotate makes a new master key and wraps it in every one of the slots, which are changed in place.
+// Everything in the vault has to be encrypted anew with it, as a slot that is gone may still be found
+// in a backup, or in the part of the file where it used to be, and would open the old master key.
+func rotate(slots []KeySlot) ([]byte, error) {
+	master, err := newMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	for i := range slots {
+		if err := slots[i].wrap(master); err != nil {
+			return nil, err
+		}
+	}
+	return master, nil
+}
+
+// rekey replaces the passphrase slot the vault was opened with by one for the new passphrase, keeping its keyfile.
+// Opened any other way, like with a recovery code, a passphrase slot is added instead, leaving the others alone.
+// Either way, the master key is replaced, and returned along with the slots.
+func (k keyring) rekey(slots []KeySlot, keyText []byte) ([]KeySlot, KeySlot, []byte, error) {
+	position := slices.IndexFunc(slots, func(slot KeySlot) bool {
+		return slot.Id == k.opened && slot.Kind == SlotPassphrase
+	})
+	label := ""
+	var keyfile []byte
+	updated := slices.Clone(slots)
+	if position >= 0 {
+		label = slots[position].Label
+		if slots[position].KDF.Keyfile {
+			if k.keyfile == nil {
+				return nil, KeySlot{}, nil, ErrKeyfileNeeded // Opened with a derived key, so the keyfile isn't known
+			}
+			keyfile = k.keyfile
+		}
+		updated = slices.Delete(updated, position, position+1)
+	}
+	kdf, err := slotKDF(slots)
+	if err != nil {
+		return nil, KeySlot{}, nil, err
+	}
+	master, err := rotate(updated)
+	if err != nil {
+		return nil, KeySlot{}, nil, err
+	}
+	slot, _, err := newSlot(SlotPassphrase, label, kdf, keyText, keyfile, master)
+	if err != nil {
+		return nil, KeySlot{}, nil, err
+	}
+	return append(updated, slot), slot, master, nil
+}
+
+// add makes a new slot holding the master key, and puts it after the others.
+func (k keyring) add(slots []KeySlot, kind SlotKind, label string, secret []byte, keyfile []byte) ([]KeySlot, KeySlot, error) {
+	kdf, err := slotKDF(slots)
+	if err != nil {
+		return nil, KeySlot{}, err
+	}
+	slot, _, err := newSlot(kind, label, kdf, secret, keyfile, k.master)
+	if err != nil {
+		return nil, KeySlot{}, err
+	}
+	return append(slices.Clone(slots), slot), slot, nil
+}
+
+// revoke takes the slot out, as long as there is another one left to open the vault with.
+// The master key is replaced, and returned along with the slots that are left.
+func (k keyring) revoke(slots []KeySlot, id uuid.UUID) ([]KeySlot, []byte, error) {
+	position := slices.IndexFunc(slots, func(slot KeySlot) bool {
+		return slot.Id == id
+	})
+	if position < 0 {
+		return nil, nil, ErrNoSuchSlot
+	}
+	if len(slots) == 1 {
+		return nil, nil, ErrLastSlot
+	}
+	updated := slices.Delete(slices.Clone(slots), position, position+1)
+	master, err := rotate(updated)
+	if err != nil {
+		return nil, nil, err
+	}
+	return updated, master, nil
+}
@@ -0,0 +1,125 @@
+package storage_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DemmyDemon/hardnote/storage"
+	"github.com/DemmyDemon/hardnote/test"
+	"github.com/google/uuid"
+)
+
+func TestRecoveryCode(t *testing.T) {
+	code, err := storage.NewRecoveryCode()
+	test.Result(t, err, "make recovery code", code)
+	test.Compare(t, "recovery code is eight groups of four", 8, len(strings.Split(code, "-")))
+	other, err := storage.NewRecoveryCode()
+	test.Result(t, err, "make other recovery code", other)
+	if code == other {
+		t.Error("two recovery codes came out the same")
+	}
+}
+
+func TestSlots(t *testing.T) {
+	passphrase := []byte("The first of many")
+	for _, backend := range storage.Backends {
+		t.Run(string(backend), func(t *testing.T) {
+			store, filename := storage.OpenTestVault(t, backend, passphrase)
+			entry, _, err := store.Create("Locked up", "Many ways in")
+			test.Result(t, err, "create entry", entry)
+
+			slots, err := store.Slots()
+			test.Result(t, err, "list slots", len(slots))
+			test.Compare(t, "a new vault has a passphrase slot", storage.SlotPassphrase, slots[0].Kind)
+
+			code, err := storage.NewRecoveryCode()
+			test.Result(t, err, "make recovery code", code)
+			recovery, err := store.AddSlot(storage.SlotRecovery, "", []byte(code), nil)
+			test.Result(t, err, "add recovery slot", recovery.Label)
+			keyfile, err := storage.NewKeyfile()
+			test.Result(t, err, "make keyfile", len(keyfile))
+			_, err = store.AddSlot(storage.SlotKeyfile, "usb stick", nil, keyfile)
+			test.Result(t, err, "add keyfile slot")
+			_, err = store.AddSlot(storage.SlotPassphrase, "spouse", []byte("The second of many"), nil)
+			test.Result(t, err, "add passphrase slot")
+
+			for _, refused := range []struct {
+				what     string
+				kind     storage.SlotKind
+				secret   []byte
+				keyfile  []byte
+				expected error
+			}{
+				{"recovery slot without a recovery code", storage.SlotRecovery, []byte("Just a passphrase"), nil, storage.ErrRecoveryCode},
+				{"passphrase slot with an empty passphrase", storage.SlotPassphrase, nil, nil, storage.ErrEmptyPassphrase},
+				{"keyfile slot without a keyfile", storage.SlotKeyfile, nil, nil, storage.ErrKeyfileNeeded},
+			} {
+				if _, err := store.AddSlot(refused.kind, "", refused.secret, refused.keyfile); !errors.Is(err, refused.expected) {
+					t.Fatalf("expected %v adding a %s, got %v", refused.expected, refused.what, err)
+				}
+			}
+			slots, err = store.Slots()
+			test.Result(t, err, "list slots", len(slots))
+			test.Compare(t, "refused slots are not added", 4, len(slots))
+			test.Result(t, store.Close(), "close vault")
+
+			written := strings.ToLower(strings.ReplaceAll(code, "-", " "))
+			for _, way := range []struct {
+				what    string
+				keyText []byte
+				opts    []storage.Option
+			}{
+				{"the first passphrase", passphrase, nil},
+				{"the second passphrase", []byte("The second of many"), nil},
+				{"the recovery code as written down", []byte(written), nil},
+				{"the keyfile alone", nil, []storage.Option{storage.WithKeyfile(keyfile)}},
+			} {
+				store, err := storage.Open(filename, way.keyText, way.opts...)
+				test.Result(t, err, "open with "+way.what)
+				read, err := store.Read(entry.Id)
+				test.Result(t, err, "read entry", read.Text)
+				test.Compare(t, "entry text", entry.Text, read.Text)
+				reopened, err := store.Slots()
+				test.Result(t, err, "list slots", len(reopened))
+				test.Compare(t, "slots survive reopening", slots, reopened)
+				test.Result(t, store.Close(), "close vault")
+			}
+
+			store, err = storage.Open(filename, []byte(code))
+			test.Result(t, err, "open with recovery code")
+			test.Result(t, store.Rekey([]byte("Remembered at last")), "rekey after recovery")
+			rekeyed, err := store.Slots()
+			test.Result(t, err, "list slots", len(rekeyed))
+			test.Compare(t, "rekeying after recovery adds a passphrase slot", 5, len(rekeyed))
+			test.Compare(t, "recovery slot is kept", recovery.Id, rekeyed[1].Id)
+
+			test.Result(t, store.RevokeSlot(recovery.Id), "revoke recovery slot")
+			if err := store.RevokeSlot(recovery.Id); !errors.Is(err, storage.ErrNoSuchSlot) {
+				t.Fatalf("expected %v revoking a slot twice, got %v", storage.ErrNoSuchSlot, err)
+			}
+			for _, slot := range rekeyed[2:] {
+				test.Result(t, store.RevokeSlot(slot.Id), "revoke slot", slot.Label)
+			}
+			if err := store.RevokeSlot(rekeyed[0].Id); !errors.Is(err, storage.ErrLastSlot) {
+				t.Fatalf("expected %v revoking the last slot, got %v", storage.ErrLastSlot, err)
+			}
+			test.Result(t, store.Close(), "close vault")
+
+			_, err = storage.Open(filename, []byte(code))
+			if !errors.Is(err, storage.ErrInvalidKey) {
+				t.Fatalf("expected %v opening with a revoked recovery code, got %v", storage.ErrInvalidKey, err)
+			}
+			_, err = storage.Open(filename, nil, storage.WithKeyfile(keyfile))
+			if !errors.Is(err, storage.ErrInvalidKey) {
+				t.Fatalf("expected %v opening with a revoked keyfile, got %v", storage.ErrInvalidKey, err)
+			}
+			store, err = storage.Open(filename, passphrase)
+			test.Result(t, err, "open with the passphrase that is left")
+			if err := store.RevokeSlot(uuid.New()); !errors.Is(err, storage.ErrNoSuchSlot) {
+				t.Fatalf("expected %v revoking a slot that never was, got %v", storage.ErrNoSuchSlot, err)
+			}
+			test.Result(t, store.Close(), "close vault")
+		})
+	}
+}
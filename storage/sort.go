@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+)
+
+// SortKey is what a listing can be sorted by.
+type SortKey int
+
+const (
+	SortManual SortKey = iota // The order kept by MoveUp and MoveDown
+	SortName
+	SortCreated
+	SortModified
+	SortSize
+)
+
+// SortMode is how a listing is sorted. Sorting never changes the manual order, it only shows the entries differently.
+type SortMode struct {
+	Key        SortKey
+	Descending bool
+}
+
+var sortKeyNames = map[SortKey]string{
+	SortManual:   "manual order",
+	SortName:     "name",
+	SortCreated:  "created",
+	SortModified: "modified",
+	SortSize:     "size",
+}
+
+func (mode SortMode) String() string {
+	name, ok := sortKeyNames[mode.Key]
+	if !ok {
+		name = "unknown"
+	}
+	if mode.Key == SortManual {
+		return name
+	}
+	if mode.Descending {
+		return name + " ↓"
+	}
+	return name + " ↑"
+}
+
+// Next is the mode after this one, going through every key both ascending and descending before coming back to manual.
+func (mode SortMode) Next() SortMode {
+	if mode.Key != SortManual && !mode.Descending {
+		return SortMode{Key: mode.Key, Descending: true}
+	}
+	if mode.Key >= SortSize {
+		return SortMode{Key: SortManual}
+	}
+	return SortMode{Key: mode.Key + 1}
+}
+
+// Sorted is a copy of the index in the given order, with folders before entries unless the order is manual.
+// Entries that sort the same keep their manual order.
+func (idx Index) Sorted(mode SortMode) Index {
+	sorted := slices.Clone(idx)
+	if mode.Key == SortManual {
+		return sorted
+	}
+	slices.SortStableFunc(sorted, func(a, b EntryMeta) int {
+		if a.Folder != b.Folder {
+			if a.Folder {
+				return -1
+			}
+			return 1
+		}
+		var order int
+		switch mode.Key {
+		case SortName:
+			order = cmp.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		case SortCreated:
+			order = a.Created.Compare(b.Created)
+		case SortModified:
+			order = a.Modified.Compare(b.Modified)
+		case SortSize:
+			order = cmp.Compare(a.Size, b.Size)
+		}
+		if mode.Descending {
+			return -order
+		}
+		return order
+	})
+	return sorted
+}
@@ -0,0 +1,56 @@
+package storage_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DemmyDemon/hardnote/storage"
+	"github.com/DemmyDemon/hardnote/test"
+	"github.com/google/uuid"
+)
+
+func TestSorted(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC)
+	}
+	idx := storage.Index{
+		{Name: "banana", Id: uuid.New(), Created: day(3), Modified: day(4), Size: 10},
+		{Name: "Apple", Id: uuid.New(), Created: day(1), Modified: day(5), Size: 30},
+		{Name: "Cherries", Id: uuid.New(), Folder: true, Created: day(9), Modified: day(9)},
+		{Name: "apple", Id: uuid.New(), Created: day(2), Modified: day(6), Size: 20},
+	}
+	names := func(sorted storage.Index) []string {
+		found := []string{}
+		for _, meta := range sorted {
+			found = append(found, meta.Name)
+		}
+		return found
+	}
+
+	tests := []struct {
+		mode storage.SortMode
+		want []string
+	}{
+		{storage.SortMode{Key: storage.SortManual}, []string{"banana", "Apple", "Cherries", "apple"}},
+		{storage.SortMode{Key: storage.SortName}, []string{"Cherries", "Apple", "apple", "banana"}},
+		{storage.SortMode{Key: storage.SortName, Descending: true}, []string{"Cherries", "banana", "Apple", "apple"}},
+		{storage.SortMode{Key: storage.SortCreated}, []string{"Cherries", "Apple", "apple", "banana"}},
+		{storage.SortMode{Key: storage.SortModified, Descending: true}, []string{"Cherries", "apple", "Apple", "banana"}},
+		{storage.SortMode{Key: storage.SortSize}, []string{"Cherries", "banana", "apple", "Apple"}},
+	}
+	for _, tt := range tests {
+		test.Compare(t, "sorted by "+tt.mode.String(), tt.want, names(idx.Sorted(tt.mode)))
+	}
+	test.Compare(t, "sorting leaves the index alone", "banana", idx[0].Name)
+
+	mode := storage.SortMode{}
+	seen := []string{}
+	for range 10 {
+		seen = append(seen, mode.String())
+		mode = mode.Next()
+	}
+	test.Compare(t, "modes cycle", []string{
+		"manual order", "name ↑", "name ↓", "created ↑", "created ↓",
+		"modified ↑", "modified ↓", "size ↑", "size ↓", "manual order",
+	}, seen)
+}
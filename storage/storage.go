@@ -5,35 +5,124 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/gob"
 	"errors"
+	"fmt"
 	"io"
 
 	"github.com/google/uuid"
 )
 
 var (
-	ErrNotImplemented = errors.New("feature not implemented")
-	ErrAlreadyClosed  = errors.New("storage is closed")
-	ErrInvalidStorage = errors.New("invalid storage")
-	ErrInvalidKey     = errors.New("invalid key provided")
-	ErrNoSuchEntry    = errors.New("no such entry")
-	ErrNoIndex        = errors.New("no index present")
+	ErrNotImplemented  = errors.New("feature not implemented")
+	ErrAlreadyClosed   = errors.New("storage is closed")
+	ErrInvalidStorage  = errors.New("invalid storage")
+	ErrInvalidKey      = errors.New("invalid key provided")
+	ErrNoSuchEntry     = errors.New("no such entry")
+	ErrNoIndex         = errors.New("no index present")
+	ErrVaultTooNew     = errors.New("vault is newer than this hardnote")
+	ErrIntegrity       = errors.New("integrity check failed, the vault may have been tampered with")
+	ErrNotAFolder      = errors.New("not a folder")
+	ErrFolderNotEmpty  = errors.New("folder is not empty")
+	ErrFolderLoop      = errors.New("a folder can't be moved into itself")
+	ErrNeedPassphrase  = errors.New("a derived key only opens an existing, upgraded vault, this needs the passphrase")
+	ErrKeyfileNeeded   = errors.New("this vault can only be opened with its keyfile")
+	ErrNoKeyfile       = errors.New("this vault has no keyfile, so none should be given")
+	ErrNoSuchSlot      = errors.New("no such key slot")
+	ErrLastSlot        = errors.New("refusing to revoke the last key slot, nothing could open the vault")
+	ErrEmptyPassphrase = errors.New("refusing to use an empty passphrase")
+	ErrRecoveryCode    = errors.New("not a recovery code")
+	ErrVaultInUse      = errors.New("vault is in use by another hardnote")
 )
 
 type Storage interface {
 	Close() error
+	Rekey(keyText []byte) error
+	Check(repair bool) (CheckReport, error)
+
+	Slots() ([]KeySlot, error)
+	AddSlot(kind SlotKind, label string, secret []byte, keyfile []byte) (KeySlot, error)
+	RevokeSlot(id uuid.UUID) error
 
 	Index() (Index, error)
 	Rename(id uuid.UUID, newName string) (Index, error)
 	MoveUp(id uuid.UUID) (Index, error)
 	MoveDown(id uuid.UUID) (Index, error)
+	Tag(id uuid.UUID, tags []string) (Index, error)
+	Pin(id uuid.UUID, pinned bool) (Index, error)
+	CreateFolder(name string, parent uuid.UUID) (EntryMeta, Index, error)
+	Move(id uuid.UUID, parent uuid.UUID) (Index, error)
 
 	Create(name, initialText string) (Entry, Index, error)
 	Read(id uuid.UUID) (Entry, error)
-	Update(entry Entry) error
+	Peek(id uuid.UUID) (Entry, error)
+	Update(entry Entry) (Index, error)
 	Delete(id uuid.UUID) (Index, error)
+
+	Trash(id uuid.UUID) (Index, error)
+	TrashBin() ([]TrashedEntry, error)
+	Restore(id uuid.UUID) (Index, error)
+	Purge(id uuid.UUID) error
+	EmptyTrash() error
+
+	Batch(ops ...Op) ([]Entry, Index, error)
+	Search(query string) ([]SearchResult, error)
+
+	Revisions(id uuid.UUID) ([]Revision, error)
+	Settings() (Settings, error)
+	UpdateSettings(settings Settings) error
+	SetSort(sort SortMode) error
+}
+
+// Option adjusts how a storage is opened or created.
+type Option func(*options)
+
+type options struct {
+	kdf        *KDF
+	backend    Backend
+	derivedKey []byte
+	keyfile    []byte
+}
+
+// WithKDF sets the key derivation used when creating a new vault, or when upgrading a legacy one.
+// Existing vaults keep the parameters stored in their header.
+func WithKDF(kdf KDF) Option {
+	return func(o *options) {
+		o.kdf = &kdf
+	}
+}
+
+// WithDerivedKey opens an existing vault with the key DeriveKey gave for one of its slots, skipping the key derivation.
+// The passphrase is ignored. A key for a slot that has since been rekeyed or revoked is reported as ErrInvalidKey.
+func WithDerivedKey(key []byte) Option {
+	return func(o *options) {
+		o.derivedKey = key
+	}
+}
+
+// WithKeyfile gives the contents of the keyfile to mix in with the passphrase.
+// A vault created with it needs it to be opened, and keeps needing it when rekeyed.
+func WithKeyfile(keyfile []byte) Option {
+	return func(o *options) {
+		o.keyfile = keyfile
+	}
+}
+
+func collectOptions(opts []Option) options {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// newKDF is the key derivation for a vault that does not have one yet.
+func (o options) newKDF() (KDF, error) {
+	kdf, err := DefaultKDF()
+	if o.kdf != nil {
+		kdf, err = *o.kdf, nil
+	}
+	return kdf.withKeyfile(o.keyfile), err
 }
 
 func Encode(data any) ([]byte, error) {
@@ -50,35 +139,88 @@ func Decode[T any](data []byte, target *T) error {
 	return gob.NewDecoder(&outputBuffer).Decode(target)
 }
 
-func NewGCM(key []byte) (cipher.AEAD, error) {
-	keySum := sha256.Sum256(key)
-	block, err := aes.NewCipher(keySum[:])
+// NewGCM derives the key from the passphrase the legacy way, with a single unsalted SHA-256.
+// Only use this to read vaults that predate the vault header.
+func NewGCM(passphrase []byte) (cipher.AEAD, error) {
+	key, err := LegacyKDF.Derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return NewCipher(key)
+}
+
+// NewCipher sets up AES-GCM for an already derived key.
+func NewCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 	return cipher.NewGCM(block)
 }
 
-func Harden(gcm cipher.AEAD, input any) ([]byte, error) {
+// Harden encodes and encrypts the input, binding it to the associated data.
+// The same associated data must be given to Soften, or it will refuse to decrypt.
+func Harden(gcm cipher.AEAD, input any, ad []byte) ([]byte, error) {
 	data, err := Encode(input)
 	if err != nil {
 		return data, err
 	}
+	return seal(gcm, data, ad)
+}
+
+// Soften decrypts and decodes into the target, if the associated data matches what it was hardened with.
+func Soften[T any](gcm cipher.AEAD, encrypted []byte, target *T, ad []byte) error {
+	data, err := unseal(gcm, encrypted, ad)
+	if err != nil {
+		return err
+	}
+	if err := Decode(data, target); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidStorage, err)
+	}
+	return nil
+}
+
+func seal(gcm cipher.AEAD, data []byte, ad []byte) ([]byte, error) {
 	nonce := make([]byte, gcm.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return []byte{}, err
 	}
-
-	cipher := gcm.Seal(nonce, nonce, data, nil)
-	return cipher, nil
+	return gcm.Seal(nonce, nonce, data, ad), nil
 }
 
-func Soften[T any](gcm cipher.AEAD, encrypted []byte, target *T) error {
+func unseal(gcm cipher.AEAD, encrypted []byte, ad []byte) ([]byte, error) {
+	if len(encrypted) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, fmt.Errorf("%w: sealed value is only %d bytes", ErrInvalidStorage, len(encrypted))
+	}
 	nonce := encrypted[:gcm.NonceSize()]
 	encrypted = encrypted[gcm.NonceSize():]
-	data, err := gcm.Open(nil, nonce, encrypted, nil)
+	data, err := gcm.Open(nil, nonce, encrypted, ad)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("%w: %w: %v", ErrInvalidStorage, ErrIntegrity, err)
 	}
-	return Decode(data, target)
+	return data, nil
+}
+
+// RecordKind tells what a sealed value is, so it can't be passed off as something else.
+type RecordKind string
+
+const (
+	RecordIndex    RecordKind = "index"
+	RecordEntry    RecordKind = "entry"
+	RecordKeyCheck RecordKind = "keycheck"
+	RecordMeta     RecordKind = "meta"
+	RecordRevision RecordKind = "revision"
+	RecordSettings RecordKind = "settings"
+	RecordTrash    RecordKind = "trash"
+	RecordVault    RecordKind = "vault"   // The whole of a sealed vault file
+	RecordSlot     RecordKind = "slot"    // The master key, wrapped in a key slot
+	RecordSlotKey  RecordKind = "slotkey" // The private key of a key slot
+)
+
+// AssociatedData binds a sealed value to the kind of record it is and the key it is stored under.
+func AssociatedData(kind RecordKind, key []byte) []byte {
+	ad := make([]byte, 0, len(kind)+1+len(key))
+	ad = append(ad, kind...)
+	ad = append(ad, 0)
+	return append(ad, key...)
 }
@@ -1,6 +1,9 @@
 package storage_test
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/DemmyDemon/hardnote/storage"
@@ -34,12 +37,173 @@ func TestHardenSoften(t *testing.T) {
 	gcm, err := storage.NewGCM([]byte("obvious-key"))
 	test.Result(t, err, "instantiate GCM")
 
-	babble, err := storage.Harden(gcm, testObject)
+	ad := storage.AssociatedData(storage.RecordEntry, []byte("silly"))
+	babble, err := storage.Harden(gcm, testObject, ad)
 	test.Result(t, err, "hardening", len(babble))
 
 	target := SillyTestType{}
-	err = storage.Soften(gcm, babble, &target)
+	err = storage.Soften(gcm, babble, &target, ad)
 	test.Result(t, err, "softening", target)
 
 	test.Compare(t, "compare initial object to softened data", testObject, target)
+
+	for _, wrong := range [][]byte{
+		nil,
+		storage.AssociatedData(storage.RecordEntry, []byte("serious")),
+		storage.AssociatedData(storage.RecordIndex, []byte("silly")),
+	} {
+		err = storage.Soften(gcm, babble, &SillyTestType{}, wrong)
+		if !errors.Is(err, storage.ErrIntegrity) {
+			t.Errorf("expected %v when softening with associated data %q, got %v", storage.ErrIntegrity, wrong, err)
+		}
+	}
+}
+
+func TestKDF(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+
+	kdf, err := storage.NewKDF(1, 1024, 1)
+	test.Result(t, err, "make KDF", kdf)
+
+	key, err := kdf.Derive(passphrase)
+	test.Result(t, err, "derive key", len(key))
+
+	again, err := kdf.Derive(passphrase)
+	test.Result(t, err, "derive key again", len(again))
+	test.Compare(t, "same salt gives same key", key, again)
+
+	other, err := storage.NewKDF(1, 1024, 1)
+	test.Result(t, err, "make other KDF", other)
+
+	otherKey, err := other.Derive(passphrase)
+	test.Result(t, err, "derive key with other salt", len(otherKey))
+	if string(key) == string(otherKey) {
+		t.Error("different salts gave the same key")
+	}
+
+	_, err = storage.NewCipher(key)
+	test.Result(t, err, "instantiate cipher from derived key")
+}
+
+func TestDerivedKey(t *testing.T) {
+	passphrase := []byte("Derivative work")
+	for _, backend := range storage.Backends {
+		t.Run(string(backend), func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "hardnote.test")
+
+			_, err := storage.Open(filename, nil, storage.WithDerivedKey(make([]byte, 32)))
+			if !errors.Is(err, storage.ErrNeedPassphrase) {
+				t.Fatalf("expected %v creating a vault with a derived key, got %v", storage.ErrNeedPassphrase, err)
+			}
+			if _, err := os.Stat(filename); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("expected no file after refusing to create the vault, got %v", err)
+			}
+
+			kdf := storage.CheapKDF(t)
+			store, err := storage.Open(filename, passphrase, storage.WithKDF(kdf), storage.WithBackend(backend))
+			test.Result(t, err, "create vault", filename)
+			entry, _, err := store.Create("Derived", "Derived text")
+			test.Result(t, err, "create entry", entry)
+			test.Result(t, store.Close(), "close vault")
+
+			key, err := storage.DeriveKey(filename, passphrase)
+			test.Result(t, err, "derive key", len(key))
+			store, err = storage.Open(filename, nil, storage.WithDerivedKey(key))
+			test.Result(t, err, "open with derived key")
+			read, err := store.Read(entry.Id)
+			test.Result(t, err, "read entry", read)
+			test.Compare(t, "entry text", entry.Text, read.Text)
+			test.Result(t, store.Rekey([]byte("Rederived")), "rekey")
+			test.Result(t, store.Close(), "close vault")
+
+			_, err = storage.Open(filename, nil, storage.WithDerivedKey(key))
+			if !errors.Is(err, storage.ErrInvalidKey) {
+				t.Fatalf("expected %v opening with a key derived before rekeying, got %v", storage.ErrInvalidKey, err)
+			}
+			_, err = storage.DeriveKey(filename, passphrase)
+			if !errors.Is(err, storage.ErrInvalidKey) {
+				t.Fatalf("expected %v deriving a key from the old passphrase, got %v", storage.ErrInvalidKey, err)
+			}
+		})
+	}
+}
+
+func TestKeyfile(t *testing.T) {
+	passphrase := []byte("Something you know")
+	keyfile, err := storage.NewKeyfile()
+	test.Result(t, err, "make keyfile", len(keyfile))
+	other, err := storage.NewKeyfile()
+	test.Result(t, err, "make other keyfile", len(other))
+
+	for _, backend := range storage.Backends {
+		t.Run(string(backend), func(t *testing.T) {
+			store, filename := storage.OpenTestVault(t, backend, passphrase, storage.WithKeyfile(keyfile))
+			entry, _, err := store.Create("Something you have", "A keyfile")
+			test.Result(t, err, "create entry", entry)
+			test.Result(t, store.Close(), "close vault")
+
+			for _, refused := range []struct {
+				what     string
+				keyText  []byte
+				keyfile  []byte
+				expected error
+			}{
+				{"without keyfile", passphrase, nil, storage.ErrKeyfileNeeded},
+				{"with the wrong keyfile", passphrase, other, storage.ErrInvalidKey},
+				{"with the wrong passphrase", []byte("Something you forgot"), keyfile, storage.ErrInvalidKey},
+			} {
+				_, err := storage.Open(filename, refused.keyText, storage.WithKeyfile(refused.keyfile))
+				if !errors.Is(err, refused.expected) {
+					t.Fatalf("expected %v opening %s, got %v", refused.expected, refused.what, err)
+				}
+			}
+
+			store, err = storage.Open(filename, passphrase, storage.WithKeyfile(keyfile))
+			test.Result(t, err, "open with keyfile")
+			test.Result(t, store.Rekey([]byte("Something else you know")), "rekey")
+			test.Result(t, store.Close(), "close vault")
+
+			_, err = storage.Open(filename, []byte("Something else you know"))
+			if !errors.Is(err, storage.ErrKeyfileNeeded) {
+				t.Fatalf("expected %v opening without keyfile after rekeying, got %v", storage.ErrKeyfileNeeded, err)
+			}
+			key, err := storage.DeriveKey(filename, []byte("Something else you know"), storage.WithKeyfile(keyfile))
+			test.Result(t, err, "derive key with keyfile", len(key))
+			store, err = storage.Open(filename, nil, storage.WithDerivedKey(key))
+			test.Result(t, err, "open with derived key")
+			read, err := store.Read(entry.Id)
+			test.Result(t, err, "read entry", read)
+			test.Compare(t, "entry text", entry.Text, read.Text)
+			if err := store.Rekey([]byte("Lost the keyfile")); !errors.Is(err, storage.ErrKeyfileNeeded) {
+				t.Fatalf("expected %v rekeying without the keyfile, got %v", storage.ErrKeyfileNeeded, err)
+			}
+			test.Result(t, store.Close(), "close vault")
+
+			store, plain := storage.OpenTestVault(t, backend, passphrase)
+			test.Result(t, store.Close(), "close vault")
+			_, err = storage.Open(plain, passphrase, storage.WithKeyfile(keyfile))
+			if !errors.Is(err, storage.ErrNoKeyfile) {
+				t.Fatalf("expected %v giving a keyfile to a vault without one, got %v", storage.ErrNoKeyfile, err)
+			}
+		})
+	}
+}
+
+func TestVaultInUse(t *testing.T) {
+	passphrase := []byte("One at a time")
+	for _, backend := range storage.Backends {
+		t.Run(string(backend), func(t *testing.T) {
+			store, filename := storage.OpenTestVault(t, backend, passphrase)
+
+			_, err := storage.Open(filename, passphrase)
+			if !errors.Is(err, storage.ErrVaultInUse) {
+				t.Fatalf("expected %v opening a vault that is open already, got %v", storage.ErrVaultInUse, err)
+			}
+			test.Result(t, store.Close(), "close vault")
+
+			store, err = storage.Open(filename, passphrase)
+			test.Result(t, err, "open vault once it is closed")
+			test.Result(t, store.Close(), "close vault")
+		})
+	}
 }
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// TagOp replaces the tags of an entry.
+type TagOp struct {
+	Id   uuid.UUID
+	Tags []string
+}
+
+func (op TagOp) apply(idx Index, target batchTarget) (Index, *Entry, error) {
+	i := idx.position(op.Id)
+	if i < 0 {
+		return idx, nil, ErrNoSuchEntry
+	}
+	idx[i].Tags = NormalizeTags(op.Tags)
+	return idx, nil, nil
+}
+
+// NormalizeTags trims the tags, drops the empty ones and duplicates, and sorts what is left.
+func NormalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			normalized = append(normalized, tag)
+		}
+	}
+	slices.Sort(normalized)
+	normalized = slices.Compact(normalized)
+	if len(normalized) == 0 {
+		return nil
+	}
+	return normalized
+}
+
+// HasTags is true if the entry carries every one of the tags.
+func (meta EntryMeta) HasTags(tags []string) bool {
+	for _, tag := range tags {
+		if _, found := slices.BinarySearch(meta.Tags, tag); !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Tags lists every tag used in the index, sorted.
+func (idx Index) Tags() []string {
+	tags := []string{}
+	for _, meta := range idx {
+		tags = append(tags, meta.Tags...)
+	}
+	slices.Sort(tags)
+	return slices.Compact(tags)
+}
+
+// same is true if the two are identical, tags and all.
+func (meta EntryMeta) same(other EntryMeta) bool {
+	return meta.Name == other.Name && meta.Id == other.Id &&
+		meta.Created.Equal(other.Created) && meta.Modified.Equal(other.Modified) && meta.Opened.Equal(other.Opened) &&
+		slices.Equal(meta.Tags, other.Tags) && meta.Parent == other.Parent && meta.Folder == other.Folder &&
+		meta.Size == other.Size && meta.Pinned == other.Pinned
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TrashedEntry is an entry that was deleted, but can still be restored until it is purged.
+// It keeps its revisions while in the trash.
+type TrashedEntry struct {
+	Meta    EntryMeta
+	Text    string
+	Deleted time.Time
+}
+
+// TrashOp moves an entry from the index to the trash.
+// Folders don't go in the trash, so only empty ones can be trashed, and they are simply removed.
+type TrashOp struct {
+	Id uuid.UUID
+}
+
+// RestoreOp moves an entry from the trash back to the end of the index.
+// If the folder it was in is gone, it goes to the top level.
+type RestoreOp struct {
+	Id uuid.UUID
+}
+
+// PurgeOp removes an entry from the trash for ever, along with its revisions.
+type PurgeOp struct {
+	Id uuid.UUID
+}
+
+func (op TrashOp) apply(idx Index, target batchTarget) (Index, *Entry, error) {
+	i := idx.position(op.Id)
+	if i < 0 {
+		return idx, nil, ErrNoSuchEntry
+	}
+	meta := idx[i]
+	if meta.Folder && idx.hasChildren(meta.Id) {
+		return idx, nil, ErrFolderNotEmpty
+	}
+	idx = append(idx[:i], idx[i+1:]...)
+	if meta.Folder {
+		return idx, nil, nil
+	}
+	return idx, nil, target.trashEntry(meta, timestamp())
+}
+
+func (op RestoreOp) apply(idx Index, target batchTarget) (Index, *Entry, error) {
+	if idx.position(op.Id) >= 0 {
+		return idx, nil, ErrNoSuchEntry // It is not in the trash if it is in the index
+	}
+	meta, err := target.restoreEntry(op.Id)
+	if err != nil {
+		return idx, nil, err
+	}
+	if idx.checkParent(meta.Parent) != nil {
+		meta.Parent = uuid.Nil
+	}
+	return append(idx, meta), nil, nil
+}
+
+func (op PurgeOp) apply(idx Index, target batchTarget) (Index, *Entry, error) {
+	return idx, nil, target.purgeEntry(op.Id)
+}
+
+// trashExpired is true if the entry has been in the trash for longer than the settings allow.
+func (s Settings) trashExpired(trashed TrashedEntry, now time.Time) bool {
+	return s.TrashMaxAge > 0 && now.Sub(trashed.Deleted) > s.TrashMaxAge
+}
@@ -18,6 +18,18 @@ func Ask(question string, answer string, placeholder string, action AskAnswerAct
 	}
 }
 
+// AskSecret is like Ask, except the answer is masked while typing and starts out empty.
+func AskSecret(question string, placeholder string, action AskAnswerAction) tea.Cmd {
+	return func() tea.Msg {
+		return AskRequestMsg{
+			Question:    question,
+			Placeholder: placeholder,
+			Action:      action,
+			Secret:      true,
+		}
+	}
+}
+
 type AskAnswerAction func(answer string) tea.Cmd
 
 type AskRequestMsg struct {
@@ -25,6 +37,7 @@ type AskRequestMsg struct {
 	Answer      string
 	Placeholder string
 	Action      AskAnswerAction
+	Secret      bool
 }
 
 func NewAskScreen() AskScreen {
@@ -61,12 +74,19 @@ func (as AskScreen) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		as.input.SetValue(msg.Answer)
 		as.input.SetCursor(len(msg.Answer))
 		as.input.Placeholder = msg.Placeholder
+		as.input.EchoMode = textinput.EchoNormal
+		if msg.Secret {
+			as.input.EchoMode = textinput.EchoPassword
+		}
 	case tea.KeyMsg:
 		switch msg.String() {
 		case "esc":
 			return as, tea.Batch(UpdateStatus("Aborted question", DirtStateUnchanged), SetUiState(UIStateListing))
 		case "enter":
 			value := as.input.Value()
+			if as.question.Secret {
+				as.input.SetValue("") // Don't keep secrets around longer than needed
+			}
 			if as.question.Action != nil {
 				return as, as.question.Action(value)
 			}
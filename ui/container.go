@@ -17,6 +17,9 @@ const (
 	UIStateEditing
 	UIStatePicking
 	UIStateAsking
+	UIStateRevisions
+	UIStateTrash
+	UIStateSearching
 )
 
 type UI struct {
@@ -27,6 +30,9 @@ type UI struct {
 	edit      tea.Model
 	pick      tea.Model
 	ask       tea.Model
+	revisions tea.Model
+	trash     tea.Model
+	search    tea.Model
 	statusbar tea.Model
 	data      storage.Storage
 }
@@ -46,6 +52,9 @@ func New(name string, data storage.Storage) tea.Model {
 		edit:      NewEditScreen(data),
 		pick:      NewPickOneScreen(),
 		ask:       NewAskScreen(),
+		revisions: NewRevisionScreen(data),
+		trash:     NewTrashScreen(data),
+		search:    NewSearchScreen(data),
 		statusbar: NewStatusbar(name),
 		data:      data,
 	}
@@ -71,7 +80,7 @@ func (ui UI) Init() tea.Cmd {
 
 func (ui UI) Distribute(msg tea.Msg) (tea.Model, tea.Cmd) {
 
-	commands := make([]tea.Cmd, 0, 7) // Initialize capacity to the number of models, including status bar
+	commands := make([]tea.Cmd, 0, 10) // Initialize capacity to the number of models, including status bar
 
 	helpModel, helpCmd := ui.help.Update(msg)
 	ui.help = helpModel
@@ -93,6 +102,18 @@ func (ui UI) Distribute(msg tea.Msg) (tea.Model, tea.Cmd) {
 	ui.ask = askModel
 	commands = append(commands, askCmd)
 
+	revisionsModel, revisionsCmd := ui.revisions.Update(msg)
+	ui.revisions = revisionsModel
+	commands = append(commands, revisionsCmd)
+
+	trashModel, trashCmd := ui.trash.Update(msg)
+	ui.trash = trashModel
+	commands = append(commands, trashCmd)
+
+	searchModel, searchCmd := ui.search.Update(msg)
+	ui.search = searchModel
+	commands = append(commands, searchCmd)
+
 	statusModel, statusCmd := ui.statusbar.Update(msg)
 	ui.statusbar = statusModel
 	commands = append(commands, statusCmd)
@@ -132,6 +153,24 @@ func (ui UI) ToCurrent(msg tea.Msg) (tea.Model, tea.Cmd) {
 		if askCmd != nil {
 			return ui, askCmd
 		}
+	case UIStateRevisions:
+		revisionsModel, revisionsCmd := ui.revisions.Update(msg)
+		ui.revisions = revisionsModel
+		if revisionsCmd != nil {
+			return ui, revisionsCmd
+		}
+	case UIStateTrash:
+		trashModel, trashCmd := ui.trash.Update(msg)
+		ui.trash = trashModel
+		if trashCmd != nil {
+			return ui, trashCmd
+		}
+	case UIStateSearching:
+		searchModel, searchCmd := ui.search.Update(msg)
+		ui.search = searchModel
+		if searchCmd != nil {
+			return ui, searchCmd
+		}
 	default:
 		return ui, UpdateStatus(fmt.Sprintf("INVALID STATE %d", ui.state), DirtStateUnchanged)
 	}
@@ -159,7 +198,13 @@ func (ui UI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		ui.state = UIStateEditing
 	case AskRequestMsg:
 		ui.state = UIStateAsking
-	case IndexUpdateMsg:
+	case RevisionsRequestMsg:
+		ui.state = UIStateRevisions
+	case TrashRequestMsg:
+		ui.state = UIStateTrash
+	case SearchRequestMsg:
+		ui.state = UIStateSearching
+	case IndexUpdateMsg, TagFilterMsg:
 		model, cmd := ui.list.Update(msg)
 		ui.list = model
 		return ui, cmd
@@ -178,6 +223,12 @@ func (ui UI) View() string {
 		s = ui.pick.View()
 	case UIStateAsking:
 		s = ui.ask.View()
+	case UIStateRevisions:
+		s = ui.revisions.View()
+	case UIStateTrash:
+		s = ui.trash.View()
+	case UIStateSearching:
+		s = ui.search.View()
 	default:
 		s = ui.help.View()
 	}
@@ -0,0 +1,95 @@
+package ui
+
+import "strings"
+
+// diffCellLimit caps the work done comparing the changed middle of two texts.
+// Past it, the whole middle is shown as removed and then added, rather than grinding to a halt.
+const diffCellLimit = 4_000_000
+
+type diffKind int
+
+const (
+	diffSame diffKind = iota
+	diffRemoved
+	diffAdded
+)
+
+type diffLine struct {
+	kind diffKind
+	text string
+}
+
+// diffLines works out which lines to remove from before, and which to add, to end up with after.
+func diffLines(before, after string) []diffLine {
+	a := strings.Split(before, "\n")
+	b := strings.Split(after, "\n")
+
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	lines := make([]diffLine, 0, len(a)+len(b))
+	for _, text := range a[:prefix] {
+		lines = append(lines, diffLine{diffSame, text})
+	}
+	lines = append(lines, diffMiddle(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, text := range a[len(a)-suffix:] {
+		lines = append(lines, diffLine{diffSame, text})
+	}
+	return lines
+}
+
+// diffMiddle is a plain longest common subsequence diff.
+func diffMiddle(a, b []string) []diffLine {
+	lines := make([]diffLine, 0, len(a)+len(b))
+	if len(a)*len(b) > diffCellLimit {
+		for _, text := range a {
+			lines = append(lines, diffLine{diffRemoved, text})
+		}
+		for _, text := range b {
+			lines = append(lines, diffLine{diffAdded, text})
+		}
+		return lines
+	}
+
+	// common[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	width := len(b) + 1
+	common := make([]int, (len(a)+1)*width)
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i*width+j] = common[(i+1)*width+j+1] + 1
+			} else {
+				common[i*width+j] = max(common[(i+1)*width+j], common[i*width+j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, diffLine{diffSame, a[i]})
+			i++
+			j++
+		case common[(i+1)*width+j] >= common[i*width+j+1]:
+			lines = append(lines, diffLine{diffRemoved, a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{diffAdded, b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, diffLine{diffRemoved, a[i]})
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, diffLine{diffAdded, b[j]})
+	}
+	return lines
+}
@@ -11,6 +11,8 @@ import (
 
 type EditRequestMsg struct {
 	EntryMeta storage.EntryMeta
+	Line      int // Where to put the cursor, counting from 0
+	Column    int
 }
 
 func RequestEdit(entryMeta storage.EntryMeta) tea.Cmd {
@@ -21,6 +23,17 @@ func RequestEdit(entryMeta storage.EntryMeta) tea.Cmd {
 	}
 }
 
+// RequestEditAt is like RequestEdit, but starts with the cursor at the given line and column.
+func RequestEditAt(entryMeta storage.EntryMeta, line int, column int) tea.Cmd {
+	return func() tea.Msg {
+		return EditRequestMsg{
+			EntryMeta: entryMeta,
+			Line:      line,
+			Column:    column,
+		}
+	}
+}
+
 func NewEditScreen(data storage.Storage) EditScreen {
 	ta := textarea.New()
 	ta.Prompt = " │ "
@@ -39,7 +52,7 @@ type EditScreen struct {
 	width  int
 	store  storage.Storage
 	entry  storage.Entry
-	name   string
+	meta   storage.EntryMeta
 	text   textarea.Model
 }
 
@@ -48,12 +61,31 @@ func (es EditScreen) Init() tea.Cmd {
 }
 
 func (es EditScreen) Name() string {
-	if es.name != "" {
-		return es.name
+	if es.meta.Name != "" {
+		return es.meta.Name
 	}
 	return "Untitled"
 }
 
+// refreshMeta picks up the timestamps of the entry being edited from a fresh index, and passes the index on.
+func (es *EditScreen) refreshMeta(idx storage.Index) tea.Cmd {
+	for _, meta := range idx {
+		if meta.Id == es.meta.Id {
+			es.meta = meta
+		}
+	}
+	return UpdateIndex(idx)
+}
+
+func (es *EditScreen) save() (tea.Cmd, error) {
+	es.entry.Text = es.text.Value()
+	idx, err := es.store.Update(es.entry)
+	if err != nil {
+		return nil, err
+	}
+	return es.refreshMeta(idx), nil
+}
+
 func (es *EditScreen) cursorToBeginningFoulSmellingHack() {
 	for es.text.Line() > 0 {
 		es.text.CursorUp()
@@ -61,6 +93,22 @@ func (es *EditScreen) cursorToBeginningFoulSmellingHack() {
 	es.text.CursorStart()
 }
 
+// cursorTo moves the cursor from the beginning down to the line, and then along to the column.
+func (es *EditScreen) cursorTo(line int, column int) {
+	for es.text.Line() < line {
+		before := es.text.Line()
+		es.text.CursorDown()
+		for es.text.Line() == before { // Soft wrapped lines take more than one step
+			previous := es.text.LineInfo().RowOffset
+			es.text.CursorDown()
+			if es.text.Line() == before && es.text.LineInfo().RowOffset == previous {
+				return // Nowhere further down to go
+			}
+		}
+	}
+	es.text.SetCursor(column)
+}
+
 func (es EditScreen) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var passCmd tea.Cmd
 	switch msg := msg.(type) {
@@ -69,29 +117,52 @@ func (es EditScreen) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		if err != nil {
 			return es, tea.Batch(UpdateStatus(err.Error(), DirtStateUnchanged), SetUiState(UIStateListing))
 		}
-		es.name = msg.EntryMeta.Name
+		es.meta = msg.EntryMeta
 		es.entry = entry
 		es.text.SetValue(entry.Text)
 		es.cursorToBeginningFoulSmellingHack()
-		return es, tea.Batch(UpdateStatus(fmt.Sprintf("Loaded %q", msg.EntryMeta.Name), DirtStateClean), UpdateStatusName(es.Name()))
+		es.cursorTo(msg.Line, msg.Column)
+		idx, err := es.store.Index()
+		if err != nil {
+			return es, UpdateStatus(err.Error(), DirtStateUnchanged)
+		}
+		return es, tea.Batch(
+			UpdateStatus(fmt.Sprintf("Loaded %q", msg.EntryMeta.Name), DirtStateClean),
+			UpdateStatusName(es.Name()),
+			es.refreshMeta(idx),
+		)
 	case tea.KeyMsg:
 		switch msg.String() {
 		case "ctrl+q", "ctrl+h", "ctrl+l", "\x00": // Noop, let statusbar handle
 		case "up", "down", "left", "right", "home", "end", "ctrl+home", "ctrl+end": // Noop, does not change value
 		case "ctrl+s":
-			es.entry.Text = es.text.Value()
-			err := es.store.Update(es.entry)
+			refresh, err := es.save()
 			if err != nil {
 				return es, UpdateStatus(err.Error(), DirtStateUnchanged)
 			}
-			return es, UpdateStatus("Saved!", DirtStateClean)
+			return es, tea.Batch(UpdateStatus("Saved!", DirtStateClean), refresh)
 		case "ctrl+d":
-			es.entry.Text = es.text.Value()
-			err := es.store.Update(es.entry)
+			refresh, err := es.save()
+			if err != nil {
+				return es, UpdateStatus(err.Error(), DirtStateUnchanged)
+			}
+			return es, tea.Batch(SetUiState(UIStateListing), UpdateStatus(es.meta.Name+" saved!", DirtStateClean), refresh)
+		case "ctrl+o":
+			if es.text.Value() != es.entry.Text {
+				return es, UpdateStatus("Save or revert before looking at revisions!", DirtStateDirty)
+			}
+			return es, RequestRevisions(es.meta)
+		case "ctrl+g":
+			if es.text.Value() != es.entry.Text {
+				return es, UpdateStatus("Save or revert before switching notes!", DirtStateDirty)
+			}
+			idx, err := es.store.Index()
 			if err != nil {
 				return es, UpdateStatus(err.Error(), DirtStateUnchanged)
 			}
-			return es, tea.Batch(SetUiState(UIStateListing), UpdateStatus(es.name+" saved!", DirtStateClean))
+			return es, switchPinned(idx)
+		case "ctrl+t":
+			return es, editTags(es.store, es.meta, UIStateEditing)
 		case "ctrl+u":
 			es.text.SetValue(es.entry.Text)
 			es.cursorToBeginningFoulSmellingHack()
@@ -118,5 +189,9 @@ func (es EditScreen) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 func (es EditScreen) View() string {
 	info := es.text.LineInfo()
-	return unifiedHeader(fmt.Sprintf("%d:%d", es.text.Line()+1, info.CharOffset+info.StartColumn), es.width) + es.text.View()
+	title := fmt.Sprintf("%d:%d ╞═╡ created %s ╞═╡ modified %s",
+		es.text.Line()+1, info.CharOffset+info.StartColumn,
+		timestamp(es.meta.Created), timestamp(es.meta.Modified),
+	)
+	return unifiedHeader(title, es.width) + es.text.View()
 }
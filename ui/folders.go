@@ -0,0 +1,104 @@
+package ui
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/DemmyDemon/hardnote/storage"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/google/uuid"
+)
+
+const topLevelName = "Top level"
+
+// breadcrumb shows the way to a folder, from the top level down.
+func breadcrumb(path storage.Index) string {
+	names := []string{topLevelName}
+	for _, folder := range path {
+		names = append(names, folder.Name)
+	}
+	return strings.Join(names, " › ")
+}
+
+// pickFolder offers every folder the entry could be moved to, and moves it there.
+func pickFolder(store storage.Storage, idx storage.Index, entryMeta storage.EntryMeta) tea.Cmd {
+	options := []string{topLevelName}
+	targets := []uuid.UUID{uuid.Nil}
+	for _, meta := range idx {
+		if !meta.Folder {
+			continue
+		}
+		path := idx.Path(meta.Id)
+		inside := false
+		for _, folder := range path {
+			inside = inside || folder.Id == entryMeta.Id
+		}
+		if inside {
+			continue // A folder can't be moved into itself
+		}
+		options = append(options, breadcrumb(path))
+		targets = append(targets, meta.Id)
+	}
+	return PickOne(
+		fmt.Sprintf("Move %q to which folder?", entryMeta.Name),
+		options,
+		func(selected int) tea.Cmd {
+			idx, err := store.Move(entryMeta.Id, targets[selected])
+			if err != nil {
+				return tea.Batch(UpdateStatus(err.Error(), DirtStateUnchanged), SetUiState(UIStateListing))
+			}
+			return tea.Batch(
+				UpdateIndex(idx),
+				SetUiState(UIStateListing),
+				UpdateStatus(fmt.Sprintf("Moved %s to %s", entryMeta.Name, options[selected]), DirtStateUnchanged),
+			)
+		},
+	)
+}
+
+// switchPinned offers every pinned note in the vault, wherever it is, and opens the one picked.
+func switchPinned(idx storage.Index) tea.Cmd {
+	pinned := idx.Pinned()
+	if len(pinned) == 0 {
+		return UpdateStatus("Nothing is pinned. Press p in the listing to pin a note.", DirtStateUnchanged)
+	}
+	options := make([]string, len(pinned))
+	for i, meta := range pinned {
+		options[i] = meta.Name
+		if meta.Parent != uuid.Nil {
+			options[i] = breadcrumb(idx.Path(meta.Parent)) + " › " + meta.Name
+		}
+	}
+	return PickOne(
+		"Open which pinned note?",
+		options,
+		func(selected int) tea.Cmd {
+			return RequestEdit(pinned[selected])
+		},
+	)
+}
+
+// exportFolder asks for a directory to write the folder to, one file per entry and one directory per folder.
+func exportFolder(store storage.Storage, idx storage.Index, folder storage.EntryMeta) tea.Cmd {
+	dirname := storage.SafeName(folder.Name)
+	if wd, err := os.Getwd(); err == nil {
+		dirname = filepath.Join(wd, dirname)
+	}
+	return Ask(
+		"Where do you want to export the folder?",
+		dirname,
+		"Enter a directory name that doesn't exist yet",
+		func(dirname string) tea.Cmd {
+			count, err := storage.WriteFolder(store, idx, folder.Id, dirname)
+			if err != nil {
+				return tea.Batch(UpdateStatus(err.Error(), DirtStateUnchanged), SetUiState(UIStateListing))
+			}
+			return tea.Batch(
+				UpdateStatus(fmt.Sprintf("Exported %d entries!", count), DirtStateUnchanged),
+				SetUiState(UIStateListing),
+			)
+		},
+	)
+}
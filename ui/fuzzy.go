@@ -0,0 +1,122 @@
+package ui
+
+import (
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// unmatched marks where the pattern so far can't end, in the scores fuzzyMatch works out.
+const unmatched = math.MinInt32
+
+// fuzzyMatch finds the runes of the pattern in the text, in order but not necessarily next to each other, ignoring case.
+// It returns the rune positions they were found at, and a score where higher is better, or false if they aren't all there.
+// Of all the places the pattern can be found at, it picks those with the best score, so runs of runes and word starts win.
+func fuzzyMatch(pattern string, text string) ([]int, int, bool) {
+	want := foldRunes(pattern)
+	runes := foldRunes(text)
+	if len(want) == 0 {
+		return []int{}, 0, true
+	}
+
+	// best[j][i] is the best score for the pattern up to rune j, with rune j found at position i,
+	// and from[j][i] is where rune j-1 was found for that score.
+	best := make([][]int, len(want))
+	from := make([][]int, len(want))
+	for j := range want {
+		best[j] = make([]int, len(runes))
+		from[j] = make([]int, len(runes))
+		far, farAt := unmatched, -1 // Best place for rune j-1 at least four runes back, where a gap costs the most
+		for i, r := range runes {
+			best[j][i] = unmatched
+			if j > 0 && i >= 4 && best[j-1][i-4] > far {
+				far, farAt = best[j-1][i-4], i-4
+			}
+			if r != want[j] {
+				continue
+			}
+			score := 1
+			if i == 0 || !unicode.IsLetter(runes[i-1]) && !unicode.IsDigit(runes[i-1]) {
+				score += 2 // Matches at the start of words are better
+			}
+			if j == 0 {
+				best[j][i] = score
+				continue
+			}
+			previous, at := unmatched, -1
+			if farAt >= 0 {
+				previous, at = far-3, farAt
+			}
+			for gap, bonus := range []int{3, -1, -2} { // Runs of matching runes are better than scattered ones
+				p := i - 1 - gap
+				if p >= 0 && best[j-1][p] != unmatched && best[j-1][p]+bonus > previous {
+					previous, at = best[j-1][p]+bonus, p
+				}
+			}
+			if at >= 0 {
+				best[j][i] = previous + score
+				from[j][i] = at
+			}
+		}
+	}
+
+	last := len(want) - 1
+	end := -1
+	for i := range runes {
+		if best[last][i] != unmatched && (end < 0 || best[last][i] > best[last][end]) {
+			end = i
+		}
+	}
+	if end < 0 {
+		return nil, 0, false
+	}
+	positions := make([]int, len(want))
+	for j, i := last, end; j >= 0; j-- {
+		positions[j] = i
+		i = from[j][i]
+	}
+	return positions, best[last][end], true
+}
+
+// foldRunes lowers the case of every rune on its own, so the positions stay those of the runes in the text.
+func foldRunes(text string) []rune {
+	runes := []rune(text)
+	for i, r := range runes {
+		runes[i] = unicode.ToLower(r)
+	}
+	return runes
+}
+
+// highlightRunes renders the text with the runes at the given positions picked out.
+// Every rune is styled, so the text can go inside another style without losing its colours after a highlight.
+func highlightRunes(text string, positions []int, base lipgloss.Style, highlight lipgloss.Style) string {
+	picked := make(map[int]bool, len(positions))
+	for _, position := range positions {
+		picked[position] = true
+	}
+	var sb strings.Builder
+	var run []rune
+	runPicked := false
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		if runPicked {
+			sb.WriteString(highlight.Render(string(run)))
+		} else {
+			sb.WriteString(base.Render(string(run)))
+		}
+		run = run[:0]
+	}
+	for i, r := range []rune(text) {
+		if picked[i] != runPicked {
+			flush()
+			runPicked = picked[i]
+		}
+		run = append(run, r)
+	}
+	flush()
+	return sb.String()
+}
@@ -0,0 +1,48 @@
+package ui
+
+import (
+	"testing"
+
+	"github.com/DemmyDemon/hardnote/test"
+)
+
+func TestFuzzyMatch(t *testing.T) {
+	for _, match := range []struct {
+		pattern   string
+		text      string
+		positions []int
+		score     int
+		ok        bool
+	}{
+		{"", "Anything at all", []int{}, 0, true},
+		{"", "", []int{}, 0, true},
+		{"AB", "abc", []int{0, 1}, 7, true},
+		{"ab", "ABC", []int{0, 1}, 7, true},
+		{"abd", "abc", nil, 0, false},
+		{"ba", "ab", nil, 0, false},
+		{"abc", "ab", nil, 0, false},
+		{"a", "", nil, 0, false},
+		{"ø", "Smørbrød", []int{2}, 1, true},
+		{"ØL", "øl", []int{0, 1}, 7, true},
+		{"x", "İx", []int{1}, 1, true},
+		{"ab", "a_xab", []int{3, 4}, 5, true},
+		{"b", "abc_b", []int{4}, 3, true},
+		{"ab", "a_b", []int{0, 2}, 5, true},
+		{"ab", "axxxxb", []int{0, 5}, 1, true},
+	} {
+		positions, score, ok := fuzzyMatch(match.pattern, match.text)
+		context := match.pattern + " in " + match.text
+		test.Compare(t, context+" is found", match.ok, ok)
+		test.Compare(t, context+" positions", match.positions, positions)
+		test.Compare(t, context+" score", match.score, score)
+	}
+
+	ranked := []string{"abc", "a_b", "axxxxb"}
+	for i := 1; i < len(ranked); i++ {
+		_, better, _ := fuzzyMatch("ab", ranked[i-1])
+		_, worse, _ := fuzzyMatch("ab", ranked[i])
+		if better <= worse {
+			t.Errorf("expected ab to score higher in %q than in %q, got %d and %d", ranked[i-1], ranked[i], better, worse)
+		}
+	}
+}
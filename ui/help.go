@@ -19,21 +19,58 @@ var defaultHelpText = []string{
 	"",
 	"Listing keys:",
 	"  ↑ and ↓   navigates the list.",
-	"  alt+↑     moves entry up",
-	"  alt+↓     moves entry down",
-	"  enter     loads the selected entry into the editor",
+	"  /         narrows the list to names matching what you type, enter opens the top match",
+	"  alt+↑     moves entry up within its folder, when in manual order",
+	"  alt+↓     moves entry down within its folder, when in manual order",
+	"  s         sorts by name, created, modified or size, each up and down, or back to manual order",
+	"  enter     loads the selected entry into the editor, or opens the selected folder",
+	"  →         opens the selected folder",
+	"  ←         goes back out of the current folder",
 	"  r         renames the selected entry",
 	"  n         creates a new entry",
-	"  d         deletes the selected entry",
-	"  ctrl+e    exports a plain text file of the selected note",
-	"  ctrl+r    reads an entry from a plain text file",
-	"  esc       exits HardNote",
+	"  N         creates a new folder",
+	"  m         moves the selected entry or folder to another folder",
+	"  p         pins or unpins the selected note, keeping it at the top",
+	"  P         quickly switches to one of the pinned notes",
+	"  d         moves the selected entry to the trash, or removes an empty folder",
+	"  t         opens the trash",
+	"  ctrl+f    searches the text of every note",
+	"  #         edits the tags of the selected entry",
+	"  f         shows only entries with all of the given tags, or everything if none are given",
+	"  ctrl+e    exports a plain text file of the selected note, or a directory of the selected folder",
+	"  ctrl+o    shows the earlier revisions of the selected note",
+	"  ctrl+r    reads an entry from a plain text file, or one per file in a directory",
+	"  ctrl+p    changes the passphrase of the vault",
+	"  ctrl+k    checks the vault for problems, offering to repair them",
+	"  esc       shows everything again after narrowing the list with /, or exits HardNote",
 	"",
 	"Editor keys:",
 	"  ctrl+s    saves the current note",
 	"  ctrl+d    saves the current note, and opens the listing",
 	"  ctrl+u    discards the changes to the current note",
+	"  ctrl+o    shows the earlier revisions of the current note, if it is saved",
+	"  ctrl+t    edits the tags of the current note",
+	"  ctrl+g    quickly switches to one of the pinned notes, if the current note is saved",
 	"  ctrl+l    opens the listing, if the current note is saved",
+	"",
+	"Revision keys:",
+	"  ↑ and ↓   selects a revision, showing what changed since",
+	"  pgup/pgdn scrolls the changes",
+	"  enter     restores the selected revision, keeping the current text as a revision",
+	"  r         sets how many revisions are kept, and for how long",
+	"  esc       opens the listing",
+	"",
+	"Search keys:",
+	"  ↑ and ↓   selects a match",
+	"  enter     opens the note with the cursor at the selected match",
+	"  esc       opens the listing",
+	"",
+	"Trash keys:",
+	"  enter     restores the selected entry, putting it last in the listing",
+	"  d         deletes the selected entry for ever",
+	"  e         empties the trash, deleting everything in it for ever",
+	"  a         sets how many days entries stay in the trash before they are deleted",
+	"  esc       opens the listing",
 }
 
 func NewHelpScreen() HelpScreen {
@@ -1,21 +1,25 @@
 package ui
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"regexp"
+	"slices"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/DemmyDemon/hardnote/storage"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
+	"github.com/google/uuid"
 )
 
 const readSizeLimit = 3 * 1024 * 1024 // 3MiB
 
-var nonWordChars = regexp.MustCompile(`[^\\w]+`)
+const pinMarker = "★ "
 
 var listStyleSelected = lipgloss.NewStyle().
 	Background(lipgloss.Color("15")).
@@ -47,10 +51,17 @@ func NewListScreen(data storage.Storage) ListScreen {
 	if err != nil {
 		panic(err) // This is astronomically unlikely.
 	}
-	return ListScreen{
+	settings, err := data.Settings()
+	if err != nil {
+		panic(err) // Just as unlikely, as the settings are read when unlocking.
+	}
+	ls := ListScreen{
 		index: idx,
 		store: data,
+		sort:  settings.Sort,
 	}
+	ls.refilter()
+	return ls
 }
 
 type ListScreen struct {
@@ -59,14 +70,128 @@ type ListScreen struct {
 	cursor int
 	store  storage.Storage
 	index  storage.Index
+	folder uuid.UUID           // The folder being shown, or uuid.Nil for the top level
+	filter []string            // Only entries with all of these tags are shown, from every folder
+	query  string              // Only entries with names fuzzily matching this are shown, best match first
+	typing bool                // Keys go to the query rather than being actions
+	found  map[uuid.UUID][]int // Where the query matched each shown name, in runes
+	sort   storage.SortMode
+	pinned int           // How many of the shown entries are pinned, and at the top
+	shown  storage.Index // The entries that pass the filter, which is what the cursor moves through
 }
 
 func (ls ListScreen) Init() tea.Cmd {
 	return nil
 }
 
+// refilter works out which entries to show, keeping the cursor within them.
+func (ls *ListScreen) refilter() {
+	if len(ls.index.Path(ls.folder)) == 0 {
+		ls.folder = uuid.Nil // The folder being shown is gone
+	}
+	ls.shown = ls.index.Children(ls.folder)
+	if len(ls.filter) > 0 {
+		ls.shown = storage.Index{}
+		for _, meta := range ls.index {
+			if !meta.Folder && meta.HasTags(ls.filter) {
+				ls.shown = append(ls.shown, meta)
+			}
+		}
+	}
+	ls.shown = ls.shown.Sorted(ls.sort)
+	ls.pinned = 0
+	if ls.query == "" {
+		pinned := ls.shown.Pinned()
+		ls.pinned = len(pinned)
+		if ls.pinned > 0 {
+			ls.shown = append(pinned, slices.DeleteFunc(ls.shown, func(meta storage.EntryMeta) bool {
+				return meta.Pinned
+			})...)
+		}
+	}
+	ls.found = nil
+	if ls.query != "" {
+		ls.found = map[uuid.UUID][]int{}
+		scores := map[uuid.UUID]int{}
+		narrowed := storage.Index{}
+		for _, meta := range ls.shown {
+			if positions, score, ok := fuzzyMatch(ls.query, meta.Name); ok {
+				ls.found[meta.Id] = positions
+				scores[meta.Id] = score
+				narrowed = append(narrowed, meta)
+			}
+		}
+		slices.SortStableFunc(narrowed, func(a, b storage.EntryMeta) int {
+			return cmp.Compare(scores[b.Id], scores[a.Id])
+		})
+		ls.shown = narrowed
+	}
+	ls.cursor = max(0, min(ls.cursor, len(ls.shown)-1))
+}
+
+// narrow changes the query, starting over from the best match.
+func (ls *ListScreen) narrow(query string) {
+	ls.query = query
+	ls.cursor = 0
+	ls.refilter()
+}
+
+// typeQuery handles the keys while typing in the query, so they don't trigger actions.
+func (ls ListScreen) typeQuery(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEsc:
+		ls.typing = false
+		ls.narrow("")
+	case tea.KeyEnter:
+		ls.typing = false
+		entryMeta, ok := ls.selected()
+		if ok && entryMeta.Folder {
+			ls.enter(entryMeta.Id)
+		} else if ok {
+			return ls, RequestEdit(entryMeta)
+		}
+	case tea.KeyBackspace:
+		runes := []rune(ls.query)
+		if len(runes) > 0 {
+			ls.narrow(string(runes[:len(runes)-1]))
+		}
+	case tea.KeyUp:
+		ls.moveCursorUp()
+	case tea.KeyDown:
+		ls.moveCursorDown()
+	case tea.KeyRunes, tea.KeySpace:
+		ls.narrow(ls.query + string(msg.Runes))
+	}
+	return ls, nil
+}
+
+// enter shows what is in the folder.
+func (ls *ListScreen) enter(folder uuid.UUID) {
+	ls.folder = folder
+	ls.query = ""
+	ls.cursor = 0
+	ls.refilter()
+}
+
+// follow puts the cursor on the entry, if it is shown.
+func (ls *ListScreen) follow(id uuid.UUID) {
+	for i, meta := range ls.shown {
+		if meta.Id == id {
+			ls.cursor = i
+		}
+	}
+}
+
+// selected is the entry under the cursor, if there is one.
+func (ls ListScreen) selected() (storage.EntryMeta, bool) {
+	if ls.cursor < 0 || ls.cursor >= len(ls.shown) {
+		return storage.EntryMeta{}, false
+	}
+	return ls.shown[ls.cursor], true
+}
+
 func (ls *ListScreen) moveCursorUp() {
-	if len(ls.index) == 0 {
+	if len(ls.shown) == 0 {
 		return
 	}
 	ls.cursor--
@@ -76,47 +201,94 @@ func (ls *ListScreen) moveCursorUp() {
 }
 
 func (ls *ListScreen) moveCursorDown() {
-	if len(ls.index) == 0 {
+	if len(ls.shown) == 0 {
 		return
 	}
 	ls.cursor++
-	if ls.cursor >= len(ls.index) {
-		ls.cursor = len(ls.index) - 1
+	if ls.cursor >= len(ls.shown) {
+		ls.cursor = len(ls.shown) - 1
 	}
 }
 
 func (ls ListScreen) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
+		if ls.typing {
+			return ls.typeQuery(msg)
+		}
 		switch msg.String() {
 		case "esc":
+			if ls.query != "" {
+				ls.narrow("")
+				return ls, nil
+			}
 			return ls, tea.Quit
+		case "/":
+			ls.typing = true
+			return ls, nil
+		case "s":
+			sort := ls.sort.Next()
+			if err := ls.store.SetSort(sort); err != nil {
+				return ls, UpdateStatus(err.Error(), DirtStateUnchanged)
+			}
+			entryMeta, _ := ls.selected()
+			ls.sort = sort
+			ls.refilter()
+			ls.follow(entryMeta.Id)
+			return ls, UpdateStatus("Sorted by "+ls.sort.String(), DirtStateUnchanged)
+		case "left", "backspace":
+			if ls.folder == uuid.Nil || len(ls.filter) > 0 {
+				return ls, nil
+			}
+			left := ls.folder
+			parent := uuid.Nil
+			if path := ls.index.Path(left); len(path) > 0 {
+				parent = path[len(path)-1].Parent
+			}
+			ls.enter(parent)
+			ls.follow(left)
+			return ls, nil
+		case "right":
+			if entryMeta, ok := ls.selected(); ok && entryMeta.Folder {
+				ls.enter(entryMeta.Id)
+			}
+			return ls, nil
 		case "up":
 			ls.moveCursorUp()
 			return ls, nil // UpdateStatus(fmt.Sprintf("[up] c:%d o: %d", ls.cursor, ls.offset), DirtStateUnchanged)
 		case "down":
 			ls.moveCursorDown()
 			return ls, nil // UpdateStatus(fmt.Sprintf("[down] c:%d o: %d", ls.cursor, ls.offset), DirtStateUnchanged)
-		case "alt+up":
-			idx, err := ls.store.MoveUp(ls.index[ls.cursor].Id)
-			if err != nil {
-				return ls, UpdateStatus(err.Error(), DirtStateUnchanged)
+		case "alt+up", "alt+down":
+			entryMeta, ok := ls.selected()
+			if !ok {
+				return ls, nil
 			}
-			ls.moveCursorUp()
-			return ls, UpdateIndex(idx)
-		case "alt+down":
-			idx, err := ls.store.MoveDown(ls.index[ls.cursor].Id)
+			if ls.sort.Key != storage.SortManual {
+				return ls, UpdateStatus("Press s until the listing is in manual order to move entries.", DirtStateUnchanged)
+			}
+			move := ls.store.MoveUp
+			if msg.String() == "alt+down" {
+				move = ls.store.MoveDown
+			}
+			idx, err := move(entryMeta.Id)
 			if err != nil {
 				return ls, UpdateStatus(err.Error(), DirtStateUnchanged)
 			}
-			ls.moveCursorDown()
+			ls.index = idx
+			ls.refilter()
+			ls.follow(entryMeta.Id)
 			return ls, UpdateIndex(idx)
 		case "n":
-			entry, idx, err := ls.store.Create("", "")
+			created, idx, err := ls.store.Batch(storage.CreateOp{Tags: ls.filter, Parent: ls.folder}) // New entries stay in view
 			if err != nil {
 				return ls, UpdateStatus(err.Error(), DirtStateUnchanged)
 			}
-			ls.cursor = len(idx) - 1
+			entry := created[0]
+			ls.index = idx
+			ls.query = "" // It has no name yet, so it wouldn't match
+			ls.refilter()
+			ls.follow(entry.Id)
 			return ls, Ask(
 				"What do you want name this entry?",
 				"",
@@ -130,7 +302,10 @@ func (ls ListScreen) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				},
 			)
 		case "r":
-			entryMeta := ls.index[ls.cursor]
+			entryMeta, ok := ls.selected()
+			if !ok {
+				return ls, nil
+			}
 			return ls, Ask(
 				"What do you want to rename it to?",
 				entryMeta.Name,
@@ -143,35 +318,125 @@ func (ls ListScreen) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					return tea.Batch(UpdateIndex(idx), SetUiState(UIStateListing))
 				},
 			)
+		case "N":
+			folder := ls.folder
+			return ls, Ask(
+				"What do you want to name the new folder?",
+				"",
+				"Untitled",
+				func(answer string) tea.Cmd {
+					_, idx, err := ls.store.CreateFolder(answer, folder)
+					if err != nil {
+						return tea.Batch(UpdateStatus(err.Error(), DirtStateUnchanged), SetUiState(UIStateListing))
+					}
+					return tea.Batch(UpdateIndex(idx), SetUiState(UIStateListing))
+				},
+			)
+		case "p":
+			entryMeta, ok := ls.selected()
+			if !ok {
+				return ls, nil
+			}
+			if entryMeta.Folder {
+				return ls, UpdateStatus("Only notes can be pinned.", DirtStateUnchanged)
+			}
+			idx, err := ls.store.Pin(entryMeta.Id, !entryMeta.Pinned)
+			if err != nil {
+				return ls, UpdateStatus(err.Error(), DirtStateUnchanged)
+			}
+			ls.index = idx
+			ls.refilter()
+			ls.follow(entryMeta.Id)
+			status := fmt.Sprintf("Pinned %s", entryMeta.Name)
+			if entryMeta.Pinned {
+				status = fmt.Sprintf("Unpinned %s", entryMeta.Name)
+			}
+			return ls, tea.Batch(UpdateIndex(idx), UpdateStatus(status, DirtStateUnchanged))
+		case "P":
+			return ls, switchPinned(ls.index)
+		case "m":
+			if entryMeta, ok := ls.selected(); ok {
+				return ls, pickFolder(ls.store, ls.index, entryMeta)
+			}
+		case "ctrl+o":
+			if entryMeta, ok := ls.selected(); ok && !entryMeta.Folder {
+				return ls, RequestRevisions(entryMeta)
+			}
+		case "#":
+			if entryMeta, ok := ls.selected(); ok {
+				return ls, editTags(ls.store, entryMeta, UIStateListing)
+			}
+		case "f":
+			placeholder := "Show everything"
+			if tags := ls.index.Tags(); len(tags) > 0 {
+				placeholder = "Tags in use: " + tagChips(tags)
+			}
+			return ls, Ask(
+				"Show only entries with all of these tags, separated by spaces",
+				tagChips(ls.filter),
+				placeholder,
+				func(answer string) tea.Cmd {
+					return tea.Batch(FilterTags(parseTags(answer)), SetUiState(UIStateListing))
+				},
+			)
 		case "d":
-			entryMeta := ls.index[ls.cursor]
+			entryMeta, ok := ls.selected()
+			if !ok {
+				return ls, nil
+			}
+			prompt, yes := fmt.Sprintf("Move %q to the trash?", entryMeta.Name), "Yes, trash it"
+			if entryMeta.Folder {
+				prompt, yes = fmt.Sprintf("Remove the folder %q?", entryMeta.Name), "Yes, remove it"
+			}
 			return ls, PickOne(
-				fmt.Sprintf("Delete %q?", entryMeta.Name),
-				[]string{"No", "Yes, delete for ever!"},
+				prompt,
+				[]string{"No", yes},
 				func(selected int) tea.Cmd {
-					if selected == 1 {
-						idx, err := ls.store.Delete(entryMeta.Id)
-						if err != nil {
-							UpdateStatus(err.Error(), DirtStateUnchanged)
-						}
+					if selected != 1 {
 						return tea.Batch(
-							UpdateStatus(fmt.Sprintf("Deleted %s", entryMeta.Name), DirtStateUnchanged),
+							UpdateStatus("Okay, never mind.", DirtStateUnchanged),
+							SetUiState(UIStateListing),
+						)
+					}
+					idx, err := ls.store.Trash(entryMeta.Id)
+					if err != nil {
+						return tea.Batch(UpdateStatus(err.Error(), DirtStateUnchanged), SetUiState(UIStateListing))
+					}
+					if entryMeta.Folder {
+						return tea.Batch(
+							UpdateStatus(fmt.Sprintf("Removed the empty folder %s", entryMeta.Name), DirtStateUnchanged),
 							UpdateIndex(idx),
 							SetUiState(UIStateListing),
 						)
 					}
 					return tea.Batch(
-						UpdateStatus("Okay, never mind.", DirtStateUnchanged),
+						UpdateStatus(fmt.Sprintf("Moved %s to the trash, press t to see it", entryMeta.Name), DirtStateUnchanged),
+						UpdateIndex(idx),
 						SetUiState(UIStateListing),
 					)
 				},
 			)
+		case "t":
+			return ls, RequestTrash()
+		case "ctrl+f":
+			return ls, RequestSearch()
 		case "enter":
-			if len(ls.index) > 0 && ls.cursor <= len(ls.index)-1 {
-				return ls, RequestEdit(ls.index[ls.cursor])
+			entryMeta, ok := ls.selected()
+			if ok && entryMeta.Folder {
+				ls.enter(entryMeta.Id)
+				return ls, nil
+			}
+			if ok {
+				return ls, RequestEdit(entryMeta)
 			}
 		case "ctrl+e":
-			entryMeta := ls.index[ls.cursor]
+			entryMeta, ok := ls.selected()
+			if !ok {
+				return ls, nil
+			}
+			if entryMeta.Folder {
+				return ls, exportFolder(ls.store, ls.index, entryMeta)
+			}
 			return ls, Ask(
 				"Where do you want to export?",
 				filename(entryMeta.Name),
@@ -191,12 +456,80 @@ func (ls ListScreen) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					if err := os.WriteFile(filename, []byte(entry.Text), 0600); err != nil {
 						return UpdateStatus(err.Error(), DirtStateUnchanged)
 					}
+					if err := os.Chtimes(filename, time.Time{}, entryMeta.Modified); err != nil {
+						return UpdateStatus(err.Error(), DirtStateUnchanged)
+					}
 					return tea.Batch(
 						UpdateStatus("Export successful!", DirtStateUnchanged),
 						SetUiState(UIStateListing),
 					)
 				},
 			)
+		case "ctrl+p":
+			return ls, AskSecret(
+				"Enter the new passphrase",
+				"New passphrase",
+				func(passphrase string) tea.Cmd {
+					return AskSecret(
+						"Repeat the new passphrase",
+						"New passphrase again",
+						func(again string) tea.Cmd {
+							if passphrase != again {
+								return tea.Batch(
+									UpdateStatus("Passphrases did not match, nothing changed.", DirtStateUnchanged),
+									SetUiState(UIStateListing),
+								)
+							}
+							if passphrase == "" {
+								return tea.Batch(
+									UpdateStatus("Refusing to use an empty passphrase.", DirtStateUnchanged),
+									SetUiState(UIStateListing),
+								)
+							}
+							if err := ls.store.Rekey([]byte(passphrase)); err != nil {
+								return tea.Batch(UpdateStatus(err.Error(), DirtStateUnchanged), SetUiState(UIStateListing))
+							}
+							return tea.Batch(
+								UpdateStatus("Passphrase changed!", DirtStateUnchanged),
+								SetUiState(UIStateListing),
+							)
+						},
+					)
+				},
+			)
+		case "ctrl+k":
+			report, err := ls.store.Check(false)
+			if err != nil {
+				return ls, UpdateStatus(err.Error(), DirtStateUnchanged)
+			}
+			if report.Clean() {
+				return ls, UpdateStatus(report.Summary(), DirtStateUnchanged)
+			}
+			return ls, PickOne(
+				report.Summary(),
+				[]string{"Leave it be", "Repair the vault"},
+				func(selected int) tea.Cmd {
+					if selected != 1 {
+						return tea.Batch(
+							UpdateStatus("Okay, never mind.", DirtStateUnchanged),
+							SetUiState(UIStateListing),
+						)
+					}
+					report, err := ls.store.Check(true)
+					if err != nil {
+						return tea.Batch(UpdateStatus(err.Error(), DirtStateUnchanged), SetUiState(UIStateListing))
+					}
+					idx, err := ls.store.Index()
+					if err != nil {
+						return tea.Batch(UpdateStatus(err.Error(), DirtStateUnchanged), SetUiState(UIStateListing))
+					}
+					return tea.Batch(
+						UpdateStatus("Repaired: "+report.Summary(), DirtStateUnchanged),
+						UpdateIndex(idx),
+						SetUiState(UIStateListing),
+					)
+				},
+			)
 		case "ctrl+r":
 			wd, err := os.Getwd()
 			if err != nil {
@@ -212,7 +545,7 @@ func (ls ListScreen) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 						return UpdateStatus(err.Error(), DirtStateUnchanged)
 					}
 					if stat.IsDir() {
-						return UpdateStatus("Can't read a whole directory.", DirtStateUnchanged)
+						return ls.importDirectory(filename)
 					}
 					if stat.Size() > readSizeLimit {
 						return UpdateStatus("No. HardNote does not do well with files that size.", DirtStateUnchanged)
@@ -221,7 +554,7 @@ func (ls ListScreen) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					if err != nil {
 						return UpdateStatus(err.Error(), DirtStateUnchanged)
 					}
-					_, idx, err := ls.store.Create(filepath.Base(filename), string(data))
+					_, idx, err := ls.store.Batch(storage.CreateOp{Name: filepath.Base(filename), Text: string(data), Parent: ls.folder})
 					if err != nil {
 						return UpdateStatus(err.Error(), DirtStateUnchanged)
 					}
@@ -235,15 +568,17 @@ func (ls ListScreen) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 	case IndexUpdateMsg:
 		ls.index = msg.Index
-		if ls.cursor >= len(ls.index) {
-			ls.cursor = len(ls.index) - 1
-		}
-		if ls.cursor < 0 {
-			ls.cursor = 0
+		ls.refilter()
+	case TagFilterMsg:
+		ls.filter = msg.Tags
+		ls.refilter()
+		if len(ls.filter) == 0 {
+			return ls, UpdateStatus("Showing everything", DirtStateUnchanged)
 		}
+		return ls, UpdateStatus(fmt.Sprintf("Showing %d entries tagged %s", len(ls.shown), tagChips(ls.filter)), DirtStateUnchanged)
 	case tea.WindowSizeMsg:
 		ls.height = msg.Height - 2 // Leave room for header and statusbar
-		ls.cursor = min(ls.cursor, len(ls.index)-1)
+		ls.cursor = max(0, min(ls.cursor, len(ls.shown)-1))
 		ls.width = msg.Width
 	}
 	return ls, nil
@@ -253,24 +588,48 @@ func (ls ListScreen) View() string {
 	var screen strings.Builder
 
 	title := "↑↓ Select an entry to edit"
-	if len(ls.index) == 0 {
-		title = "Press n to create a new entry"
+	if ls.typing {
+		title = fmt.Sprintf("/%s▏ ╞═╡ %d matches, enter opens the top one", ls.query, len(ls.shown))
+	} else if ls.query != "" {
+		title = fmt.Sprintf("/%s ╞═╡ %d matches, esc shows everything", ls.query, len(ls.shown))
 	}
-	screen.WriteString(unifiedHeader(title, ls.width))
+	if len(ls.filter) > 0 && (ls.typing || ls.query != "") {
+		title = fmt.Sprintf("Tagged %s ╞═╡ %s", tagChips(ls.filter), title)
+	} else if len(ls.filter) > 0 {
+		title = fmt.Sprintf("Tagged %s ╞═╡ f changes the filter", tagChips(ls.filter))
+		if len(ls.shown) == 0 {
+			title = fmt.Sprintf("Nothing is tagged %s ╞═╡ f changes the filter", tagChips(ls.filter))
+		}
+	} else if len(ls.shown) == 0 && !ls.typing && ls.query == "" {
+		title = "Press n to create a new entry, or N for a new folder"
+	}
+	if ls.folder != uuid.Nil && len(ls.filter) == 0 {
+		title = breadcrumb(ls.index.Path(ls.folder)) + " ╞═╡ " + title
+	}
+	screen.WriteString(unifiedHeader(title+" ╞═╡ "+ls.sort.String(), ls.width))
 
-	start := max(0, (ls.cursor)-(ls.height/2))
-	end := start + ls.height
+	height := ls.height
+	if ls.pinned > 0 && ls.pinned < len(ls.shown) {
+		height-- // Room for the line between the pinned entries and the rest
+	}
+	start := max(0, (ls.cursor)-(height/2))
+	end := start + height
 
-	if end > len(ls.index) {
-		end = len(ls.index)
-		start = max(0, end-ls.height)
+	if end > len(ls.shown) {
+		end = len(ls.shown)
+		start = max(0, end-height)
 	}
 
+	lines := 0
 	for i := start; i < end; i++ {
-		entryMeta := ls.index[i]
+		entryMeta := ls.shown[i]
+		if i == ls.pinned && i > start {
+			screen.WriteString(" ┄┄┄\n")
+			lines++
+		}
 		if i-start == 0 && start != 0 {
 			screen.WriteRune('↑')
-		} else if i-start == ls.height-1 && end < len(ls.index) {
+		} else if i-start == height-1 && end < len(ls.shown) {
 			screen.WriteRune('↓')
 		} else {
 			screen.WriteRune(' ')
@@ -279,24 +638,105 @@ func (ls ListScreen) View() string {
 		if name == "" {
 			name = "Untitled"
 		}
+		positions := ls.found[entryMeta.Id]
+		if entryMeta.Pinned {
+			name = pinMarker + name
+			positions = slices.Clone(positions)
+			for j := range positions {
+				positions[j] += utf8.RuneCountInString(pinMarker)
+			}
+		}
+		detail := timestamp(entryMeta.Modified)
+		switch ls.sort.Key { // Show what it is sorted by
+		case storage.SortCreated:
+			detail = timestamp(entryMeta.Created)
+		case storage.SortSize:
+			detail = fmt.Sprintf("%d bytes", entryMeta.Size)
+		}
+		if entryMeta.Folder {
+			name += "/"
+			detail = fmt.Sprintf("%d inside", len(ls.index.Children(entryMeta.Id)))
+		}
+		if len(entryMeta.Tags) > 0 {
+			name += "  " + tagChips(entryMeta.Tags)
+		}
 
+		row := listRow(name, detail, ls.width)
+		style := listStyleUnselected
 		if i == ls.cursor {
-			screen.WriteString(listStyleSelected.Render(name))
-		} else {
-			screen.WriteString(listStyleUnselected.Render(name))
+			style = listStyleSelected
 		}
+		if len(positions) > 0 {
+			base := lipgloss.NewStyle().Background(style.GetBackground()).Foreground(style.GetForeground())
+			row = highlightRunes(row, positions, base, base.Underline(true).Bold(true))
+		}
+		screen.WriteString(style.Render(row))
 		screen.WriteRune('\n')
+		lines++
 	}
 
-	screen.WriteString(strings.Repeat(" │\n", max(0, ls.height-(end-start))))
+	screen.WriteString(strings.Repeat(" │\n", max(0, ls.height-lines)))
 	return strings.TrimSuffix(screen.String(), "\n")
 }
 
+// importDirectory reads every regular file in the directory as a new entry, all at once or not at all.
+func (ls ListScreen) importDirectory(dirname string) tea.Cmd {
+	files, err := os.ReadDir(dirname)
+	if err != nil {
+		return UpdateStatus(err.Error(), DirtStateUnchanged)
+	}
+	ops := []storage.Op{}
+	for _, file := range files {
+		if !file.Type().IsRegular() {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return UpdateStatus(err.Error(), DirtStateUnchanged)
+		}
+		if info.Size() > readSizeLimit {
+			return UpdateStatus(fmt.Sprintf("No. %s is too big for HardNote.", file.Name()), DirtStateUnchanged)
+		}
+		data, err := os.ReadFile(filepath.Join(dirname, file.Name()))
+		if err != nil {
+			return UpdateStatus(err.Error(), DirtStateUnchanged)
+		}
+		ops = append(ops, storage.CreateOp{Name: file.Name(), Text: string(data), Parent: ls.folder})
+	}
+	if len(ops) == 0 {
+		return UpdateStatus("No files to read in that directory.", DirtStateUnchanged)
+	}
+	_, idx, err := ls.store.Batch(ops...)
+	if err != nil {
+		return UpdateStatus(err.Error(), DirtStateUnchanged)
+	}
+	return tea.Batch(
+		UpdateIndex(idx),
+		SetUiState(UIStateListing),
+		UpdateStatus(fmt.Sprintf("Read %d files", len(ops)), DirtStateUnchanged),
+	)
+}
+
+// listRow puts the detail at the right hand side of the row, if there is room for it next to the name.
+func listRow(name string, detail string, width int) string {
+	const frame = 4 // Leading rune, border and padding
+	gap := width - frame - lipgloss.Width(name) - lipgloss.Width(detail)
+	if gap < 2 {
+		return name
+	}
+	return name + strings.Repeat(" ", gap) + detail
+}
+
+// timestamp formats a time for display, or a dash if it never happened.
+func timestamp(t time.Time) string {
+	if t.IsZero() {
+		return "—"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
+
 func filename(original string) string {
-	filename := strings.ToLower(original)
-	filename = nonWordChars.ReplaceAllString(filename, "_")
-	filename = strings.Trim(filename, "_")
-	filename += ".txt"
+	filename := storage.SafeName(original) + ".txt"
 	wd, err := os.Getwd()
 	if err != nil { // ... what would that error even be?!
 		return filename
@@ -0,0 +1,228 @@
+package ui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DemmyDemon/hardnote/storage"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+var diffStyleRemoved = lipgloss.NewStyle().Foreground(lipgloss.Color("9"))
+var diffStyleAdded = lipgloss.NewStyle().Foreground(lipgloss.Color("10"))
+
+type RevisionsRequestMsg struct {
+	EntryMeta storage.EntryMeta
+}
+
+func RequestRevisions(entryMeta storage.EntryMeta) tea.Cmd {
+	return func() tea.Msg {
+		return RevisionsRequestMsg{
+			EntryMeta: entryMeta,
+		}
+	}
+}
+
+func NewRevisionScreen(data storage.Storage) RevisionScreen {
+	return RevisionScreen{
+		store: data,
+	}
+}
+
+type RevisionScreen struct {
+	height    int
+	width     int
+	store     storage.Storage
+	meta      storage.EntryMeta
+	current   storage.Entry
+	revisions []storage.Revision
+	cursor    int
+	diff      []diffLine
+	offset    int
+}
+
+func (rs RevisionScreen) Init() tea.Cmd {
+	return nil
+}
+
+func (rs RevisionScreen) listHeight() int {
+	return min(len(rs.revisions), max(1, rs.height/3))
+}
+
+func (rs RevisionScreen) diffHeight() int {
+	return max(0, rs.height-rs.listHeight()-1) // Leave room for the separator
+}
+
+func (rs *RevisionScreen) selectRevision(cursor int) {
+	if len(rs.revisions) == 0 {
+		return
+	}
+	rs.cursor = max(0, min(cursor, len(rs.revisions)-1))
+	rs.diff = diffLines(rs.revisions[rs.cursor].Text, rs.current.Text)
+	rs.offset = 0
+}
+
+func (rs *RevisionScreen) scroll(lines int) {
+	rs.offset = max(0, min(rs.offset+lines, len(rs.diff)-rs.diffHeight()))
+}
+
+func (rs RevisionScreen) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case RevisionsRequestMsg:
+		current, err := rs.store.Peek(msg.EntryMeta.Id)
+		if err != nil {
+			return rs, tea.Batch(UpdateStatus(err.Error(), DirtStateUnchanged), SetUiState(UIStateListing))
+		}
+		revisions, err := rs.store.Revisions(msg.EntryMeta.Id)
+		if err != nil {
+			return rs, tea.Batch(UpdateStatus(err.Error(), DirtStateUnchanged), SetUiState(UIStateListing))
+		}
+		if len(revisions) == 0 {
+			return rs, tea.Batch(UpdateStatus(fmt.Sprintf("%q has no earlier revisions", msg.EntryMeta.Name), DirtStateUnchanged), SetUiState(UIStateListing))
+		}
+		rs.meta = msg.EntryMeta
+		rs.current = current
+		rs.revisions = revisions
+		rs.selectRevision(0)
+		return rs, UpdateStatus(fmt.Sprintf("%d revisions of %q", len(revisions), msg.EntryMeta.Name), DirtStateUnchanged)
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "esc":
+			return rs, tea.Batch(SetUiState(UIStateListing), UpdateStatus("Left revisions alone", DirtStateUnchanged))
+		case "up":
+			rs.selectRevision(rs.cursor - 1)
+		case "down":
+			rs.selectRevision(rs.cursor + 1)
+		case "pgup":
+			rs.scroll(-rs.diffHeight())
+		case "pgdown":
+			rs.scroll(rs.diffHeight())
+		case "enter":
+			if len(rs.revisions) == 0 {
+				return rs, nil
+			}
+			revision := rs.revisions[rs.cursor]
+			meta := rs.meta
+			return rs, PickOne(
+				fmt.Sprintf("Restore %q as it was at %s?", meta.Name, timestamp(revision.Saved)),
+				[]string{"No", "Yes, restore it"},
+				func(selected int) tea.Cmd {
+					if selected != 1 {
+						return tea.Batch(
+							UpdateStatus("Okay, never mind.", DirtStateUnchanged),
+							SetUiState(UIStateListing),
+						)
+					}
+					idx, err := rs.store.Update(storage.Entry{Id: meta.Id, Text: revision.Text})
+					if err != nil {
+						return tea.Batch(UpdateStatus(err.Error(), DirtStateUnchanged), SetUiState(UIStateListing))
+					}
+					return tea.Batch(
+						UpdateIndex(idx),
+						RequestEdit(meta),
+						UpdateStatus(fmt.Sprintf("Restored %q from %s", meta.Name, timestamp(revision.Saved)), DirtStateClean),
+					)
+				},
+			)
+		case "r":
+			return rs, rs.askRetention()
+		}
+	case tea.WindowSizeMsg:
+		rs.height = msg.Height - 2 // Leave room for header and statusbar
+		rs.width = msg.Width
+		rs.scroll(0)
+	}
+	return rs, nil
+}
+
+// askRetention asks for how many revisions to keep, and then for how long.
+func (rs RevisionScreen) askRetention() tea.Cmd {
+	settings, err := rs.store.Settings()
+	if err != nil {
+		return UpdateStatus(err.Error(), DirtStateUnchanged)
+	}
+	backToListing := func(status string) tea.Cmd {
+		return tea.Batch(UpdateStatus(status, DirtStateUnchanged), SetUiState(UIStateListing))
+	}
+	return Ask(
+		"How many revisions should be kept per note? 0 keeps none.",
+		strconv.Itoa(settings.RevisionsKept),
+		"Number of revisions",
+		func(answer string) tea.Cmd {
+			kept, err := strconv.Atoi(strings.TrimSpace(answer))
+			if err != nil || kept < 0 {
+				return backToListing("That's not a number of revisions.")
+			}
+			settings.RevisionsKept = kept
+			return Ask(
+				"Forget revisions older than how many days? 0 never forgets.",
+				strconv.Itoa(int(settings.RevisionMaxAge/(24*time.Hour))),
+				"Number of days",
+				func(answer string) tea.Cmd {
+					days, err := strconv.Atoi(strings.TrimSpace(answer))
+					if err != nil || days < 0 {
+						return backToListing("That's not a number of days.")
+					}
+					settings.RevisionMaxAge = time.Duration(days) * 24 * time.Hour
+					if err := rs.store.UpdateSettings(settings); err != nil {
+						return backToListing(err.Error())
+					}
+					if days == 0 {
+						return backToListing(fmt.Sprintf("Keeping %d revisions, for ever", kept))
+					}
+					return backToListing(fmt.Sprintf("Keeping %d revisions, for %d days", kept, days))
+				},
+			)
+		},
+	)
+}
+
+func (rs RevisionScreen) View() string {
+	var screen strings.Builder
+	screen.WriteString(unifiedHeader(fmt.Sprintf("Revisions of %s", rs.meta.Name), rs.width))
+
+	listHeight := rs.listHeight()
+	start := max(0, rs.cursor-(listHeight/2))
+	end := min(len(rs.revisions), start+listHeight)
+	start = max(0, end-listHeight)
+	for i := start; i < end; i++ {
+		revision := rs.revisions[i]
+		row := listRow(
+			timestamp(revision.Saved),
+			fmt.Sprintf("%d bytes", len(revision.Text)),
+			rs.width,
+		)
+		screen.WriteRune(' ')
+		if i == rs.cursor {
+			screen.WriteString(listStyleSelected.Render(row))
+		} else {
+			screen.WriteString(listStyleUnselected.Render(row))
+		}
+		screen.WriteRune('\n')
+	}
+
+	separator := "No revision selected"
+	if len(rs.revisions) > 0 {
+		separator = fmt.Sprintf("Changes since %s, enter restores it", timestamp(rs.revisions[rs.cursor].Saved))
+	}
+	screen.WriteString(unifiedHeader(separator, rs.width))
+
+	diffHeight := rs.diffHeight()
+	for i := rs.offset; i < min(len(rs.diff), rs.offset+diffHeight); i++ {
+		line := rs.diff[i]
+		switch line.kind {
+		case diffRemoved:
+			screen.WriteString(diffStyleRemoved.Render(" - " + line.text))
+		case diffAdded:
+			screen.WriteString(diffStyleAdded.Render(" + " + line.text))
+		default:
+			screen.WriteString(" │ " + line.text)
+		}
+		screen.WriteRune('\n')
+	}
+	screen.WriteString(strings.Repeat(" │\n", max(0, diffHeight-(len(rs.diff)-rs.offset))))
+	return strings.TrimSuffix(screen.String(), "\n")
+}
@@ -0,0 +1,173 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/DemmyDemon/hardnote/storage"
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+var searchStyleName = lipgloss.NewStyle().Bold(true)
+var searchStyleMatch = lipgloss.NewStyle().
+	Background(lipgloss.Color("11")).
+	Foreground(lipgloss.Color("0"))
+
+type SearchRequestMsg struct{}
+
+func RequestSearch() tea.Cmd {
+	return func() tea.Msg {
+		return SearchRequestMsg{}
+	}
+}
+
+// searchRow is one match in one entry, as shown in the search results.
+type searchRow struct {
+	meta  storage.EntryMeta
+	match storage.SearchMatch
+}
+
+func NewSearchScreen(data storage.Storage) SearchScreen {
+	ti := textinput.New()
+	ti.Focus()
+	ti.Prompt = " │ » "
+	ti.Placeholder = "Words to search for"
+	return SearchScreen{
+		store: data,
+		input: ti,
+	}
+}
+
+type SearchScreen struct {
+	height  int
+	width   int
+	cursor  int
+	store   storage.Storage
+	input   textinput.Model
+	rows    []searchRow
+	summary string
+}
+
+func (ss SearchScreen) Init() tea.Cmd {
+	return nil
+}
+
+// search runs the query as it stands, which is quick enough to do for every key press.
+func (ss *SearchScreen) search() error {
+	results, err := ss.store.Search(ss.input.Value())
+	if err != nil {
+		return err
+	}
+	ss.rows = []searchRow{}
+	count := 0
+	for _, result := range results {
+		if result.Meta.Folder {
+			continue
+		}
+		for _, match := range result.Matches {
+			ss.rows = append(ss.rows, searchRow{meta: result.Meta, match: match})
+		}
+		count += result.Count
+	}
+	ss.summary = fmt.Sprintf("%d matches in %d notes", count, len(results))
+	ss.cursor = max(0, min(ss.cursor, len(ss.rows)-1))
+	return nil
+}
+
+func (ss SearchScreen) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case SearchRequestMsg:
+		if err := ss.search(); err != nil { // The notes may have changed since last time
+			return ss, tea.Batch(UpdateStatus(err.Error(), DirtStateUnchanged), SetUiState(UIStateListing))
+		}
+		return ss, nil
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "esc":
+			return ss, SetUiState(UIStateListing)
+		case "up":
+			ss.cursor = max(0, ss.cursor-1)
+			return ss, nil
+		case "down":
+			ss.cursor = max(0, min(ss.cursor+1, len(ss.rows)-1))
+			return ss, nil
+		case "enter":
+			if len(ss.rows) == 0 {
+				return ss, nil
+			}
+			row := ss.rows[ss.cursor]
+			return ss, RequestEditAt(row.meta, row.match.Line, row.match.Column)
+		}
+		inputModel, inputCmd := ss.input.Update(msg)
+		ss.input = inputModel
+		if err := ss.search(); err != nil {
+			return ss, tea.Batch(inputCmd, UpdateStatus(err.Error(), DirtStateUnchanged))
+		}
+		return ss, inputCmd
+	case tea.WindowSizeMsg:
+		ss.height = msg.Height - 3 // Leave room for header, input and statusbar
+		ss.width = msg.Width
+		ss.input.Width = msg.Width
+		return ss, nil
+	}
+	inputModel, inputCmd := ss.input.Update(msg)
+	ss.input = inputModel
+	return ss, inputCmd
+}
+
+func (ss SearchScreen) View() string {
+	var screen strings.Builder
+
+	title := "Search ╞═╡ enter opens the note at the selected match"
+	if strings.TrimSpace(ss.input.Value()) != "" {
+		title = ss.summary + " ╞═╡ enter opens the note at the selected match"
+	}
+	screen.WriteString(unifiedHeader(title, ss.width))
+	screen.WriteString(ss.input.View())
+	screen.WriteRune('\n')
+
+	start := max(0, ss.cursor-(ss.height/2))
+	end := min(len(ss.rows), start+ss.height)
+	start = max(0, end-ss.height)
+
+	for i := start; i < end; i++ {
+		row := ss.rows[i]
+		if i == ss.cursor {
+			screen.WriteString(" ▶ ")
+		} else {
+			screen.WriteString(" │ ")
+		}
+		name := row.meta.Name
+		if name == "" {
+			name = "Untitled"
+		}
+		screen.WriteString(searchStyleName.Render(name))
+		screen.WriteString(": ")
+		before, hit, after := fitSnippet(row.match, ss.width-lipgloss.Width(name)-5)
+		screen.WriteString(before + searchStyleMatch.Render(hit) + after)
+		screen.WriteRune('\n')
+	}
+
+	screen.WriteString(strings.Repeat(" │\n", max(0, ss.height-(end-start))))
+	return strings.TrimSuffix(screen.String(), "\n")
+}
+
+// fitSnippet cuts the snippet down to the width, keeping the match in view if it can.
+func fitSnippet(match storage.SearchMatch, width int) (string, string, string) {
+	before := []rune(strings.ReplaceAll(match.Snippet[:match.Start], "\t", " "))
+	hit := []rune(match.Snippet[match.Start:match.End])
+	after := []rune(strings.ReplaceAll(match.Snippet[match.End:], "\t", " "))
+	width = max(0, width)
+	if len(hit) > width {
+		hit = hit[:width]
+	}
+	if len(before)+len(hit) > width {
+		before = before[len(before)+len(hit)-width:]
+	}
+	if len(before)+len(hit)+len(after) > width {
+		after = after[:width-len(before)-len(hit)]
+	}
+	return string(before), string(hit), string(after)
+}
@@ -0,0 +1,72 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/DemmyDemon/hardnote/storage"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+type TagFilterMsg struct {
+	Tags []string
+}
+
+func FilterTags(tags []string) tea.Cmd {
+	return func() tea.Msg {
+		return TagFilterMsg{
+			Tags: tags,
+		}
+	}
+}
+
+// parseTags reads tags separated by spaces or commas, with or without a leading #.
+func parseTags(text string) []string {
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+	for i, field := range fields {
+		fields[i] = strings.TrimPrefix(field, "#")
+	}
+	return storage.NormalizeTags(fields)
+}
+
+// tagChips renders tags the way they are typed.
+func tagChips(tags []string) string {
+	chips := make([]string, len(tags))
+	for i, tag := range tags {
+		chips[i] = "#" + tag
+	}
+	return strings.Join(chips, " ")
+}
+
+// editTags asks for the new tags of an entry, going back to the given state when done.
+func editTags(store storage.Storage, entryMeta storage.EntryMeta, back uiState) tea.Cmd {
+	placeholder := "No tags"
+	if idx, err := store.Index(); err == nil {
+		for _, meta := range idx {
+			if meta.Id == entryMeta.Id {
+				entryMeta = meta // The one passed in may be stale
+			}
+		}
+		if tags := idx.Tags(); len(tags) > 0 {
+			placeholder = "Tags in use: " + tagChips(tags)
+		}
+	}
+	return Ask(
+		fmt.Sprintf("Tags for %q, separated by spaces", entryMeta.Name),
+		tagChips(entryMeta.Tags),
+		placeholder,
+		func(answer string) tea.Cmd {
+			idx, err := store.Tag(entryMeta.Id, parseTags(answer))
+			if err != nil {
+				return tea.Batch(UpdateStatus(err.Error(), DirtStateUnchanged), SetUiState(back))
+			}
+			return tea.Batch(
+				UpdateIndex(idx),
+				SetUiState(back),
+				UpdateStatus(fmt.Sprintf("Tagged %s", entryMeta.Name), DirtStateUnchanged),
+			)
+		},
+	)
+}
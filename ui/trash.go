@@ -0,0 +1,174 @@
+package ui
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DemmyDemon/hardnote/storage"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+type TrashRequestMsg struct{}
+
+func RequestTrash() tea.Cmd {
+	return func() tea.Msg {
+		return TrashRequestMsg{}
+	}
+}
+
+func NewTrashScreen(data storage.Storage) TrashScreen {
+	return TrashScreen{
+		store: data,
+	}
+}
+
+type TrashScreen struct {
+	height int
+	width  int
+	cursor int
+	store  storage.Storage
+	trash  []storage.TrashedEntry
+}
+
+func (ts TrashScreen) Init() tea.Cmd {
+	return nil
+}
+
+// backToTrash shows the trash again after asking something, with a fresh list of what's in it.
+func backToTrash(message string) tea.Cmd {
+	return tea.Batch(RequestTrash(), UpdateStatus(message, DirtStateUnchanged))
+}
+
+func (ts TrashScreen) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case TrashRequestMsg:
+		trash, err := ts.store.TrashBin()
+		if err != nil {
+			return ts, tea.Batch(UpdateStatus(err.Error(), DirtStateUnchanged), SetUiState(UIStateListing))
+		}
+		ts.trash = trash
+		ts.cursor = max(0, min(ts.cursor, len(ts.trash)-1))
+		return ts, nil
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "esc":
+			return ts, SetUiState(UIStateListing)
+		case "up":
+			ts.cursor = max(0, ts.cursor-1)
+		case "down":
+			ts.cursor = max(0, min(ts.cursor+1, len(ts.trash)-1))
+		case "enter", "r":
+			if len(ts.trash) == 0 {
+				return ts, nil
+			}
+			trashed := ts.trash[ts.cursor]
+			idx, err := ts.store.Restore(trashed.Meta.Id)
+			if err != nil {
+				return ts, UpdateStatus(err.Error(), DirtStateUnchanged)
+			}
+			return ts, tea.Batch(
+				UpdateIndex(idx),
+				backToTrash(fmt.Sprintf("Restored %s", trashed.Meta.Name)),
+			)
+		case "d":
+			if len(ts.trash) == 0 {
+				return ts, nil
+			}
+			trashed := ts.trash[ts.cursor]
+			return ts, PickOne(
+				fmt.Sprintf("Delete %q?", trashed.Meta.Name),
+				[]string{"No", "Yes, delete for ever!"},
+				func(selected int) tea.Cmd {
+					if selected != 1 {
+						return backToTrash("Okay, never mind.")
+					}
+					if err := ts.store.Purge(trashed.Meta.Id); err != nil {
+						return backToTrash(err.Error())
+					}
+					return backToTrash(fmt.Sprintf("Deleted %s", trashed.Meta.Name))
+				},
+			)
+		case "e":
+			if len(ts.trash) == 0 {
+				return ts, UpdateStatus("The trash is already empty.", DirtStateUnchanged)
+			}
+			count := len(ts.trash)
+			return ts, PickOne(
+				fmt.Sprintf("Delete all %d entries in the trash?", count),
+				[]string{"No", "Yes, delete them all for ever!"},
+				func(selected int) tea.Cmd {
+					if selected != 1 {
+						return backToTrash("Okay, never mind.")
+					}
+					if err := ts.store.EmptyTrash(); err != nil {
+						return backToTrash(err.Error())
+					}
+					return backToTrash(fmt.Sprintf("Deleted %d entries", count))
+				},
+			)
+		case "a":
+			settings, err := ts.store.Settings()
+			if err != nil {
+				return ts, UpdateStatus(err.Error(), DirtStateUnchanged)
+			}
+			return ts, Ask(
+				"Delete entries that have been in the trash for how many days? 0 keeps them.",
+				strconv.Itoa(int(settings.TrashMaxAge/(24*time.Hour))),
+				"Number of days",
+				func(answer string) tea.Cmd {
+					days, err := strconv.Atoi(strings.TrimSpace(answer))
+					if err != nil || days < 0 {
+						return backToTrash("That's not a number of days.")
+					}
+					settings.TrashMaxAge = time.Duration(days) * 24 * time.Hour
+					if err := ts.store.UpdateSettings(settings); err != nil {
+						return backToTrash(err.Error())
+					}
+					if days == 0 {
+						return backToTrash("Keeping trash until it is emptied")
+					}
+					return backToTrash(fmt.Sprintf("Keeping trash for %d days", days))
+				},
+			)
+		}
+	case tea.WindowSizeMsg:
+		ts.height = msg.Height - 2 // Leave room for header and statusbar
+		ts.width = msg.Width
+	}
+	return ts, nil
+}
+
+func (ts TrashScreen) View() string {
+	var screen strings.Builder
+
+	title := "Trash ╞═╡ enter restores, d deletes, e empties, a sets auto-delete"
+	if len(ts.trash) == 0 {
+		title = "The trash is empty"
+	}
+	screen.WriteString(unifiedHeader(title, ts.width))
+
+	start := max(0, ts.cursor-(ts.height/2))
+	end := min(len(ts.trash), start+ts.height)
+	start = max(0, end-ts.height)
+
+	for i := start; i < end; i++ {
+		trashed := ts.trash[i]
+		screen.WriteRune(' ')
+		name := trashed.Meta.Name
+		if name == "" {
+			name = "Untitled"
+		}
+		row := listRow(name, "deleted "+timestamp(trashed.Deleted), ts.width)
+		if i == ts.cursor {
+			screen.WriteString(listStyleSelected.Render(row))
+		} else {
+			screen.WriteString(listStyleUnselected.Render(row))
+		}
+		screen.WriteRune('\n')
+	}
+
+	screen.WriteString(strings.Repeat(" │\n", max(0, ts.height-(end-start))))
+	return strings.TrimSuffix(screen.String(), "\n")
+}